@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -18,6 +19,7 @@ import (
 func main() {
 	cfg := config.Load()
 	db := database.Connect(cfg.DatabaseURL)
+	database.PromoteSuperAdmins(db, cfg.SuperAdminPhones)
 
 	app := fiber.New(fiber.Config{
 		AppName: "Shafran Backend",
@@ -28,9 +30,10 @@ func main() {
 	app.Use(recover.New())
 	app.Use(logger.New())
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders: "Content-Type,Authorization",
+		AllowOrigins:  "*",
+		AllowMethods:  "GET,POST,PUT,DELETE,OPTIONS",
+		AllowHeaders:  "Content-Type,Authorization,X-Cart-Token",
+		ExposeHeaders: "Retry-After,X-Cart-Token",
 	}))
 
 	// Ensure uploads directory exists
@@ -39,11 +42,75 @@ func main() {
 	// Serve uploaded files
 	app.Static("/uploads", "./uploads")
 
-	routes.Register(app, db, cfg)
+	services.ConfigureBillzStore(services.BillzStoreConfig{
+		ShopID:         cfg.BillzShopID,
+		CashboxID:      cfg.BillzCashboxID,
+		PaymentTypeID:  cfg.BillzPaymentTypeID,
+		PaymentTypeIDs: cfg.BillzPaymentTypeIDs,
+	})
+	services.ConfigureBillzOutbox(services.BillzOutboxConfig{
+		MaxAttempts: cfg.BillzOutboxMaxAttempts,
+		BaseDelay:   cfg.BillzOutboxBaseDelay,
+		MaxDelay:    cfg.BillzOutboxMaxDelay,
+	})
+
+	smsSender, err := services.NewSMSSender(services.SMSConfig{
+		Provider:      cfg.SMSProvider,
+		EskizBaseURL:  cfg.EskizBaseURL,
+		EskizEmail:    cfg.EskizEmail,
+		EskizPassword: cfg.EskizPassword,
+		EskizFrom:     cfg.EskizFrom,
+		LogFile:       cfg.SMSLogFile,
+	})
+	if err != nil {
+		log.Fatalf("sms sender: %v", err)
+	}
+	telegramService := services.NewTelegramService(cfg.TelegramBotToken, cfg.TelegramAdminChat)
+	backInStock := services.NewBackInStockNotifier(db, smsSender, cfg.StorefrontURL)
+	billzSync := services.NewBillzSyncService(db, services.BillzSyncConfig{
+		ShopIDs: cfg.BillzSyncShopIDs,
+	}, backInStock)
+	billzOutbox := services.NewBillzOutbox(db, telegramService)
+
+	routes.Register(app, db, cfg, routes.Dependencies{
+		SMS:         smsSender,
+		BackInStock: backInStock,
+		BillzSync:   billzSync,
+		BillzOutbox: billzOutbox,
+	})
+
+	go func() {
+		services.BackfillSlugs(db)
+		services.BackfillProductSearch(db)
+	}()
+	services.StartReservationExpiryWorker(db, time.Minute)
+
+	services.ConfigureLoyalty(services.LoyaltyConfig{
+		EarnPercent: cfg.BonusEarnPercent,
+		TTL:         cfg.BonusTTL,
+	})
+	services.StartBonusExpiryWorker(db, time.Hour)
+
+	if cfg.ReminderInterval > 0 {
+		reminders := services.NewReminderService(db, services.ReminderConfig{
+			Channel:       cfg.ReminderChannel,
+			StorefrontURL: cfg.StorefrontURL,
+			CartAge:       cfg.ReminderCartAge,
+			PaymentAge:    cfg.ReminderPayAge,
+			MaxAge:        cfg.ReminderMaxAge,
+		}, smsSender, telegramService)
+		services.StartReminderWorker(reminders, cfg.ReminderInterval)
+	}
 
 	if _, err := services.GetBillzToken(); err != nil {
 		log.Printf("Billz token warm-up failed: %v", err)
 	}
+	if cfg.BillzSyncInterval > 0 {
+		services.StartBillzSyncWorker(billzSync, cfg.BillzSyncInterval)
+	}
+	if cfg.BillzOutboxInterval > 0 {
+		services.StartBillzOutboxWorker(billzOutbox, cfg.BillzOutboxInterval)
+	}
 
 	log.Printf("Starting server on :%s", cfg.AppPort)
 	if err := app.Listen(":" + cfg.AppPort); err != nil {
@@ -62,16 +62,30 @@ func migrate(conn *gorm.DB) error {
 		&models.ProductDescriptionBlock{},
 		&models.ProductHighlight{},
 		&models.ProductRelation{},
+		&models.ProductReview{},
 		&models.Banner{},
 		&models.PickupBranch{},
 		&models.PaymentProvider{},
 		&models.UserAddress{},
 		&models.BonusTransaction{},
+		&models.WishlistItem{},
+		&models.Cart{},
+		&models.CartItem{},
+		&models.Reminder{},
+		&models.PromoCode{},
 		&models.Order{},
 		&models.OrderItem{},
+		&models.OrderStatusHistory{},
+		&models.InventoryReservation{},
+		&models.PromoRedemption{},
 		&models.PaymeTransaction{},
 		&models.PasswordResetToken{},
+		&models.OTPThrottle{},
+		&models.UserSession{},
 		&models.FooterSettings{},
+		&models.SlugRedirect{},
+		&models.BillzSyncRun{},
+		&models.BillzOutbox{},
 	}
 
 	for _, migration := range migrations {
@@ -80,9 +94,81 @@ func migrate(conn *gorm.DB) error {
 		}
 	}
 
+	if err := migrateSearch(conn); err != nil {
+		return err
+	}
+	return migrateWishlist(conn)
+}
+
+// migrateSearch sets up the full-text and trigram indexes behind product
+// search. search_vector weighs the brand and name above the rest of the text.
+func migrateSearch(conn *gorm.DB) error {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (
+				setweight(to_tsvector('simple', coalesce(search_key, '')), 'A') ||
+				setweight(to_tsvector('simple', coalesce(search_document, '')), 'B')
+			) STORED`,
+		`CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector)`,
+		`CREATE INDEX IF NOT EXISTS idx_products_search_key_trgm ON products USING GIN (search_key gin_trgm_ops)`,
+	}
+
+	for _, statement := range statements {
+		if err := conn.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// migrateWishlist keeps one wishlist item per user, product and variant.
+// Product-level items have no variant, and NULLs never conflict in a unique
+// index, so they get an index of their own. Duplicates saved before the
+// indexes existed are dropped, keeping the oldest item.
+func migrateWishlist(conn *gorm.DB) error {
+	statements := []string{
+		`DELETE FROM wishlist_items AS dup
+			USING wishlist_items AS kept
+			WHERE dup.user_id = kept.user_id
+				AND dup.product_id = kept.product_id
+				AND dup.product_variant_id IS NOT DISTINCT FROM kept.product_variant_id
+				AND (dup.created_at, dup.id) > (kept.created_at, kept.id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_wishlist_items_user_product_variant
+			ON wishlist_items (user_id, product_id, product_variant_id)
+			WHERE product_variant_id IS NOT NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_wishlist_items_user_product
+			ON wishlist_items (user_id, product_id)
+			WHERE product_variant_id IS NULL`,
+	}
+
+	for _, statement := range statements {
+		if err := conn.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PromoteSuperAdmins grants the super admin role to the users registered with
+// the given phone numbers so the back office can be bootstrapped from config.
+func PromoteSuperAdmins(conn *gorm.DB, phones []string) {
+	if len(phones) == 0 {
+		return
+	}
+
+	result := conn.Model(&models.User{}).
+		Where("phone IN ? AND role <> ?", phones, models.RoleSuperAdmin).
+		Update("role", models.RoleSuperAdmin)
+	if result.Error != nil {
+		log.Printf("failed to promote super admins: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("promoted %d user(s) to super admin", result.RowsAffected)
+	}
+}
+
 func ensureDatabase(dsn string) error {
 	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
 		return nil
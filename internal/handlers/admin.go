@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"errors"
+	"strings"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
+	"github.com/example/shafran/internal/middleware"
 	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
 	"github.com/example/shafran/internal/utils"
 )
 
@@ -48,10 +54,10 @@ func (h *AdminHandler) DashboardStats(c *fiber.Ctx) error {
 		ordersByStatus[sc.Status] = sc.Count
 	}
 
-	// Total revenue (sum of total_amount for non-cancelled orders)
+	// Total revenue (sum of total_amount for non-cancelled, non-refunded orders)
 	var totalRevenue float64
 	if err := h.db.Model(&models.Order{}).
-		Where("status != ?", "cancelled").
+		Where("status NOT IN ?", []string{models.OrderStatusCancelled, models.OrderStatusRefunded}).
 		Select("COALESCE(SUM(total_amount), 0)").
 		Scan(&totalRevenue).Error; err != nil {
 		return err
@@ -60,7 +66,7 @@ func (h *AdminHandler) DashboardStats(c *fiber.Ctx) error {
 	// Today's revenue
 	var todayRevenue float64
 	if err := h.db.Model(&models.Order{}).
-		Where("status != ? AND placed_at::date = CURRENT_DATE", "cancelled").
+		Where("status NOT IN ? AND placed_at::date = CURRENT_DATE", []string{models.OrderStatusCancelled, models.OrderStatusRefunded}).
 		Select("COALESCE(SUM(total_amount), 0)").
 		Scan(&todayRevenue).Error; err != nil {
 		return err
@@ -144,7 +150,7 @@ func (h *AdminHandler) ListAllUsers(c *fiber.Ctx) error {
 
 	// Select specific fields to avoid exposing password hash
 	var users []models.User
-	if err := query.Select("id, first_name, last_name, phone, display_name, is_verified, created_at, updated_at").
+	if err := query.Select("id, first_name, last_name, phone, display_name, is_verified, role, created_at, updated_at").
 		Order("created_at desc").
 		Limit(pg.Limit).Offset(pg.Offset).
 		Find(&users).Error; err != nil {
@@ -195,6 +201,43 @@ func (h *AdminHandler) ListAllUsers(c *fiber.Ctx) error {
 	})
 }
 
+type updateUserRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// UpdateUserRole assigns a role to a user (super admin only).
+func (h *AdminHandler) UpdateUserRole(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req updateUserRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	if !models.IsValidRole(req.Role) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid role")
+	}
+
+	result := h.db.Model(&models.User{}).Where("id = ?", id).Update("role", req.Role)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "user not found")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"id":   id,
+			"role": req.Role,
+		},
+	})
+}
+
 // RecentOrders returns the most recent 5 orders for the dashboard.
 func (h *AdminHandler) RecentOrders(c *fiber.Ctx) error {
 	var orders []models.Order
@@ -210,3 +253,96 @@ func (h *AdminHandler) RecentOrders(c *fiber.Ctx) error {
 		"data":    orders,
 	})
 }
+
+// GetOrder returns a single order with its items and status history.
+func (h *AdminHandler) GetOrder(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var order models.Order
+	if err := h.db.Preload("Items").Preload("User").
+		Preload("StatusHistory", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at asc")
+		}).
+		Preload("StatusHistory.ChangedBy").
+		First(&order, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "order not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"order":         order,
+			"next_statuses": models.AdminNextOrderStatuses(order.Status, order.PaymentMethod),
+		},
+	})
+}
+
+type updateOrderStatusRequest struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// UpdateOrderStatus moves an order to the next status of its lifecycle.
+func (h *AdminHandler) UpdateOrderStatus(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req updateOrderStatusRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if !models.IsValidOrderStatus(req.Status) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid status")
+	}
+	if req.Status == models.OrderStatusPaid {
+		return fiber.NewError(fiber.StatusBadRequest, "orders are marked paid by their payment provider")
+	}
+
+	actorID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	var order *models.Order
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var txErr error
+		order, txErr = services.AdminTransitionOrderStatus(tx, id, req.Status, &actorID, strings.TrimSpace(req.Note))
+		return txErr
+	})
+	if err != nil {
+		var transitionErr *services.OrderTransitionError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return fiber.NewError(fiber.StatusNotFound, "order not found")
+		case errors.As(err, &transitionErr):
+			var paymentMethod string
+			if err := h.db.Model(&models.Order{}).Where("id = ?", id).Pluck("payment_method", &paymentMethod).Error; err != nil {
+				return err
+			}
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"success":       false,
+				"message":       transitionErr.Error(),
+				"status":        transitionErr.From,
+				"next_statuses": models.AdminNextOrderStatuses(transitionErr.From, paymentMethod),
+			})
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"id":            order.ID,
+			"status":        order.Status,
+			"next_statuses": models.AdminNextOrderStatuses(order.Status, order.PaymentMethod),
+		},
+	})
+}
@@ -1,28 +1,37 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"log"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"github.com/example/shafran/internal/config"
 	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
 	"github.com/example/shafran/internal/utils"
 )
 
 // AuthHandler bundles dependencies for authentication endpoints.
 type AuthHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db       *gorm.DB
+	cfg      *config.Config
+	sms      services.SMSSender
+	otp      *services.OTPGuard
+	sessions *services.SessionService
 }
 
 // NewAuthHandler constructs an AuthHandler.
-func NewAuthHandler(db *gorm.DB, cfg *config.Config) *AuthHandler {
-	return &AuthHandler{db: db, cfg: cfg}
+func NewAuthHandler(db *gorm.DB, cfg *config.Config, sms services.SMSSender, otp *services.OTPGuard, sessions *services.SessionService) *AuthHandler {
+	return &AuthHandler{db: db, cfg: cfg, sms: sms, otp: otp, sessions: sessions}
 }
 
 type registerRequest struct {
@@ -30,6 +39,7 @@ type registerRequest struct {
 	LastName  string `json:"last_name"`
 	Phone     string `json:"phone"`
 	Password  string `json:"password"`
+	CartToken string `json:"cart_token"`
 }
 
 // Register creates a new user account.
@@ -43,6 +53,10 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "missing required fields")
 	}
 
+	if err := h.otp.CheckSend(services.OTPPurposeVerification, c.IP(), nil); err != nil {
+		return otpError(c, err)
+	}
+
 	var existing models.User
 	if err := h.db.Where("phone = ?", req.Phone).First(&existing).Error; err == nil {
 		return fiber.NewError(fiber.StatusConflict, "user already exists")
@@ -62,6 +76,7 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		DisplayName:  fmt.Sprintf("%s %s", req.FirstName, req.LastName),
 		PasswordHash: passwordHash,
 		IsVerified:   false,
+		Role:         models.RoleCustomer,
 	}
 
 	if err := h.db.Create(&user).Error; err != nil {
@@ -73,22 +88,21 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to generate verification code")
 	}
 
-	verification := models.SMSVerification{
-		Phone:     req.Phone,
-		Code:      code,
-		ExpiresAt: time.Now().Add(10 * time.Minute),
-		Verified:  false,
-	}
-
-	if err := h.db.Create(&verification).Error; err != nil {
-		return err
+	// The account is kept even if the SMS cannot be delivered; the client
+	// can request a new code.
+	verificationSent := true
+	if err := h.sendVerificationCode(req.Phone, code, c.IP()); err != nil {
+		log.Printf("[Auth] %s failed to send verification code to %s: %v", h.sms.Name(), req.Phone, err)
+		verificationSent = false
 	}
 
-	token, err := utils.GenerateToken(h.cfg.JWTSecret, user.ID, h.cfg.TokenExpires)
+	tokens, err := h.sessions.Issue(context.Background(), &user, c.Get(fiber.HeaderUserAgent), c.IP())
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to generate token")
 	}
 
+	h.mergeGuestCart(c, user.ID, req.CartToken)
+
 	respUser := map[string]interface{}{
 		"id":           user.ID,
 		"first_name":   user.FirstName,
@@ -98,15 +112,20 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"success": true,
-		"user":    respUser,
-		"token":   token,
+		"success":            true,
+		"user":               respUser,
+		"token":              tokens.AccessToken,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+		"verification_sent":  verificationSent,
 	})
 }
 
 type loginRequest struct {
-	Phone    string `json:"phone"`
-	Password string `json:"password"`
+	Phone     string `json:"phone"`
+	Password  string `json:"password"`
+	CartToken string `json:"cart_token"`
 }
 
 // Login authenticates an existing user.
@@ -128,21 +147,95 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
 	}
 
-	token, err := utils.GenerateToken(h.cfg.JWTSecret, user.ID, h.cfg.TokenExpires)
+	tokens, err := h.sessions.Issue(context.Background(), &user, c.Get(fiber.HeaderUserAgent), c.IP())
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to generate token")
 	}
 
+	h.mergeGuestCart(c, user.ID, req.CartToken)
+
 	respUser := map[string]interface{}{
 		"id":           user.ID,
 		"display_name": user.DisplayName,
 		"phone":        user.Phone,
+		"role":         user.Role,
+	}
+
+	return c.JSON(fiber.Map{
+		"success":            true,
+		"user":               respUser,
+		"token":              tokens.AccessToken,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+	})
+}
+
+// mergeGuestCart attaches the guest cart the client was using before it
+// signed in. Failures only cost the guest cart and do not fail the sign-in.
+func (h *AuthHandler) mergeGuestCart(c *fiber.Ctx, userID uuid.UUID, token string) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		token = strings.TrimSpace(c.Get(cartTokenHeader))
+	}
+	if token == "" {
+		return
+	}
+	if _, err := services.MergeGuestCart(h.db, userID, token); err != nil && !errors.Is(err, services.ErrCartNotFound) {
+		log.Printf("[Auth] failed to merge guest cart for user %s: %v", userID, err)
+	}
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh exchanges a refresh token for a new token pair.
+func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
+	var req refreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	tokens, err := h.sessions.Refresh(context.Background(), req.RefreshToken, c.Get(fiber.HeaderUserAgent), c.IP())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrRefreshTokenReused):
+			log.Printf("[Auth] refresh token reuse detected from %s, session revoked", c.IP())
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid refresh token")
+		case errors.Is(err, services.ErrInvalidRefreshToken):
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid refresh token")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success":            true,
+		"token":              tokens.AccessToken,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+	})
+}
+
+// Logout revokes the session identified by the refresh token.
+func (h *AuthHandler) Logout(c *fiber.Ctx) error {
+	var req refreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.RefreshToken == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "refresh_token is required")
+	}
+
+	// Logging out twice is not an error.
+	if err := h.sessions.RevokeByRefreshToken(context.Background(), req.RefreshToken); err != nil &&
+		!errors.Is(err, services.ErrSessionNotFound) {
+		return err
 	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
-		"user":    respUser,
-		"token":   token,
 	})
 }
 
@@ -158,6 +251,10 @@ func (h *AuthHandler) Verify(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
+	if err := h.otp.CheckVerify(services.OTPPurposeVerification, req.Phone, c.IP()); err != nil {
+		return otpError(c, err)
+	}
+
 	var verification models.SMSVerification
 	err := h.db.Where("phone = ?", req.Phone).
 		Order("created_at desc").
@@ -169,14 +266,25 @@ func (h *AuthHandler) Verify(c *fiber.Ctx) error {
 		return err
 	}
 
-	if verification.Code != req.Code {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid verification code")
-	}
-
 	if verification.ExpiresAt.Before(time.Now()) {
 		return fiber.NewError(fiber.StatusBadRequest, "verification code expired")
 	}
 
+	claimed, err := claimCodeAttempt(h.db, &verification, h.otp.MaxAttempts())
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return exhaustedCodeError(c, h.otp, verification.CreatedAt)
+	}
+
+	if verification.Code != req.Code {
+		if err := h.otp.RecordFailure(services.OTPPurposeVerification, req.Phone, c.IP()); err != nil {
+			return otpError(c, err)
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "invalid verification code")
+	}
+
 	verification.Verified = true
 	now := time.Now()
 	verification.UsedAt = &now
@@ -189,12 +297,93 @@ func (h *AuthHandler) Verify(c *fiber.Ctx) error {
 		return err
 	}
 
+	if err := h.otp.RecordSuccess(services.OTPPurposeVerification, req.Phone); err != nil {
+		log.Printf("[Auth] failed to reset OTP counter for %s: %v", req.Phone, err)
+	}
+
 	return c.JSON(fiber.Map{
 		"success":  true,
 		"verified": true,
 	})
 }
 
+type resendCodeRequest struct {
+	Phone string `json:"phone"`
+}
+
+// ResendCode issues a new verification code to an unverified account.
+func (h *AuthHandler) ResendCode(c *fiber.Ctx) error {
+	var req resendCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if req.Phone == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "phone is required")
+	}
+
+	lastSentAt, err := lastSMSVerificationAt(h.db, req.Phone)
+	if err != nil {
+		return err
+	}
+	if err := h.otp.CheckSend(services.OTPPurposeVerification, c.IP(), lastSentAt); err != nil {
+		return otpError(c, err)
+	}
+
+	var user models.User
+	if err := h.db.Where("phone = ?", req.Phone).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "user not found")
+		}
+		return err
+	}
+	if user.IsVerified {
+		return fiber.NewError(fiber.StatusBadRequest, "phone is already verified")
+	}
+
+	code, err := generateVerificationCode()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to generate verification code")
+	}
+
+	if err := h.sendVerificationCode(req.Phone, code, c.IP()); err != nil {
+		log.Printf("[Auth] %s failed to resend verification code to %s: %v", h.sms.Name(), req.Phone, err)
+		return fiber.NewError(fiber.StatusBadGateway, "failed to send verification code")
+	}
+
+	return c.JSON(fiber.Map{
+		"success":     true,
+		"retry_after": int(h.otp.ResendCooldown() / time.Second),
+	})
+}
+
+// sendVerificationCode replaces any open verification code for the phone
+// with a new one and sends it by SMS.
+func (h *AuthHandler) sendVerificationCode(phone, code, ip string) error {
+	now := time.Now()
+	if err := h.db.Model(&models.SMSVerification{}).
+		Where("phone = ? AND used_at IS NULL AND expires_at > ?", phone, now).
+		Update("expires_at", now).Error; err != nil {
+		return err
+	}
+
+	verification := models.SMSVerification{
+		Phone:     phone,
+		Code:      code,
+		ExpiresAt: now.Add(10 * time.Minute),
+		Verified:  false,
+		RequestIP: ip,
+	}
+	if err := h.db.Create(&verification).Error; err != nil {
+		return err
+	}
+
+	if err := h.otp.RecordSend(services.OTPPurposeVerification, ip); err != nil {
+		log.Printf("[Auth] failed to record OTP send for %s: %v", ip, err)
+	}
+
+	return h.sms.Send(phone, services.OTPMessage(services.OTPPurposeVerification, code))
+}
+
 func generateVerificationCode() (string, error) {
 	max := big.NewInt(1000000)
 	n, err := rand.Int(rand.Reader, max)
@@ -2,36 +2,92 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 
+	"github.com/example/shafran/internal/middleware"
+	"github.com/example/shafran/internal/models"
 	"github.com/example/shafran/internal/services"
+	"github.com/example/shafran/internal/utils"
 )
 
-// BillzHandler provides endpoints that proxy requests to the Billz API.
-type BillzHandler struct{}
+// BillzHandler provides endpoints that proxy requests to the Billz API,
+// manage the catalog sync and the order push outbox.
+type BillzHandler struct {
+	db     *gorm.DB
+	sync   *services.BillzSyncService
+	outbox *services.BillzOutbox
+	proxy  *services.BillzProxy
+}
 
 // NewBillzHandler builds a BillzHandler instance.
-func NewBillzHandler() *BillzHandler {
-	return &BillzHandler{}
+func NewBillzHandler(db *gorm.DB, sync *services.BillzSyncService, outbox *services.BillzOutbox, proxy *services.BillzProxy) *BillzHandler {
+	return &BillzHandler{db: db, sync: sync, outbox: outbox, proxy: proxy}
+}
+
+// billzProxyRequestHeaders are the client headers passed on to Billz.
+var billzProxyRequestHeaders = []string{
+	fiber.HeaderAccept,
+	fiber.HeaderAcceptLanguage,
+	fiber.HeaderContentType,
+	"Billz-Response-Channel",
+}
+
+// proxyPath returns the Billz API path of a proxied request.
+func proxyPath(c *fiber.Ctx) (string, error) {
+	// Read from the full path; route params are not resolved in group middleware.
+	raw := strings.TrimPrefix(c.Path(), "/api/billz")
+	apiPath, ok := services.CleanBillzProxyPath(strings.Trim(raw, "/"))
+	if !ok {
+		return "", fiber.NewError(fiber.StatusBadRequest, "missing Billz API path")
+	}
+	return apiPath, nil
+}
+
+// ProxyAccess rate limits proxy clients and lets reads of allowlisted paths
+// through. Other reads go through requireReader and writes through
+// requireWriter. It must be mounted after OptionalAuthMiddleware.
+func (h *BillzHandler) ProxyAccess(requireReader, requireWriter fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		client := c.IP()
+		if userID, ok := middleware.GetCurrentUserID(c); ok {
+			client = userID.String()
+		}
+		if err := h.proxy.Allow(client); err != nil {
+			return otpError(c, err)
+		}
+
+		apiPath, err := proxyPath(c)
+		if err != nil {
+			return err
+		}
+		method := c.Method()
+		if h.proxy.IsPublic(method, apiPath) {
+			return c.Next()
+		}
+		if method == http.MethodGet || method == http.MethodHead {
+			return requireReader(c)
+		}
+		return requireWriter(c)
+	}
 }
 
 // Proxy forwards the incoming request to the Billz API, injecting the server-side token.
+// Public reads are served from cache while fresh.
 func (h *BillzHandler) Proxy(c *fiber.Ctx) error {
 	method := strings.ToUpper(strings.TrimSpace(c.Method()))
 	if method == "" {
 		method = http.MethodGet
 	}
 
-	path := strings.TrimLeft(strings.TrimSpace(c.Params("*")), "/")
-	if path == "" {
-		// Support calls to /billz without trailing path by attempting to reuse current route.
-		path = strings.TrimLeft(strings.TrimPrefix(c.OriginalURL(), "/api/billz"), "/")
-	}
-	if path == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "missing Billz API path")
+	path, err := proxyPath(c)
+	if err != nil {
+		return err
 	}
 
 	var body any
@@ -44,14 +100,19 @@ func (h *BillzHandler) Proxy(c *fiber.Ctx) error {
 		queryMap[k] = v
 	}
 
-	reqHeaders := c.GetReqHeaders()
-	headers := make(map[string]string, len(reqHeaders))
-	for k, vals := range reqHeaders {
-		if strings.EqualFold(k, "Authorization") {
-			continue
+	headers := make(map[string]string, len(billzProxyRequestHeaders))
+	for _, name := range billzProxyRequestHeaders {
+		if value := c.Get(name); value != "" {
+			headers[name] = value
 		}
-		if len(vals) > 0 {
-			headers[k] = vals[0]
+	}
+
+	cacheKey := ""
+	if method == http.MethodGet && h.proxy.IsPublic(method, path) {
+		cacheKey = h.proxy.CacheKey(method, path, queryMap, headers)
+		if cached, ok := h.proxy.Cached(cacheKey); ok {
+			c.Set("X-Cache", "HIT")
+			return sendBillzProxyResponse(c, cached)
 		}
 	}
 
@@ -68,21 +129,152 @@ func (h *BillzHandler) Proxy(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadGateway, err.Error())
 	}
 
+	out := services.BillzProxyResponse{
+		Status:      resp.Status,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        resp.Body,
+	}
+	if cacheKey != "" {
+		h.proxy.Store(cacheKey, out)
+		c.Set("X-Cache", "MISS")
+	}
+	return sendBillzProxyResponse(c, out)
+}
+
+// sendBillzProxyResponse writes a Billz reply. Only the content type is
+// passed on from the Billz headers.
+func sendBillzProxyResponse(c *fiber.Ctx, resp services.BillzProxyResponse) error {
 	c.Status(resp.Status)
+	if resp.ContentType != "" {
+		c.Set(fiber.HeaderContentType, resp.ContentType)
+	}
+	return c.Send(resp.Body)
+}
+
+// RunSync pulls the Billz catalog now and returns the recorded run.
+func (h *BillzHandler) RunSync(c *fiber.Ctx) error {
+	run, err := h.sync.Run("manual")
+	if errors.Is(err, services.ErrBillzSyncRunning) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if run == nil {
+		return err
+	}
+	// A failed run is still recorded; its error is part of the run.
+	return c.JSON(fiber.Map{"success": err == nil, "data": run})
+}
+
+// ListSyncRuns returns recent sync runs without their reports.
+func (h *BillzHandler) ListSyncRuns(c *fiber.Ctx) error {
+	pg := utils.ParsePagination(c)
+	query := h.db.Model(&models.BillzSyncRun{})
 
-	if ct := resp.Header.Get("Content-Type"); ct != "" {
-		c.Set("Content-Type", ct)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
 	}
 
-	for k, vals := range resp.Header {
-		if len(vals) == 0 {
-			continue
+	var runs []models.BillzSyncRun
+	if err := query.Omit("report").
+		Order("started_at desc").
+		Limit(pg.Limit).Offset(pg.Offset).
+		Find(&runs).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    runs,
+		"pagination": fiber.Map{
+			"current_page":   pg.Page,
+			"items_per_page": pg.Limit,
+			"total_items":    total,
+		},
+	})
+}
+
+// GetSyncRun returns a sync run with its diff report.
+func (h *BillzHandler) GetSyncRun(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var run models.BillzSyncRun
+	if err := h.db.First(&run, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "sync run not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": run})
+}
+
+// ListOutbox returns queued Billz order pushes. Without a status filter,
+// completed pushes are left out.
+func (h *BillzHandler) ListOutbox(c *fiber.Ctx) error {
+	pg := utils.ParsePagination(c)
+	query := h.db.Model(&models.BillzOutbox{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	} else {
+		query = query.Where("status <> ?", models.BillzOutboxStatusDone)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
+	}
+
+	var entries []models.BillzOutbox
+	if err := query.Order("created_at desc").
+		Limit(pg.Limit).Offset(pg.Offset).
+		Find(&entries).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    entries,
+		"pagination": fiber.Map{
+			"current_page":   pg.Page,
+			"items_per_page": pg.Limit,
+			"total_items":    total,
+		},
+	})
+}
+
+// ReplayOutbox retries a failed or dead-lettered Billz order push now.
+func (h *BillzHandler) ReplayOutbox(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	entry, err := h.outbox.Replay(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "outbox entry not found")
 		}
-		if strings.EqualFold(k, "Content-Type") || strings.EqualFold(k, "Content-Length") {
-			continue
+		if errors.Is(err, services.ErrBillzOutboxNotReplayable) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
 		}
-		c.Set(k, vals[0])
+		return err
 	}
+	// A failed replay is recorded on the entry.
+	return c.JSON(fiber.Map{"success": entry.Status == models.BillzOutboxStatusDone, "data": entry})
+}
 
-	return c.Send(resp.Body)
+// ListShops returns the Billz shops and cashboxes pickup branches can be
+// mapped to.
+func (h *BillzHandler) ListShops(c *fiber.Ctx) error {
+	shops, err := services.ListBillzShops()
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadGateway, err.Error())
+	}
+	return c.JSON(fiber.Map{"success": true, "data": shops})
 }
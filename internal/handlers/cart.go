@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/middleware"
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+	"github.com/example/shafran/internal/utils"
+)
+
+// cartTokenHeader carries the guest cart token between client and server.
+const cartTokenHeader = "X-Cart-Token"
+
+// CartHandler manages the shopping cart of guests and signed-in customers.
+type CartHandler struct {
+	db *gorm.DB
+}
+
+// NewCartHandler constructs CartHandler.
+func NewCartHandler(db *gorm.DB) *CartHandler {
+	return &CartHandler{db: db}
+}
+
+// cartOwner returns the signed-in user, if any, and the guest cart token.
+func cartOwner(c *fiber.Ctx) (*uuid.UUID, string) {
+	token := strings.TrimSpace(c.Get(cartTokenHeader))
+	if token == "" {
+		token = strings.TrimSpace(c.Query("cart_token"))
+	}
+	if userID, ok := middleware.GetCurrentUserID(c); ok {
+		return &userID, token
+	}
+	return nil, token
+}
+
+func (h *CartHandler) respond(c *fiber.Ctx, status int, cart *models.Cart) error {
+	summary, err := services.PriceCart(h.db, cart)
+	if err != nil {
+		return err
+	}
+	c.Set(cartTokenHeader, cart.Token)
+	return c.Status(status).JSON(fiber.Map{"success": true, "data": summary})
+}
+
+func cartError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrCartNotFound):
+		return fiber.NewError(fiber.StatusNotFound, "cart not found")
+	case errors.Is(err, services.ErrCartItemNotFound):
+		return fiber.NewError(fiber.StatusNotFound, "cart item not found")
+	case errors.Is(err, services.ErrCartVariantNotFound):
+		return fiber.NewError(fiber.StatusNotFound, "product variant not found")
+	case errors.Is(err, services.ErrCartVariantInactive):
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+	return err
+}
+
+// GetCart returns the current cart priced against the catalog. A missing cart
+// is returned as an empty one without being created.
+func (h *CartHandler) GetCart(c *fiber.Ctx) error {
+	userID, token := cartOwner(c)
+	cart, err := services.FindActiveCart(h.db, userID, token)
+	if errors.Is(err, services.ErrCartNotFound) {
+		return c.JSON(fiber.Map{"success": true, "data": services.CartSummary{
+			Status: models.CartStatusActive,
+			Items:  []services.CartLine{},
+		}})
+	}
+	if err != nil {
+		return err
+	}
+	return h.respond(c, fiber.StatusOK, cart)
+}
+
+type addCartItemRequest struct {
+	ProductVariantID string `json:"product_variant_id"`
+	Quantity         int    `json:"quantity"`
+}
+
+// AddItem puts a variant into the cart, creating the cart on first use.
+func (h *CartHandler) AddItem(c *fiber.Ctx) error {
+	var req addCartItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	variantID, err := uuid.Parse(req.ProductVariantID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid product_variant_id")
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.Quantity < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "quantity must be greater than zero")
+	}
+
+	userID, token := cartOwner(c)
+	cart, err := services.OpenCart(h.db, userID, token)
+	if err != nil {
+		return err
+	}
+	if err := services.AddCartItem(h.db, cart, variantID, req.Quantity); err != nil {
+		return cartError(err)
+	}
+
+	return h.respond(c, fiber.StatusCreated, cart)
+}
+
+type updateCartItemRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// UpdateItem sets the quantity of a cart line; zero removes it.
+func (h *CartHandler) UpdateItem(c *fiber.Ctx) error {
+	itemID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req updateCartItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	userID, token := cartOwner(c)
+	cart, err := services.FindActiveCart(h.db, userID, token)
+	if err != nil {
+		return cartError(err)
+	}
+	if err := services.SetCartItemQuantity(h.db, cart, itemID, req.Quantity); err != nil {
+		return cartError(err)
+	}
+
+	return h.respond(c, fiber.StatusOK, cart)
+}
+
+// RemoveItem deletes a cart line.
+func (h *CartHandler) RemoveItem(c *fiber.Ctx) error {
+	itemID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	userID, token := cartOwner(c)
+	cart, err := services.FindActiveCart(h.db, userID, token)
+	if err != nil {
+		return cartError(err)
+	}
+	if err := services.RemoveCartItem(h.db, cart, itemID); err != nil {
+		return cartError(err)
+	}
+
+	return h.respond(c, fiber.StatusOK, cart)
+}
+
+// ClearCart empties the current cart.
+func (h *CartHandler) ClearCart(c *fiber.Ctx) error {
+	userID, token := cartOwner(c)
+	cart, err := services.FindActiveCart(h.db, userID, token)
+	if err != nil {
+		return cartError(err)
+	}
+	if err := services.ClearCart(h.db, cart); err != nil {
+		return err
+	}
+
+	return h.respond(c, fiber.StatusOK, cart)
+}
+
+type mergeCartRequest struct {
+	CartToken string `json:"cart_token"`
+}
+
+// MergeCart folds a guest cart into the signed-in user's cart.
+func (h *CartHandler) MergeCart(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	var req mergeCartRequest
+	_ = c.BodyParser(&req)
+	token := strings.TrimSpace(req.CartToken)
+	if token == "" {
+		_, token = cartOwner(c)
+	}
+	if token == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "cart_token is required")
+	}
+
+	cart, err := services.MergeGuestCart(h.db, userID, token)
+	if err != nil {
+		return cartError(err)
+	}
+
+	return h.respond(c, fiber.StatusOK, cart)
+}
+
+// ListAbandonedCarts returns non-empty carts without activity for the given
+// number of hours (default 24).
+func (h *CartHandler) ListAbandonedCarts(c *fiber.Ctx) error {
+	hours, err := strconv.Atoi(c.Query("hours", "24"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	cutoff := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	pg := utils.ParsePagination(c)
+	query := h.db.Model(&models.Cart{}).
+		Where("status = ? AND last_activity_at < ?", models.CartStatusActive, cutoff).
+		Where("EXISTS (SELECT 1 FROM cart_items WHERE cart_items.cart_id = carts.id)")
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
+	}
+
+	var carts []models.Cart
+	if err := query.Preload("User").
+		Preload("Items").
+		Order("last_activity_at desc").
+		Limit(pg.Limit).Offset(pg.Offset).
+		Find(&carts).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    carts,
+		"pagination": fiber.Map{
+			"current_page":   pg.Page,
+			"items_per_page": pg.Limit,
+			"total_items":    total,
+		},
+	})
+}
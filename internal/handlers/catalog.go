@@ -1,11 +1,15 @@
 package handlers
 
 import (
+	"errors"
+	"strings"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
 	"github.com/example/shafran/internal/utils"
 )
 
@@ -63,6 +67,20 @@ func (h *CatalogHandler) GetCategory(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"success": true, "data": category})
 }
 
+// GetCategoryBySlug returns a category by its current or a former slug.
+func (h *CatalogHandler) GetCategoryBySlug(c *fiber.Ctx) error {
+	var category models.Category
+	redirected, err := h.lookupBySlug(&category, models.SlugKindCategory, c.Params("slug"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "category not found")
+		}
+		return err
+	}
+
+	return c.JSON(slugResponse(category, category.Slug, redirected))
+}
+
 // CreateCategory persists a new category.
 func (h *CatalogHandler) CreateCategory(c *fiber.Ctx) error {
 	var payload models.Category
@@ -70,6 +88,12 @@ func (h *CatalogHandler) CreateCategory(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
+	slug, err := services.UniqueSlug(h.db, models.SlugKindCategory, payload.Slug, payload.Name, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	payload.Slug = slug
+
 	if err := h.db.Create(&payload).Error; err != nil {
 		return err
 	}
@@ -98,7 +122,12 @@ func (h *CatalogHandler) UpdateCategory(c *fiber.Ctx) error {
 	}
 
 	payload.ID = category.ID
-	if err := h.db.Model(&category).Updates(payload).Error; err != nil {
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := assignSlug(tx, models.SlugKindCategory, category.ID, category.Slug, &payload.Slug, payload.Name); err != nil {
+			return err
+		}
+		return tx.Model(&category).Updates(payload).Error
+	}); err != nil {
 		return err
 	}
 
@@ -159,12 +188,32 @@ func (h *CatalogHandler) GetBrand(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"success": true, "data": item})
 }
 
+// GetBrandBySlug returns a brand by its current or a former slug.
+func (h *CatalogHandler) GetBrandBySlug(c *fiber.Ctx) error {
+	var item models.Brand
+	redirected, err := h.lookupBySlug(&item, models.SlugKindBrand, c.Params("slug"), "Category")
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "brand not found")
+		}
+		return err
+	}
+
+	return c.JSON(slugResponse(item, item.Slug, redirected))
+}
+
 func (h *CatalogHandler) CreateBrand(c *fiber.Ctx) error {
 	var payload models.Brand
 	if err := c.BodyParser(&payload); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
+	slug, err := services.UniqueSlug(h.db, models.SlugKindBrand, payload.Slug, payload.Name, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	payload.Slug = slug
+
 	if err := h.db.Create(&payload).Error; err != nil {
 		return err
 	}
@@ -192,7 +241,15 @@ func (h *CatalogHandler) UpdateBrand(c *fiber.Ctx) error {
 	}
 
 	payload.ID = item.ID
-	if err := h.db.Model(&item).Updates(payload).Error; err != nil {
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := assignSlug(tx, models.SlugKindBrand, item.ID, item.Slug, &payload.Slug, payload.Name); err != nil {
+			return err
+		}
+		return tx.Model(&item).Updates(payload).Error
+	}); err != nil {
+		return err
+	}
+	if err := services.RefreshBrandProductSearch(h.db, item.ID); err != nil {
 		return err
 	}
 
@@ -210,6 +267,59 @@ func (h *CatalogHandler) DeleteBrand(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
+// Slug helpers shared by categories and brands.
+
+// lookupBySlug loads the entity with the given current or former slug into
+// dest and reports whether a former slug was used.
+func (h *CatalogHandler) lookupBySlug(dest any, kind, slug string, preloads ...string) (bool, error) {
+	query := func() *gorm.DB {
+		q := h.db
+		for _, preload := range preloads {
+			q = q.Preload(preload)
+		}
+		return q
+	}
+
+	err := query().First(dest, "slug = ?", slug).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	id, found, err := services.ResolveSlugRedirect(h.db, kind, slug)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, gorm.ErrRecordNotFound
+	}
+	return true, query().First(dest, "id = ?", id).Error
+}
+
+// assignSlug normalizes a slug sent on update. An empty slug keeps the
+// current one; a new slug leaves the current one behind as a redirect.
+func assignSlug(tx *gorm.DB, kind string, id uuid.UUID, current string, requested *string, name string) error {
+	if strings.TrimSpace(*requested) == "" {
+		*requested = ""
+		return nil
+	}
+	slug, err := services.UniqueSlug(tx, kind, *requested, name, id)
+	if err != nil {
+		return err
+	}
+	*requested = slug
+	return services.RecordSlugChange(tx, kind, id, current, slug)
+}
+
+// slugResponse wraps an entity found by slug, adding a redirect_slug hint
+// when it was found by a former slug.
+func slugResponse(data any, slug string, redirected bool) fiber.Map {
+	resp := fiber.Map{"success": true, "data": data}
+	if redirected {
+		resp["redirect_slug"] = slug
+	}
+	return resp
+}
+
 // Generic helpers for simple lookup tables.
 
 func (h *CatalogHandler) listSimple(c *fiber.Ctx, model interface{}) error {
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/example/shafran/internal/services"
+)
+
+// ClickHandler manages Click merchant API callbacks.
+type ClickHandler struct {
+	click *services.ClickService
+}
+
+// NewClickHandler constructs ClickHandler.
+func NewClickHandler(click *services.ClickService) *ClickHandler {
+	return &ClickHandler{click: click}
+}
+
+// Prepare handles Click's Prepare callback on /click/prepare.
+func (h *ClickHandler) Prepare(c *fiber.Ctx) error {
+	var req services.ClickRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(services.ClickResponse{Error: services.ClickErrorBadRequest, ErrorNote: "invalid request body"})
+	}
+
+	return c.JSON(h.click.Prepare(context.Background(), req))
+}
+
+// Complete handles Click's Complete callback on /click/complete.
+func (h *ClickHandler) Complete(c *fiber.Ctx) error {
+	var req services.ClickRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.JSON(services.ClickResponse{Error: services.ClickErrorBadRequest, ErrorNote: "invalid request body"})
+	}
+
+	return c.JSON(h.click.Complete(context.Background(), req))
+}
@@ -264,6 +264,9 @@ func (h *MarketingHandler) CreatePickupBranch(c *fiber.Ctx) error {
 	if err := c.BodyParser(&item); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
+	if err := validatePickupBranch(&item); err != nil {
+		return err
+	}
 	if err := h.db.Create(&item).Error; err != nil {
 		return err
 	}
@@ -286,12 +289,26 @@ func (h *MarketingHandler) UpdatePickupBranch(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 	item.ID = id
+	if err := validatePickupBranch(&item); err != nil {
+		return err
+	}
 	if err := h.db.Save(&item).Error; err != nil {
 		return err
 	}
 	return c.JSON(fiber.Map{"success": true, "data": item})
 }
 
+// validatePickupBranch checks the Billz store of a branch. A cashbox belongs
+// to one shop, so the two are set together.
+func validatePickupBranch(item *models.PickupBranch) error {
+	item.BillzShopID = strings.TrimSpace(item.BillzShopID)
+	item.BillzCashboxID = strings.TrimSpace(item.BillzCashboxID)
+	if (item.BillzShopID == "") != (item.BillzCashboxID == "") {
+		return fiber.NewError(fiber.StatusBadRequest, "billz_shop_id and billz_cashbox_id must be set together")
+	}
+	return nil
+}
+
 func (h *MarketingHandler) DeletePickupBranch(c *fiber.Ctx) error {
 	id, err := uuid.Parse(c.Params("id"))
 	if err != nil {
@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 
+	"github.com/example/shafran/internal/config"
 	"github.com/example/shafran/internal/middleware"
 	"github.com/example/shafran/internal/models"
 	"github.com/example/shafran/internal/services"
@@ -18,12 +23,14 @@ import (
 // OrderHandler manages order endpoints.
 type OrderHandler struct {
 	db       *gorm.DB
-	telegram *services.TelegramService
+	cfg      *config.Config
+	payments *services.PaymentRegistry
+	outbox   *services.BillzOutbox
 }
 
 // NewOrderHandler constructs OrderHandler.
-func NewOrderHandler(db *gorm.DB, telegram *services.TelegramService) *OrderHandler {
-	return &OrderHandler{db: db, telegram: telegram}
+func NewOrderHandler(db *gorm.DB, cfg *config.Config, outbox *services.BillzOutbox, payments *services.PaymentRegistry) *OrderHandler {
+	return &OrderHandler{db: db, cfg: cfg, payments: payments, outbox: outbox}
 }
 
 type orderProductRequest struct {
@@ -49,10 +56,12 @@ type createOrderRequest struct {
 	PaymentDetails     paymentDetailsRequest `json:"payment_details"`
 	Currency           string                `json:"currency"`
 	Products           []orderProductRequest `json:"products"`
+	CartID             string                `json:"cart_id"`
 	Promotion          string                `json:"promotion"`
 	TotalAmount        float64               `json:"total_amount"`
 	BonusAmount        float64               `json:"bonus_amount"`
 	Notes              string                `json:"notes"`
+	ReturnURL          string                `json:"return_url"`
 }
 
 // CreateOrder allows authenticated users to place an order.
@@ -67,6 +76,47 @@ func (h *OrderHandler) CreateOrder(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
 	}
 
+	// A server-side cart can be checked out instead of sending the lines.
+	var cart *models.Cart
+	if req.CartID != "" {
+		if len(req.Products) > 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "send either products or cart_id")
+		}
+		cartID, err := uuid.Parse(req.CartID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid cart_id")
+		}
+		cart = &models.Cart{}
+		if err := h.db.Preload("Items").
+			First(cart, "id = ? AND user_id = ? AND status = ?", cartID, userID, models.CartStatusActive).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return fiber.NewError(fiber.StatusNotFound, "cart not found")
+			}
+			return err
+		}
+		req.Products = cartOrderLines(cart)
+	}
+
+	if len(req.Products) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "products are required")
+	}
+
+	// Orders are paid in cash or through an active payment gateway.
+	var gateway services.PaymentGateway
+	if req.PaymentMethod != models.PaymentTypeCash {
+		if _, ok := h.payments.Get(req.PaymentMethod); !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "unsupported payment_method")
+		}
+		active, err := h.payments.Active(context.Background(), req.PaymentMethod)
+		if err != nil {
+			if errors.Is(err, services.ErrPaymentProviderUnavailable) {
+				return fiber.NewError(fiber.StatusBadRequest, "payment method is not available")
+			}
+			return err
+		}
+		gateway = active
+	}
+
 	order := models.Order{
 		UserID:         userID,
 		DeliveryMethod: req.DeliveryMethod,
@@ -75,7 +125,7 @@ func (h *OrderHandler) CreateOrder(c *fiber.Ctx) error {
 		TransactionID:  req.PaymentDetails.CardToken,
 		BonusAmount:    req.BonusAmount,
 		Notes:          req.Notes,
-		Status:         "pending",
+		Status:         models.OrderStatusPending,
 		PlacedAt:       time.Now(),
 	}
 
@@ -102,176 +152,195 @@ func (h *OrderHandler) CreateOrder(c *fiber.Ctx) error {
 		}
 	}
 
-	var subtotal float64
-	for _, p := range req.Products {
-		lineTotal := p.LineTotal
-		if lineTotal == 0 {
-			lineTotal = p.UnitPrice * float64(p.Quantity)
-		}
+	priced, lineErrors, err := priceOrderLines(h.db, req.Products)
+	if err != nil {
+		return err
+	}
+	if len(lineErrors) > 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"success": false,
+			"error":   "some order lines could not be accepted",
+			"lines":   lineErrors,
+		})
+	}
 
-		item := models.OrderItem{
-			ProductName:  p.ProductName,
-			VariantLabel: p.VariantLabel,
-			Quantity:     p.Quantity,
-			UnitPrice:    p.UnitPrice,
-			LineTotal:    lineTotal,
-		}
+	order.Items = priced.Items
+	if priced.Currency != "" {
+		order.Currency = priced.Currency
+	}
 
-		if p.ProductID != "" {
-			if id, err := uuid.Parse(p.ProductID); err == nil {
-				item.ProductID = &id
-			}
+	if code := strings.TrimSpace(req.Promotion); code != "" {
+		lines, err := services.PromoLinesForItems(h.db, order.Items)
+		if err != nil {
+			return err
 		}
-		if p.ProductVariantID != "" {
-			if id, err := uuid.Parse(p.ProductVariantID); err == nil {
-				item.ProductVariantID = &id
-			}
+		promo, err := services.EvaluatePromo(h.db, code, &userID, lines)
+		if err != nil {
+			return promoError(c, err)
 		}
+		order.PromoCodeID = &promo.Promo.ID
+		order.PromoCode = promo.Code
+		order.DiscountAmount = promo.Discount
+	}
 
-		subtotal += item.LineTotal
-		order.Items = append(order.Items, item)
+	if req.BonusAmount < 0 || req.BonusAmount > priced.Subtotal-order.DiscountAmount {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid bonus_amount")
 	}
 
-	order.Subtotal = subtotal
-	order.TotalAmount = req.TotalAmount
-	if order.TotalAmount == 0 {
-		order.TotalAmount = subtotal - order.BonusAmount
+	order.Subtotal = priced.Subtotal
+	order.TotalAmount = order.Subtotal + order.ShippingFee - order.DiscountAmount - order.BonusAmount
+	if req.TotalAmount > 0 && math.Abs(req.TotalAmount-order.TotalAmount) > priceTolerance {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"success":      false,
+			"error":        "order total does not match current prices",
+			"total_amount": order.TotalAmount,
+		})
 	}
 
 	if order.OrderNumber == "" {
 		order.OrderNumber = h.generateOrderNumber()
 	}
 
-	if err := h.db.Create(&order).Error; err != nil {
+	// Online payments hold stock only for a limited time; cash orders keep
+	// their reservation until an operator confirms or cancels them.
+	var reservationExpiry *time.Time
+	if req.PaymentMethod != models.PaymentTypeCash {
+		expiresAt := time.Now().Add(h.cfg.ReservationTTL)
+		reservationExpiry = &expiresAt
+	}
+
+	reservations := make([]services.ReservationLine, 0, len(order.Items))
+	for _, item := range order.Items {
+		reservations = append(reservations, services.ReservationLine{
+			VariantID: *item.ProductVariantID,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.OrderStatusHistory{
+			OrderID:     order.ID,
+			ToStatus:    order.Status,
+			ChangedByID: &userID,
+			Note:        "order placed",
+		}).Error; err != nil {
+			return err
+		}
+		if err := services.RedeemBonus(tx, userID, order.ID, order.BonusAmount, order.Currency); err != nil {
+			return err
+		}
+		if order.PromoCodeID != nil {
+			if err := services.RedeemPromo(tx, *order.PromoCodeID, userID, order.ID, order.DiscountAmount); err != nil {
+				return err
+			}
+		}
+		if cart != nil {
+			res := tx.Model(&models.Cart{}).
+				Where("id = ? AND status = ?", cart.ID, models.CartStatusActive).
+				Updates(map[string]any{
+					"status":           models.CartStatusOrdered,
+					"order_id":         order.ID,
+					"last_activity_at": time.Now(),
+				})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return errCartCheckedOut
+			}
+		}
+		// Cash orders are queued for Billz with the order so the push
+		// survives restarts and failed attempts are retried.
+		if req.PaymentMethod == models.PaymentTypeCash {
+			if err := services.EnqueueBillzOrder(tx, order.ID, billzOrderPayload(order, req)); err != nil {
+				return err
+			}
+		}
+		return services.ReserveStock(tx, order.ID, reservations, reservationExpiry)
+	}); err != nil {
+		var promoErr *services.PromoError
+		if errors.As(err, &promoErr) {
+			return promoError(c, err)
+		}
+		if errors.Is(err, services.ErrInsufficientBonus) {
+			return fiber.NewError(fiber.StatusUnprocessableEntity, "bonus_amount exceeds your bonus balance")
+		}
+		if errors.Is(err, errCartCheckedOut) {
+			return fiber.NewError(fiber.StatusConflict, "cart has already been checked out")
+		}
+		var stockErr *services.StockError
+		if errors.As(err, &stockErr) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"success": false,
+				"error":   "some items are no longer available in the requested quantity",
+				"lines":   stockLineErrors(req.Products, stockErr),
+			})
+		}
 		return err
 	}
 
 	// Cash to'lov uchun Billz'ga order yaratish (async)
 	// Telegram xabar Billz order yaratilgandan keyin yuboriladi
 	// Payme to'lov uchun Billz PerformTransaction vaqtida yaratiladi va Telegram yuboriladi
-	if req.PaymentMethod == "cash" {
-		go h.dispatchBillzOrderAndNotify(order, userID, req)
+	if req.PaymentMethod == models.PaymentTypeCash {
+		go h.dispatchBillzOrder(order.ID)
 	}
 	// Payme uchun Telegram notification PerformTransaction da yuboriladi
 
+	data := fiber.Map{
+		"id":           order.ID,
+		"order_number": order.OrderNumber,
+		"status":       order.Status,
+		"placed_at":    order.PlacedAt,
+		"total":        order.TotalAmount,
+		"currency":     order.Currency,
+	}
+
+	// The order is kept even if the checkout cannot be started; the client
+	// can retry through /payments/checkout.
+	if gateway != nil {
+		session, err := gateway.CreateCheckout(context.Background(), services.CheckoutRequest{
+			Order:     order,
+			UserID:    userID,
+			ReturnURL: strings.TrimSpace(req.ReturnURL),
+		})
+		if err != nil {
+			log.Printf("[Order] %s checkout failed for order %s: %v", gateway.Provider(), order.ID, err)
+			data["payment_error"] = "checkout could not be started"
+		} else {
+			data["payment"] = session
+		}
+	}
+
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"success": true,
-		"data": fiber.Map{
-			"id":           order.ID,
-			"order_number": order.OrderNumber,
-			"status":       order.Status,
-			"placed_at":    order.PlacedAt,
-			"total":        order.TotalAmount,
-			"currency":     order.Currency,
-		},
+		"data":    data,
 	})
 }
 
-// dispatchBillzOrderAndNotify creates a Billz order and sends Telegram notification after success
-func (h *OrderHandler) dispatchBillzOrderAndNotify(order models.Order, userID uuid.UUID, req createOrderRequest) {
-	log.Printf("[Order] dispatchBillzOrderAndNotify started for order %s, user %s", order.ID, userID)
-
-	// Build Billz order payload
-	billzItems := make([]services.BillzOrderItem, 0, len(req.Products))
-	for _, p := range req.Products {
-		qty := float64(p.Quantity)
-		if qty <= 0 {
-			qty = 1
-		}
-		log.Printf("[Order] Adding Billz item: productID=%s, qty=%v", p.ProductID, qty)
-		billzItems = append(billzItems, services.BillzOrderItem{
-			ProductID: p.ProductID,
-			Quantity:  qty,
-		})
+// dispatchBillzOrder pushes a queued cash order to Billz right away; the
+// outbox worker retries it if this attempt fails.
+func (h *OrderHandler) dispatchBillzOrder(orderID uuid.UUID) {
+	result, err := h.outbox.DispatchOrder(orderID)
+	if err != nil {
+		log.Printf("[Order] Billz order creation failed for order %s: %v", orderID, err)
+		return
 	}
-
-	// Try to get Billz customer ID by looking up user's phone
-	var billzCustomerID string
-	var user models.User
-	if err := h.db.First(&user, "id = ?", userID).Error; err == nil && user.Phone != "" {
-		log.Printf("[Order] Found user phone: %s, will try to lookup Billz customer", user.Phone)
-		billzCustomerID = ""
+	if result != nil {
+		log.Printf("[Order] Billz order %s created for order %s", result.OrderID, orderID)
 	}
+}
 
-	log.Printf("[Order] Creating Billz order with %d items, total: %v", len(billzItems), req.TotalAmount)
-	result, err := services.CreateBillzOrderDirect(services.BillzOrderPayload{
-		Items:         billzItems,
-		CustomerID:    billzCustomerID,
+// billzOrderPayload builds the Billz push of a cash order. Its items are read
+// from the order lines when the order is pushed.
+func billzOrderPayload(order models.Order, req createOrderRequest) services.BillzOrderPayload {
+	return services.BillzOrderPayload{
 		PaymentMethod: req.PaymentMethod,
-		TotalAmount:   req.TotalAmount,
+		TotalAmount:   order.TotalAmount,
 		Comment:       req.Notes,
-	})
-
-	now := time.Now()
-	updates := map[string]any{
-		"billz_synced_at": &now,
-	}
-
-	if err != nil {
-		log.Printf("[Order] Billz order creation failed for order %s: %v", order.ID, err)
-		errMsg := err.Error()
-		if len(errMsg) > 1024 {
-			errMsg = errMsg[:1024]
-		}
-		updates["billz_sync_error"] = errMsg
-	} else if result != nil {
-		log.Printf("[Order] Billz order %s created for order %s", result.OrderID, order.ID)
-		updates["billz_order_id"] = result.OrderID
-		updates["billz_order_number"] = result.OrderNumber
-		updates["billz_order_type"] = result.OrderType
-		updates["billz_sync_error"] = ""
-
-		// Billz muvaffaqiyatli - Telegram xabar yuborish
-		if h.telegram != nil {
-			// Get user info for notification
-			userName := "Не указано"
-			userPhone := "Не указано"
-			if user.FirstName != "" || user.LastName != "" {
-				userName = user.FirstName + " " + user.LastName
-			}
-			if user.Phone != "" {
-				userPhone = user.Phone
-			}
-
-			// Build items list
-			items := make([]services.OrderItemNotification, 0, len(req.Products))
-			for _, p := range req.Products {
-				items = append(items, services.OrderItemNotification{
-					Name:     p.ProductName,
-					Quantity: p.Quantity,
-					Price:    p.UnitPrice,
-					Currency: req.Currency,
-				})
-			}
-
-			// Use Billz order number if available
-			orderNumber := result.OrderNumber
-			if orderNumber == "" {
-				orderNumber = order.OrderNumber
-			}
-
-			notification := services.OrderNotification{
-				OrderID:       order.ID.String(),
-				OrderNumber:   orderNumber,
-				Items:         items,
-				TotalAmount:   order.TotalAmount,
-				Currency:      order.Currency,
-				UserName:      userName,
-				UserPhone:     userPhone,
-				PaymentMethod: req.PaymentMethod,
-				Status:        "pending",
-			}
-
-			if err := h.telegram.NotifyNewOrder(notification); err != nil {
-				log.Printf("[Order] Telegram notification failed: %v", err)
-			} else {
-				log.Printf("[Order] Telegram notification sent for order %s", orderNumber)
-			}
-		}
-	}
-
-	if err := h.db.Model(&models.Order{}).Where("id = ?", order.ID).Updates(updates).Error; err != nil {
-		log.Printf("[Order] Failed to update Billz sync status for order %s: %v", order.ID, err)
 	}
 }
 
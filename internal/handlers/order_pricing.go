@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+)
+
+// Line error codes returned when an order line cannot be accepted.
+const (
+	lineErrorInvalidVariant    = "invalid_variant"
+	lineErrorVariantNotFound   = "variant_not_found"
+	lineErrorInvalidQuantity   = "invalid_quantity"
+	lineErrorInactive          = "inactive"
+	lineErrorOutOfStock        = "out_of_stock"
+	lineErrorInsufficientStock = "insufficient_stock"
+	lineErrorPriceMismatch     = "price_mismatch"
+)
+
+// priceTolerance absorbs float rounding when comparing client and server prices.
+const priceTolerance = 0.01
+
+// orderLineError describes why a requested order line was rejected.
+type orderLineError struct {
+	Index            int     `json:"index"`
+	ProductVariantID string  `json:"product_variant_id"`
+	Code             string  `json:"code"`
+	Message          string  `json:"message"`
+	CurrentPrice     float64 `json:"current_price,omitempty"`
+	Available        *int    `json:"available,omitempty"`
+}
+
+// pricedOrder holds order items priced from the catalog rather than the client.
+type pricedOrder struct {
+	Items    []models.OrderItem
+	Subtotal float64
+	Currency string
+}
+
+// priceOrderLines resolves every requested line to its product variant and
+// snapshots the current catalog price. Lines that reference unknown, inactive
+// or out-of-stock variants, or that carry a stale price, are reported back
+// instead of being silently corrected. Orders are priced in a single currency,
+// so lines priced in different currencies are rejected as a bad request.
+func priceOrderLines(db *gorm.DB, lines []orderProductRequest) (*pricedOrder, []orderLineError, error) {
+	var lineErrors []orderLineError
+	variantIDs := make([]uuid.UUID, len(lines))
+
+	for i, line := range lines {
+		id, err := uuid.Parse(line.ProductVariantID)
+		if err != nil {
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorInvalidVariant,
+				Message:          "product_variant_id is missing or invalid",
+			})
+			continue
+		}
+		variantIDs[i] = id
+
+		if line.Quantity <= 0 {
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorInvalidQuantity,
+				Message:          "quantity must be greater than zero",
+			})
+		}
+	}
+	if len(lineErrors) > 0 {
+		return nil, lineErrors, nil
+	}
+
+	var variants []models.ProductVariant
+	if err := db.Where("id IN ?", variantIDs).Find(&variants).Error; err != nil {
+		return nil, nil, err
+	}
+	variantsByID := make(map[uuid.UUID]models.ProductVariant, len(variants))
+	productIDs := make([]uuid.UUID, 0, len(variants))
+	for _, v := range variants {
+		variantsByID[v.ID] = v
+		productIDs = append(productIDs, v.ProductID)
+	}
+
+	var products []models.Product
+	if len(productIDs) > 0 {
+		if err := db.Select("id, name").Where("id IN ?", productIDs).Find(&products).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	productNames := make(map[uuid.UUID]string, len(products))
+	for _, p := range products {
+		productNames[p.ID] = p.Name
+	}
+
+	// The same variant may appear on several lines; stock is checked against
+	// the combined quantity.
+	requested := make(map[uuid.UUID]int, len(variantIDs))
+	for i, line := range lines {
+		requested[variantIDs[i]] += line.Quantity
+	}
+
+	result := &pricedOrder{}
+	mixedCurrencies := false
+	for i, line := range lines {
+		variant, ok := variantsByID[variantIDs[i]]
+		if !ok {
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorVariantNotFound,
+				Message:          "product variant not found",
+			})
+			continue
+		}
+
+		productName, ok := productNames[variant.ProductID]
+		if !ok || !variant.IsActive {
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorInactive,
+				Message:          "product variant is no longer available",
+			})
+			continue
+		}
+
+		available := variant.AvailableQuantity()
+		if !variant.InStock || available <= 0 {
+			none := 0
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorOutOfStock,
+				Message:          "product variant is out of stock",
+				Available:        &none,
+			})
+			continue
+		}
+
+		if requested[variant.ID] > available {
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorInsufficientStock,
+				Message:          fmt.Sprintf("only %d item(s) left in stock", available),
+				Available:        &available,
+			})
+			continue
+		}
+
+		lineTotal := variant.Price * float64(line.Quantity)
+		if (line.UnitPrice > 0 && math.Abs(line.UnitPrice-variant.Price) > priceTolerance) ||
+			(line.LineTotal > 0 && math.Abs(line.LineTotal-lineTotal) > priceTolerance) {
+			lineErrors = append(lineErrors, orderLineError{
+				Index:            i,
+				ProductVariantID: line.ProductVariantID,
+				Code:             lineErrorPriceMismatch,
+				Message:          "price has changed, please review your order",
+				CurrentPrice:     variant.Price,
+			})
+			continue
+		}
+
+		productID := variant.ProductID
+		variantID := variant.ID
+		result.Items = append(result.Items, models.OrderItem{
+			ProductID:        &productID,
+			ProductVariantID: &variantID,
+			ProductName:      productName,
+			VariantLabel:     variant.Label,
+			Quantity:         line.Quantity,
+			UnitPrice:        variant.Price,
+			LineTotal:        lineTotal,
+		})
+		result.Subtotal += lineTotal
+		if len(result.Items) == 1 {
+			result.Currency = variant.Currency
+		} else if variant.Currency != result.Currency {
+			mixedCurrencies = true
+		}
+	}
+
+	if len(lineErrors) > 0 {
+		return nil, lineErrors, nil
+	}
+	if mixedCurrencies {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "order lines must be priced in the same currency")
+	}
+
+	return result, nil, nil
+}
+
+// stockLineErrors maps a reservation failure back onto the request lines that
+// reference the exhausted variant.
+func stockLineErrors(lines []orderProductRequest, stockErr *services.StockError) []orderLineError {
+	var lineErrors []orderLineError
+	for i, line := range lines {
+		if id, err := uuid.Parse(line.ProductVariantID); err != nil || id != stockErr.VariantID {
+			continue
+		}
+		available := stockErr.Available
+		lineErrors = append(lineErrors, orderLineError{
+			Index:            i,
+			ProductVariantID: line.ProductVariantID,
+			Code:             lineErrorInsufficientStock,
+			Message:          fmt.Sprintf("only %d item(s) left in stock", available),
+			Available:        &available,
+		})
+	}
+	return lineErrors
+}
+
+var errCartCheckedOut = errors.New("cart already checked out")
+
+// cartOrderLines turns cart items into order lines. Prices are left blank so
+// the cart is checked out at the current catalog price.
+func cartOrderLines(cart *models.Cart) []orderProductRequest {
+	lines := make([]orderProductRequest, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		lines = append(lines, orderProductRequest{
+			ProductID:        item.ProductID.String(),
+			ProductVariantID: item.ProductVariantID.String(),
+			Quantity:         item.Quantity,
+		})
+	}
+	return lines
+}
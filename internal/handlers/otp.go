@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+)
+
+// otpError turns a throttling error into a 429 response with a
+// Retry-After header. Other errors are returned unchanged.
+func otpError(c *fiber.Ctx, err error) error {
+	var rateErr *services.RateLimitError
+	if !errors.As(err, &rateErr) {
+		return err
+	}
+
+	retryAfter := rateErr.RetryAfterSeconds()
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"success":     false,
+		"error":       rateErr.Message,
+		"retry_after": retryAfter,
+	})
+}
+
+// exhaustedCodeError is returned once a single code has taken too many wrong
+// guesses; the user has to request a new one.
+func exhaustedCodeError(c *fiber.Ctx, otp *services.OTPGuard, issuedAt time.Time) error {
+	wait := otp.ResendCooldown() - time.Since(issuedAt)
+	return otpError(c, &services.RateLimitError{
+		Message:    "too many attempts, request a new code",
+		RetryAfter: wait,
+	})
+}
+
+// claimCodeAttempt counts a guess against a verification code and reports
+// whether the code had attempts left. The limit is checked by the update
+// itself, so concurrent guesses cannot get past it.
+func claimCodeAttempt(db *gorm.DB, code any, maxAttempts int) (bool, error) {
+	result := db.Model(code).
+		Where("attempts < ?", maxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// lastSMSVerificationAt returns when the latest verification code for a phone
+// was issued.
+func lastSMSVerificationAt(db *gorm.DB, phone string) (*time.Time, error) {
+	var last models.SMSVerification
+	err := db.Select("created_at").Where("phone = ?", phone).Order("created_at desc").First(&last).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &last.CreatedAt, nil
+}
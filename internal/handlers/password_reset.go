@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"log"
 	"math/big"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"github.com/example/shafran/internal/config"
@@ -18,13 +21,16 @@ import (
 
 // PasswordResetHandler manages forgot-password endpoints.
 type PasswordResetHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db       *gorm.DB
+	cfg      *config.Config
+	sms      services.SMSSender
+	otp      *services.OTPGuard
+	sessions *services.SessionService
 }
 
 // NewPasswordResetHandler constructs a PasswordResetHandler.
-func NewPasswordResetHandler(db *gorm.DB, cfg *config.Config) *PasswordResetHandler {
-	return &PasswordResetHandler{db: db, cfg: cfg}
+func NewPasswordResetHandler(db *gorm.DB, cfg *config.Config, sms services.SMSSender, otp *services.OTPGuard, sessions *services.SessionService) *PasswordResetHandler {
+	return &PasswordResetHandler{db: db, cfg: cfg, sms: sms, otp: otp, sessions: sessions}
 }
 
 type forgotPasswordRequest struct {
@@ -32,7 +38,7 @@ type forgotPasswordRequest struct {
 }
 
 // ForgotPassword initiates the password-reset flow: validates user, generates
-// a 6-digit code, sends it via Plum, and returns a reset token.
+// a 6-digit code, sends it by SMS, and returns a reset token.
 func (h *PasswordResetHandler) ForgotPassword(c *fiber.Ctx) error {
 	var req forgotPasswordRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -43,6 +49,19 @@ func (h *PasswordResetHandler) ForgotPassword(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "phone is required")
 	}
 
+	var lastSentAt *time.Time
+	var last models.PasswordResetToken
+	if err := h.db.Select("created_at").Where("phone = ?", req.Phone).
+		Order("created_at desc").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	if !last.CreatedAt.IsZero() {
+		lastSentAt = &last.CreatedAt
+	}
+	if err := h.otp.CheckSend(services.OTPPurposePasswordReset, c.IP(), lastSentAt); err != nil {
+		return otpError(c, err)
+	}
+
 	// Check user exists.
 	var user models.User
 	if err := h.db.Where("phone = ?", req.Phone).First(&user).Error; err != nil {
@@ -65,19 +84,6 @@ func (h *PasswordResetHandler) ForgotPassword(c *fiber.Ctx) error {
 	}
 	resetToken := hex.EncodeToString(tokenBytes)
 
-	// Try sending code via Plum; if disabled/fails, still store the code (fallback).
-	var sessionID string
-	plumCfg := services.LoadPlumConfig()
-	if plumCfg.Enabled {
-		sid, err := services.PlumVerifyPhone(req.Phone)
-		if err != nil {
-			// Log but don't fail — store code for manual/SMS fallback.
-			fmt.Printf("plum verify phone failed: %v\n", err)
-		} else {
-			sessionID = sid
-		}
-	}
-
 	// Expire any previous unused reset tokens for this phone.
 	h.db.Model(&models.PasswordResetToken{}).
 		Where("phone = ? AND used_at IS NULL", req.Phone).
@@ -88,26 +94,33 @@ func (h *PasswordResetHandler) ForgotPassword(c *fiber.Ctx) error {
 		Phone:     req.Phone,
 		Token:     resetToken,
 		Code:      code,
-		SessionID: sessionID,
 		ExpiresAt: time.Now().Add(10 * time.Minute),
 		Verified:  false,
+		RequestIP: c.IP(),
 	}
 	if err := h.db.Create(&resetRecord).Error; err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to create reset token")
 	}
 
+	if err := h.otp.RecordSend(services.OTPPurposePasswordReset, c.IP()); err != nil {
+		log.Printf("[PasswordReset] failed to record OTP send for %s: %v", c.IP(), err)
+	}
+
+	if err := h.sms.Send(req.Phone, services.OTPMessage(services.OTPPurposePasswordReset, code)); err != nil {
+		log.Printf("[PasswordReset] %s failed to send reset code to %s: %v", h.sms.Name(), req.Phone, err)
+		h.db.Model(&resetRecord).Update("expires_at", time.Now())
+		return fiber.NewError(fiber.StatusBadGateway, "failed to send verification code")
+	}
+
 	return c.JSON(fiber.Map{
-		"success":    true,
-		"token":      resetToken,
-		"session_id": sessionID,
-		"code":       code,
+		"success": true,
+		"token":   resetToken,
 	})
 }
 
 type verifyResetCodeRequest struct {
-	Token     string `json:"token"`
-	Code      string `json:"code"`
-	SessionID string `json:"session_id"`
+	Token string `json:"token"`
+	Code  string `json:"code"`
 }
 
 // VerifyResetCode verifies the code submitted by the user.
@@ -137,23 +150,22 @@ func (h *PasswordResetHandler) VerifyResetCode(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "token expired")
 	}
 
-	// Verify code: try Plum first, then fallback to local code.
-	plumCfg := services.LoadPlumConfig()
-	verified := false
-
-	if plumCfg.Enabled && req.SessionID != "" {
-		ok, err := services.PlumConfirmCode(req.SessionID, req.Code)
-		if err == nil && ok {
-			verified = true
-		}
+	if err := h.otp.CheckVerify(services.OTPPurposePasswordReset, record.Phone, c.IP()); err != nil {
+		return otpError(c, err)
 	}
 
-	// Fallback: compare with stored code.
-	if !verified && record.Code == req.Code {
-		verified = true
+	claimed, err := claimCodeAttempt(h.db, &record, h.otp.MaxAttempts())
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return exhaustedCodeError(c, h.otp, record.CreatedAt)
 	}
 
-	if !verified {
+	if record.Code != req.Code {
+		if err := h.otp.RecordFailure(services.OTPPurposePasswordReset, record.Phone, c.IP()); err != nil {
+			return otpError(c, err)
+		}
 		return fiber.NewError(fiber.StatusBadRequest, "invalid verification code")
 	}
 
@@ -162,6 +174,10 @@ func (h *PasswordResetHandler) VerifyResetCode(c *fiber.Ctx) error {
 		return err
 	}
 
+	if err := h.otp.RecordSuccess(services.OTPPurposePasswordReset, record.Phone); err != nil {
+		log.Printf("[PasswordReset] failed to reset OTP counter for %s: %v", record.Phone, err)
+	}
+
 	return c.JSON(fiber.Map{
 		"success":  true,
 		"verified": true,
@@ -215,13 +231,24 @@ func (h *PasswordResetHandler) ResetPassword(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to hash password")
 	}
 
+	var user models.User
+	if err := h.db.Where("phone = ?", record.Phone).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "user not found")
+		}
+		return err
+	}
+
 	// Update user password.
-	if err := h.db.Model(&models.User{}).
-		Where("phone = ?", record.Phone).
-		Update("password_hash", hash).Error; err != nil {
+	if err := h.db.Model(&user).Update("password_hash", hash).Error; err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to update password")
 	}
 
+	// Sign out every device that used the old password.
+	if _, err := h.sessions.RevokeAll(context.Background(), user.ID, uuid.Nil); err != nil {
+		log.Printf("[PasswordReset] failed to revoke sessions of %s: %v", user.ID, err)
+	}
+
 	// Mark token as used.
 	now := time.Now()
 	record.UsedAt = &now
@@ -2,10 +2,8 @@ package handlers
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math"
 	"strconv"
 	"strings"
 
@@ -20,19 +18,12 @@ import (
 
 // PaymeHandler manages Payme-related endpoints.
 type PaymeHandler struct {
-	db         *gorm.DB
-	payme      *services.PaymeService
-	merchantID string
-	telegram   *services.TelegramService
+	db    *gorm.DB
+	payme *services.PaymeService
 }
 
-func NewPaymeHandler(db *gorm.DB, merchantID string, telegram *services.TelegramService) *PaymeHandler {
-	return &PaymeHandler{
-		db:         db,
-		payme:      services.NewPaymeService(db, telegram),
-		merchantID: merchantID,
-		telegram:   telegram,
-	}
+func NewPaymeHandler(db *gorm.DB, payme *services.PaymeService) *PaymeHandler {
+	return &PaymeHandler{db: db, payme: payme}
 }
 
 type paymeRPCRequest struct {
@@ -41,13 +32,6 @@ type paymeRPCRequest struct {
 	ID     any             `json:"id"`
 }
 
-type paymeCheckoutRequest struct {
-	OrderDetails json.RawMessage `json:"orderDetails"`
-	Amount       float64         `json:"amount"`
-	UserID       string          `json:"userId"`
-	URL          string          `json:"url"`
-}
-
 // paymeFakeTransactionRequest is used to seed a fake Payme transaction for testing.
 type paymeFakeTransactionRequest struct {
 	UserID        string          `json:"userId"`
@@ -141,80 +125,6 @@ func (h *PaymeHandler) Pay(c *fiber.Ctx) error {
 	}
 }
 
-// Checkout creates a new Payme transaction and returns a checkout URL.
-func (h *PaymeHandler) Checkout(c *fiber.Ctx) error {
-	var req paymeCheckoutRequest
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
-	}
-
-	if req.Amount <= 0 {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid amount")
-	}
-	if strings.TrimSpace(req.URL) == "" {
-		return fiber.NewError(fiber.StatusBadRequest, "url is required")
-	}
-
-	var userIDPtr *uuid.UUID
-	if req.UserID != "" {
-		if id, err := uuid.Parse(req.UserID); err == nil {
-			userIDPtr = &id
-		}
-	}
-
-	if userIDPtr != nil {
-		if err := h.db.
-			Where("user_id = ? AND status = ? AND provider = ?", *userIDPtr, services.TransactionStatePending, "payme").
-			Delete(&models.PaymeTransaction{}).Error; err != nil {
-			return err
-		}
-	}
-
-	var details map[string]any
-	if len(req.OrderDetails) > 0 {
-		_ = json.Unmarshal(req.OrderDetails, &details)
-	}
-
-	txn := models.PaymeTransaction{
-		UserID:       userIDPtr,
-		OrderDetails: req.OrderDetails,
-		OrderID:      extractInternalOrderID(details),
-		Status:       0,
-		Provider:     "payme",
-		Amount:       int64(math.Floor(req.Amount)),
-	}
-
-	if err := h.db.Create(&txn).Error; err != nil {
-		return err
-	}
-
-	redirectURL := strings.TrimRight(req.URL, "/")
-
-	if details != nil {
-		if v, ok := details["service_mode"]; ok {
-			switch vv := v.(type) {
-			case float64:
-				if int(vv) != 1 {
-					redirectURL = fmt.Sprintf("%s/%s", redirectURL, txn.ID.String())
-				}
-			case int:
-				if vv != 1 {
-					redirectURL = fmt.Sprintf("%s/%s", redirectURL, txn.ID.String())
-				}
-			}
-		}
-	}
-
-	amountOrder := int64(req.Amount * 100)
-	payload := fmt.Sprintf("m=%s;ac.order_id=%s;a=%d;c=%s", h.merchantID, txn.ID.String(), amountOrder, redirectURL)
-	encoded := base64.StdEncoding.EncodeToString([]byte(payload))
-
-	return c.JSON(fiber.Map{
-		"url":      "https://checkout.payme.uz/" + encoded,
-		"order_id": txn.ID,
-	})
-}
-
 // CreateFakeTransaction inserts a fake Payme transaction for testing purposes.
 func (h *PaymeHandler) CreateFakeTransaction(c *fiber.Ctx) error {
 	var req paymeFakeTransactionRequest
@@ -245,7 +155,7 @@ func (h *PaymeHandler) CreateFakeTransaction(c *fiber.Ctx) error {
 	}
 
 	if txn.Provider == "" {
-		txn.Provider = "payme"
+		txn.Provider = models.PaymentTypePayme
 	}
 
 	if err := h.db.Create(&txn).Error; err != nil {
@@ -278,7 +188,11 @@ func (h *PaymeHandler) ListTransactions(c *fiber.Ctx) error {
 		query = query.Where("user_id = ?", parsed)
 	}
 	if orderID := strings.TrimSpace(c.Query("order_id")); orderID != "" {
-		query = query.Where("order_id = ?", orderID)
+		if parsed, err := uuid.Parse(orderID); err == nil {
+			query = query.Where("internal_order_id = ? OR order_id = ?", parsed, orderID)
+		} else {
+			query = query.Where("order_id = ?", orderID)
+		}
 	}
 
 	var total int64
@@ -306,20 +220,6 @@ func (h *PaymeHandler) ListTransactions(c *fiber.Ctx) error {
 	})
 }
 
-func extractInternalOrderID(details map[string]any) string {
-	if details == nil {
-		return ""
-	}
-	for _, key := range []string{"internalOrderId", "internal_order_id", "order_id", "orderId"} {
-		if v, ok := details[key]; ok {
-			if str, _ := v.(string); str != "" {
-				return strings.TrimSpace(str)
-			}
-		}
-	}
-	return ""
-}
-
 func writePaymeError(c *fiber.Ctx, err error) error {
 	if txErr, ok := err.(*services.TransactionError); ok {
 		info := txErr.Info
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/middleware"
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+)
+
+// PaymentHandler exposes provider-agnostic payment endpoints.
+type PaymentHandler struct {
+	db       *gorm.DB
+	payments *services.PaymentRegistry
+}
+
+// NewPaymentHandler constructs PaymentHandler.
+func NewPaymentHandler(db *gorm.DB, payments *services.PaymentRegistry) *PaymentHandler {
+	return &PaymentHandler{db: db, payments: payments}
+}
+
+type paymentCheckoutRequest struct {
+	OrderID string `json:"order_id"`
+	URL     string `json:"url"`
+}
+
+type refundPaymentRequest struct {
+	Reason int `json:"reason"`
+}
+
+// Checkout starts a payment for one of the user's pending orders with the
+// provider the order was placed with.
+func (h *PaymentHandler) Checkout(c *fiber.Ctx) error {
+	return h.checkout(c, "")
+}
+
+// ProviderCheckout returns a checkout handler that only accepts orders placed
+// with the given provider.
+func (h *PaymentHandler) ProviderCheckout(provider string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return h.checkout(c, provider)
+	}
+}
+
+func (h *PaymentHandler) checkout(c *fiber.Ctx, provider string) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	var req paymentCheckoutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if strings.TrimSpace(req.URL) == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "url is required")
+	}
+
+	order, err := findPayableOrder(h.db, userID, req.OrderID, provider)
+	if err != nil {
+		return err
+	}
+
+	gateway, err := h.payments.Active(context.Background(), order.PaymentMethod)
+	if err != nil {
+		if errors.Is(err, services.ErrPaymentProviderUnavailable) {
+			return fiber.NewError(fiber.StatusBadRequest, "payment method is not available")
+		}
+		return err
+	}
+
+	session, err := gateway.CreateCheckout(context.Background(), services.CheckoutRequest{
+		Order:     *order,
+		UserID:    userID,
+		ReturnURL: strings.TrimSpace(req.URL),
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"url":            session.URL,
+		"order_id":       session.TransactionID,
+		"provider":       session.Provider,
+		"internal_order": order.ID,
+		"order_number":   order.OrderNumber,
+		"amount":         session.Amount,
+	})
+}
+
+// MarkTransactionRefunded records that a paid transaction was refunded and
+// refunds its order. No money is moved: the admin returns the payment in the
+// provider's merchant cabinet, which the response reminds them of.
+func (h *PaymentHandler) MarkTransactionRefunded(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req refundPaymentRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+		}
+	}
+	if req.Reason == 0 {
+		req.Reason = services.PaymentCancelReasonRefund
+	}
+
+	var txn models.PaymeTransaction
+	if err := h.db.First(&txn, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "transaction not found")
+		}
+		return err
+	}
+
+	gateway, ok := h.payments.Get(txn.Provider)
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, "unsupported payment provider")
+	}
+
+	if err := gateway.MarkRefunded(context.Background(), txn.ID, req.Reason); err != nil {
+		switch {
+		case errors.Is(err, services.ErrPaymentTransactionNotFound):
+			return fiber.NewError(fiber.StatusNotFound, "transaction not found")
+		case errors.Is(err, services.ErrPaymentInvalidState):
+			return fiber.NewError(fiber.StatusConflict, "only paid transactions can be refunded")
+		}
+		return err
+	}
+
+	if err := h.db.First(&txn, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    txn,
+		"note":    fmt.Sprintf("The payment was only marked as refunded. Return the money to the customer in the %s merchant cabinet.", txn.Provider),
+	})
+}
+
+// findPayableOrder loads an order of the given user that is waiting for an
+// online payment. An empty method accepts any payment method.
+func findPayableOrder(db *gorm.DB, userID uuid.UUID, rawOrderID, method string) (*models.Order, error) {
+	orderID, err := uuid.Parse(strings.TrimSpace(rawOrderID))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid order_id")
+	}
+
+	var order models.Order
+	if err := db.First(&order, "id = ? AND user_id = ?", orderID, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fiber.NewError(fiber.StatusNotFound, "order not found")
+		}
+		return nil, err
+	}
+	if method != "" && !strings.EqualFold(order.PaymentMethod, method) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "order is not paid with "+method)
+	}
+	if order.Status != models.OrderStatusPending {
+		return nil, fiber.NewError(fiber.StatusConflict, "order is not awaiting payment")
+	}
+	if math.Floor(order.TotalAmount) <= 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "invalid amount")
+	}
+	return &order, nil
+}
@@ -2,96 +2,165 @@ package handlers
 
 import (
 	"errors"
-	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
 	"github.com/example/shafran/internal/utils"
 )
 
 // ProductHandler manages product CRUD.
 type ProductHandler struct {
-	db *gorm.DB
+	db          *gorm.DB
+	backInStock *services.BackInStockNotifier
 }
 
 // NewProductHandler constructs ProductHandler.
-func NewProductHandler(db *gorm.DB) *ProductHandler {
-	return &ProductHandler{db: db}
+func NewProductHandler(db *gorm.DB, backInStock *services.BackInStockNotifier) *ProductHandler {
+	return &ProductHandler{db: db, backInStock: backInStock}
 }
 
-// ListProducts returns paginated products with optional filters.
+// ListProducts returns products with optional filters and the facet counts
+// of the filtered result set. Pages are addressed by page/limit, or by an
+// opaque cursor when the cursor query key is present (empty for the first
+// page). Cursors are not available for relevance-sorted searches.
 func (h *ProductHandler) ListProducts(c *fiber.Ctx) error {
 	pg := utils.ParsePagination(c)
-	query := h.db.Model(&models.Product{})
+	search := services.ParseProductSearch(c.Query("search"))
+	filters := parseProductFilters(c, search)
+	query := filters.apply(h.db.Model(&models.Product{}), "")
 
-	if v := c.Query("category_id"); v != "" {
-		if id, err := uuid.Parse(v); err == nil {
-			query = query.Where("category_id = ?", id)
+	sortName := c.Query("sort")
+	if sortName == "" {
+		sortName = productSortNewest
+		if search != nil {
+			sortName = productSortRelevance
 		}
 	}
+	sort, keyed := productSorts[sortName]
+	if !keyed && (sortName != productSortRelevance || search == nil) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid sort")
+	}
 
-	if v := c.Query("brand_id"); v != "" {
-		if id, err := uuid.Parse(v); err == nil {
-			query = query.Where("brand_id = ?", id)
-		}
+	useCursor := c.Context().QueryArgs().Has("cursor")
+	if useCursor && !keyed {
+		return fiber.NewError(fiber.StatusBadRequest, "cursor pagination is not available for relevance sort")
 	}
 
-	if search := strings.TrimSpace(c.Query("search")); search != "" {
-		q := "%" + search + "%"
-		query = query.Where(
-			h.db.Where("products.name ILIKE ?", q).
-				Or("products.short_description ILIKE ?", q).
-				Or("products.manufacturer ILIKE ?", q).
-				Or("products.fragrance_family ILIKE ?", q).
-				Or("products.fragrance_group ILIKE ?", q).
-				Or("products.composition_notes ILIKE ?", q).
-				Or("EXISTS (SELECT 1 FROM brands WHERE brands.id = products.brand_id AND brands.name ILIKE ?)", q).
-				Or("EXISTS (SELECT 1 FROM product_specifications WHERE product_specifications.product_id = products.id AND (product_specifications.label ILIKE ? OR product_specifications.value ILIKE ?))", q, q),
-		)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
 	}
 
-	if minPrice := c.Query("min_price"); minPrice != "" {
-		if val, err := strconv.ParseFloat(minPrice, 64); err == nil {
-			query = query.Where("base_price >= ?", val)
-		}
+	if keyed {
+		query = sort.order(query)
+	} else {
+		query = search.Rank(query).Order("products.id")
 	}
 
-	if maxPrice := c.Query("max_price"); maxPrice != "" {
-		if val, err := strconv.ParseFloat(maxPrice, 64); err == nil {
-			query = query.Where("base_price <= ?", val)
+	if useCursor {
+		if token := c.Query("cursor"); token != "" {
+			cursor, err := utils.DecodeCursor(token)
+			if err != nil || cursor.Sort != sortName {
+				return fiber.NewError(fiber.StatusBadRequest, errInvalidCursor.Error())
+			}
+			if query, err = sort.after(query, cursor); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
 		}
+		query = query.Limit(pg.Limit + 1)
+	} else {
+		query = query.Limit(pg.Limit).Offset(pg.Offset)
 	}
 
-	if gender := c.Query("gender"); gender != "" {
-		query = query.Where("gender_audience = ?", gender)
+	var products []models.Product
+	if err := query.Preload("Brand").Preload("Category").Preload("Variants").Preload("Media").
+		Find(&products).Error; err != nil {
+		return err
+	}
+	if search != nil {
+		for i := range products {
+			products[i].SearchHighlight = search.Highlight(&products[i])
+		}
 	}
 
-	var total int64
-	if err := query.Count(&total).Error; err != nil {
+	facets, err := h.productFacets(filters)
+	if err != nil {
 		return err
 	}
 
+	pagination := fiber.Map{
+		"items_per_page": pg.Limit,
+		"total_items":    total,
+		"sort":           sortName,
+	}
+	if useCursor {
+		var nextCursor string
+		if len(products) > pg.Limit {
+			products = products[:pg.Limit]
+			if nextCursor, err = sort.cursorFor(h.db, sortName, products[len(products)-1].ID); err != nil {
+				return err
+			}
+		}
+		pagination["next_cursor"] = nextCursor
+	} else {
+		pagination["current_page"] = pg.Page
+	}
+
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"data":       products,
+		"facets":     facets,
+		"pagination": pagination,
+	})
+}
+
+// SuggestProducts returns a few best matching products for search
+// autocomplete.
+func (h *ProductHandler) SuggestProducts(c *fiber.Ctx) error {
+	search := services.ParseProductSearch(c.Query("q"))
+	if search == nil {
+		return c.JSON(fiber.Map{"success": true, "data": []fiber.Map{}})
+	}
+
+	limit := c.QueryInt("limit", 8)
+	if limit < 1 || limit > 20 {
+		limit = 8
+	}
+
 	var products []models.Product
-	if err := query.Preload("Brand").Preload("Category").Preload("Variants").Preload("Media").
-		Limit(pg.Limit).Offset(pg.Offset).
-		Order("created_at desc").
+	if err := search.Rank(search.Apply(h.db.Model(&models.Product{}))).
+		Preload("Brand").
+		Limit(limit).
 		Find(&products).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"data":    products,
-		"pagination": fiber.Map{
-			"current_page":  pg.Page,
-			"items_per_page": pg.Limit,
-			"total_items":   total,
-		},
-	})
+	data := make([]fiber.Map, 0, len(products))
+	for i := range products {
+		product := &products[i]
+		var brand string
+		if product.Brand != nil {
+			brand = product.Brand.Name
+		}
+		data = append(data, fiber.Map{
+			"id":         product.ID,
+			"slug":       product.Slug,
+			"name":       product.Name,
+			"brand":      brand,
+			"hero_image": product.HeroImage,
+			"base_price": product.BasePrice,
+			"currency":   product.Currency,
+			"highlight":  search.Highlight(product).Name,
+		})
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": data})
 }
 
 // GetProduct loads a product with relations.
@@ -101,6 +170,47 @@ func (h *ProductHandler) GetProduct(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
 	}
 
+	product, err := h.loadProduct("id = ?", id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "product not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": product})
+}
+
+// GetProductBySlug loads a product by its current or a former slug. Former
+// slugs answer with the product and a redirect_slug hint so the storefront
+// can redirect permanently.
+func (h *ProductHandler) GetProductBySlug(c *fiber.Ctx) error {
+	slug := c.Params("slug")
+	product, err := h.loadProduct("slug = ?", slug)
+	if err == nil {
+		return c.JSON(fiber.Map{"success": true, "data": product})
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	id, found, err := services.ResolveSlugRedirect(h.db, models.SlugKindProduct, slug)
+	if err != nil {
+		return err
+	}
+	if found {
+		product, err = h.loadProduct("id = ?", id)
+	}
+	if !found || errors.Is(err, gorm.ErrRecordNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, "product not found")
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"success": true, "data": product, "redirect_slug": product.Slug})
+}
+
+func (h *ProductHandler) loadProduct(query string, arg any) (*models.Product, error) {
 	var product models.Product
 	if err := h.db.Preload("Brand").
 		Preload("Category").
@@ -113,14 +223,10 @@ func (h *ProductHandler) GetProduct(c *fiber.Ctx) error {
 		Preload("Seasons").
 		Preload("ProductTypes").
 		Preload("RelatedProducts").
-		First(&product, "id = ?", id).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return fiber.NewError(fiber.StatusNotFound, "product not found")
-		}
-		return err
+		First(&product, query, arg).Error; err != nil {
+		return nil, err
 	}
-
-	return c.JSON(fiber.Map{"success": true, "data": product})
+	return &product, nil
 }
 
 type productRequest struct {
@@ -131,8 +237,6 @@ type productRequest struct {
 	GenderAudience    string               `json:"gender_audience"`
 	BasePrice         float64              `json:"base_price"`
 	Currency          string               `json:"currency"`
-	RatingAverage     float64              `json:"rating_average"`
-	RatingCount       int                  `json:"rating_count"`
 	ReleaseYear       int                  `json:"release_year"`
 	Manufacturer      string               `json:"manufacturer"`
 	CountryOfOrigin   string               `json:"country_of_origin"`
@@ -214,7 +318,15 @@ func (h *ProductHandler) CreateProduct(c *fiber.Ctx) error {
 		if err := h.attachLookupRelations(tx, &product, req); err != nil {
 			return err
 		}
-		return tx.Create(&product).Error
+		slug, err := services.UniqueSlug(tx, models.SlugKindProduct, req.Slug, req.Name, uuid.Nil)
+		if err != nil {
+			return err
+		}
+		product.Slug = slug
+		if err := tx.Create(&product).Error; err != nil {
+			return err
+		}
+		return services.RefreshProductSearch(tx, product.ID)
 	}); err != nil {
 		return err
 	}
@@ -254,6 +366,7 @@ func (h *ProductHandler) UpdateProduct(c *fiber.Ctx) error {
 	}
 	product.ID = existing.ID
 
+	var restocked []uuid.UUID
 	if err := h.db.Transaction(func(tx *gorm.DB) error {
 		if err := h.attachLookupRelations(tx, &product, req); err != nil {
 			return err
@@ -261,10 +374,21 @@ func (h *ProductHandler) UpdateProduct(c *fiber.Ctx) error {
 
 		product.CreatedAt = existing.CreatedAt
 
-		// Replace dependent associations
-		if err := tx.Where("product_id = ?", product.ID).Delete(&models.ProductVariant{}).Error; err != nil {
-			return err
+		// An empty slug keeps the current one; a new slug leaves the old one
+		// behind as a redirect.
+		product.Slug = existing.Slug
+		if strings.TrimSpace(req.Slug) != "" {
+			slug, err := services.UniqueSlug(tx, models.SlugKindProduct, req.Slug, req.Name, existing.ID)
+			if err != nil {
+				return err
+			}
+			if err := services.RecordSlugChange(tx, models.SlugKindProduct, existing.ID, existing.Slug, slug); err != nil {
+				return err
+			}
+			product.Slug = slug
 		}
+
+		// Replace dependent associations; variants are updated in place below.
 		if err := tx.Where("product_id = ?", product.ID).Delete(&models.ProductMedia{}).Error; err != nil {
 			return err
 		}
@@ -291,15 +415,53 @@ func (h *ProductHandler) UpdateProduct(c *fiber.Ctx) error {
 			return err
 		}
 
-		if err := tx.Model(&existing).Omit("ID", "CreatedAt").Updates(product).Error; err != nil {
+		// Associations are written explicitly below.
+		if err := tx.Model(&existing).Omit(clause.Associations, "ID", "CreatedAt").Updates(product).Error; err != nil {
 			return err
 		}
+		setProductChildIDs(&product)
+
+		// Variants are updated in place so cart lines, wishlist items and
+		// reservations keep pointing at them. Reserved stock is owned by open
+		// orders and the Billz product by the catalog sync, not by the edit
+		// form.
+		previous := make(map[uuid.UUID]models.ProductVariant, len(existing.Variants))
+		for _, v := range existing.Variants {
+			previous[v.ID] = v
+		}
+		for i := range product.Variants {
+			variant := &product.Variants[i]
+			old, ok := previous[variant.ID]
+			if !ok {
+				if err := tx.Create(variant).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			delete(previous, variant.ID)
 
-		if len(product.Variants) > 0 {
-			if err := tx.Create(&product.Variants).Error; err != nil {
+			variant.CreatedAt = old.CreatedAt
+			variant.ReservedQuantity = old.ReservedQuantity
+			if old.SKU == variant.SKU {
+				variant.BillzProductID = old.BillzProductID
+			}
+			if !old.InStock && variant.InStock {
+				restocked = append(restocked, old.ID)
+			}
+			if err := tx.Save(variant).Error; err != nil {
+				return err
+			}
+		}
+		if len(previous) > 0 {
+			dropped := make([]uuid.UUID, 0, len(previous))
+			for id := range previous {
+				dropped = append(dropped, id)
+			}
+			if err := deleteVariants(tx, "id IN ?", dropped); err != nil {
 				return err
 			}
 		}
+
 		if len(product.Media) > 0 {
 			if err := tx.Create(&product.Media).Error; err != nil {
 				return err
@@ -342,14 +504,57 @@ func (h *ProductHandler) UpdateProduct(c *fiber.Ctx) error {
 			}
 		}
 
-		return nil
+		return services.RefreshProductSearch(tx, product.ID)
 	}); err != nil {
 		return err
 	}
+	go h.backInStock.Notify(restocked)
 
 	return c.JSON(fiber.Map{"success": true, "data": product})
 }
 
+// setProductChildIDs points the dependent rows built from a request at the
+// product.
+func setProductChildIDs(product *models.Product) {
+	for i := range product.Variants {
+		product.Variants[i].ProductID = product.ID
+	}
+	for i := range product.Media {
+		product.Media[i].ProductID = product.ID
+	}
+	for i := range product.Specifications {
+		product.Specifications[i].ProductID = product.ID
+	}
+	for i := range product.DescriptionBlocks {
+		product.DescriptionBlocks[i].ProductID = product.ID
+	}
+	for i := range product.Highlights {
+		product.Highlights[i].ProductID = product.ID
+	}
+	for i := range product.RelatedProducts {
+		product.RelatedProducts[i].ProductID = product.ID
+	}
+}
+
+// deleteVariants deletes the variants matching the condition together with
+// the cart lines and wishlist items that hold them.
+func deleteVariants(tx *gorm.DB, query string, args ...any) error {
+	var ids []uuid.UUID
+	if err := tx.Model(&models.ProductVariant{}).Where(query, args...).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := tx.Where("product_variant_id IN ?", ids).Delete(&models.CartItem{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("product_variant_id IN ?", ids).Delete(&models.WishlistItem{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", ids).Delete(&models.ProductVariant{}).Error
+}
+
 // DeleteProduct removes a product and its associations.
 func (h *ProductHandler) DeleteProduct(c *fiber.Ctx) error {
 	id, err := uuid.Parse(c.Params("id"))
@@ -358,7 +563,13 @@ func (h *ProductHandler) DeleteProduct(c *fiber.Ctx) error {
 	}
 
 	if err := h.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Where("product_id = ?", id).Delete(&models.ProductVariant{}).Error; err != nil {
+		if err := tx.Where("product_id = ?", id).Delete(&models.WishlistItem{}).Error; err != nil {
+			return err
+		}
+		if err := deleteVariants(tx, "product_id = ?", id); err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", id).Delete(&models.ProductReview{}).Error; err != nil {
 			return err
 		}
 		if err := tx.Where("product_id = ?", id).Delete(&models.ProductMedia{}).Error; err != nil {
@@ -405,8 +616,6 @@ func (h *ProductHandler) buildProductFromRequest(req productRequest) (models.Pro
 		GenderAudience:    req.GenderAudience,
 		BasePrice:         req.BasePrice,
 		Currency:          req.Currency,
-		RatingAverage:     req.RatingAverage,
-		RatingCount:       req.RatingCount,
 		ReleaseYear:       req.ReleaseYear,
 		Manufacturer:      req.Manufacturer,
 		CountryOfOrigin:   req.CountryOfOrigin,
@@ -451,6 +660,15 @@ func (h *ProductHandler) buildProductFromRequest(req productRequest) (models.Pro
 		} else {
 			variant.InStock = v.InventoryQuantity > 0
 		}
+		// Keep variant IDs stable across edits so orders and stock
+		// reservations keep pointing at the same variant.
+		if v.ID != "" {
+			id, err := uuid.Parse(v.ID)
+			if err != nil {
+				return product, errors.New("invalid variant id")
+			}
+			variant.ID = id
+		}
 		product.Variants = append(product.Variants, variant)
 	}
 
@@ -570,11 +788,18 @@ func stringSliceToUUID(values []string) []uuid.UUID {
 	return ids
 }
 
-// RegisterProductRoutes attaches product routes to fiber app.
-func (h *ProductHandler) RegisterProductRoutes(router fiber.Router) {
+// RegisterProductRoutes attaches product routes to fiber app. The guards run
+// in front of every mutating route.
+func (h *ProductHandler) RegisterProductRoutes(router fiber.Router, guards ...fiber.Handler) {
+	guarded := func(handler fiber.Handler) []fiber.Handler {
+		return append(append([]fiber.Handler{}, guards...), handler)
+	}
+
 	router.Get("/", h.ListProducts)
+	router.Get("/suggest", h.SuggestProducts)
+	router.Get("/by-slug/:slug", h.GetProductBySlug)
 	router.Get("/:id", h.GetProduct)
-	router.Post("/", h.CreateProduct)
-	router.Put("/:id", h.UpdateProduct)
-	router.Delete("/:id", h.DeleteProduct)
+	router.Post("/", guarded(h.CreateProduct)...)
+	router.Put("/:id", guarded(h.UpdateProduct)...)
+	router.Delete("/:id", guarded(h.DeleteProduct)...)
 }
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+)
+
+// Facet names, also used as the keys of the facets block.
+const (
+	facetFragranceNotes    = "fragrance_notes"
+	facetSeasons           = "seasons"
+	facetProductTypes      = "product_types"
+	facetFragranceFamilies = "fragrance_families"
+	facetVolumes           = "volumes"
+)
+
+// productFilter is one condition of a product listing. Conditions tied to a
+// facet are left out when counting that facet, so shoppers still see the
+// other values they can add to the selection.
+type productFilter struct {
+	facet string
+	apply func(*gorm.DB) *gorm.DB
+}
+
+type productFilters []productFilter
+
+// parseProductFilters reads the listing filters from the query string.
+// Multi-select filters accept repeated keys or comma separated values; values
+// of one filter are OR-ed and different filters are AND-ed.
+func parseProductFilters(c *fiber.Ctx, search *services.ProductSearchQuery) productFilters {
+	var filters productFilters
+	add := func(facet string, apply func(*gorm.DB) *gorm.DB) {
+		filters = append(filters, productFilter{facet: facet, apply: apply})
+	}
+
+	if ids := queryUUIDs(c, "category_id"); len(ids) > 0 {
+		add("", func(q *gorm.DB) *gorm.DB { return q.Where("products.category_id IN ?", ids) })
+	}
+	if ids := queryUUIDs(c, "brand_id"); len(ids) > 0 {
+		add("", func(q *gorm.DB) *gorm.DB { return q.Where("products.brand_id IN ?", ids) })
+	}
+	if search != nil {
+		add("", search.Apply)
+	}
+	if minPrice := c.Query("min_price"); minPrice != "" {
+		if val, err := strconv.ParseFloat(minPrice, 64); err == nil {
+			add("", func(q *gorm.DB) *gorm.DB { return q.Where("products.base_price >= ?", val) })
+		}
+	}
+	if maxPrice := c.Query("max_price"); maxPrice != "" {
+		if val, err := strconv.ParseFloat(maxPrice, 64); err == nil {
+			add("", func(q *gorm.DB) *gorm.DB { return q.Where("products.base_price <= ?", val) })
+		}
+	}
+	if gender := c.Query("gender"); gender != "" {
+		add("", func(q *gorm.DB) *gorm.DB { return q.Where("products.gender_audience = ?", gender) })
+	}
+	if c.QueryBool("in_stock") {
+		add("", func(q *gorm.DB) *gorm.DB {
+			return q.Where("EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.is_active AND v.in_stock AND v.inventory_quantity > v.reserved_quantity)")
+		})
+	}
+
+	if ids := queryUUIDs(c, "fragrance_note_id"); len(ids) > 0 {
+		add(facetFragranceNotes, func(q *gorm.DB) *gorm.DB {
+			return q.Where("EXISTS (SELECT 1 FROM product_fragrance_notes j WHERE j.product_id = products.id AND j.fragrance_note_id IN ?)", ids)
+		})
+	}
+	if ids := queryUUIDs(c, "season_id"); len(ids) > 0 {
+		add(facetSeasons, func(q *gorm.DB) *gorm.DB {
+			return q.Where("EXISTS (SELECT 1 FROM product_seasons j WHERE j.product_id = products.id AND j.season_id IN ?)", ids)
+		})
+	}
+	if ids := queryUUIDs(c, "product_type_id"); len(ids) > 0 {
+		add(facetProductTypes, func(q *gorm.DB) *gorm.DB {
+			return q.Where("EXISTS (SELECT 1 FROM product_types_products j WHERE j.product_id = products.id AND j.product_type_id IN ?)", ids)
+		})
+	}
+	if families := queryValues(c, "fragrance_family"); len(families) > 0 {
+		add(facetFragranceFamilies, func(q *gorm.DB) *gorm.DB {
+			return q.Where("products.fragrance_family IN ?", families)
+		})
+	}
+	if volumes := queryInts(c, "volume_ml"); len(volumes) > 0 {
+		add(facetVolumes, func(q *gorm.DB) *gorm.DB {
+			return q.Where("EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.is_active AND v.volume_ml IN ?)", volumes)
+		})
+	}
+
+	return filters
+}
+
+// apply adds every filter except the ones of the given facet to query.
+func (f productFilters) apply(query *gorm.DB, exceptFacet string) *gorm.DB {
+	for _, filter := range f {
+		if exceptFacet != "" && filter.facet == exceptFacet {
+			continue
+		}
+		query = filter.apply(query)
+	}
+	return query
+}
+
+type lookupFacetValue struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	Count int64     `json:"count"`
+}
+
+type familyFacetValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type volumeFacetValue struct {
+	VolumeML int   `json:"volume_ml"`
+	Count    int64 `json:"count"`
+}
+
+// productFacets counts the products per facet value among the products
+// matching the filters.
+func (h *ProductHandler) productFacets(filters productFilters) (fiber.Map, error) {
+	matching := func(facet string) *gorm.DB {
+		return filters.apply(h.db.Model(&models.Product{}).Select("products.id"), facet)
+	}
+
+	lookups := []struct {
+		facet, joinTable, column, table string
+	}{
+		{facetFragranceNotes, "product_fragrance_notes", "fragrance_note_id", "fragrance_notes"},
+		{facetSeasons, "product_seasons", "season_id", "seasons"},
+		{facetProductTypes, "product_types_products", "product_type_id", "product_types"},
+	}
+
+	facets := fiber.Map{}
+	for _, lookup := range lookups {
+		var values []lookupFacetValue
+		if err := h.db.Table(lookup.joinTable+" AS j").
+			Select("l.id, l.name, COUNT(DISTINCT j.product_id) AS count").
+			Joins("JOIN "+lookup.table+" l ON l.id = j."+lookup.column).
+			Where("j.product_id IN (?)", matching(lookup.facet)).
+			Group("l.id, l.name").
+			Order("count DESC, l.name").
+			Scan(&values).Error; err != nil {
+			return nil, err
+		}
+		facets[lookup.facet] = values
+	}
+
+	var families []familyFacetValue
+	if err := h.db.Model(&models.Product{}).
+		Select("fragrance_family AS value, COUNT(*) AS count").
+		Where("id IN (?) AND fragrance_family <> ''", matching(facetFragranceFamilies)).
+		Group("fragrance_family").
+		Order("count DESC, fragrance_family").
+		Scan(&families).Error; err != nil {
+		return nil, err
+	}
+	facets[facetFragranceFamilies] = families
+
+	var volumes []volumeFacetValue
+	if err := h.db.Model(&models.ProductVariant{}).
+		Select("volume_ml, COUNT(DISTINCT product_id) AS count").
+		Where("product_id IN (?) AND is_active AND volume_ml > 0", matching(facetVolumes)).
+		Group("volume_ml").
+		Order("volume_ml").
+		Scan(&volumes).Error; err != nil {
+		return nil, err
+	}
+	facets[facetVolumes] = volumes
+
+	return facets, nil
+}
+
+// queryValues returns the values of a repeatable, comma separated query key.
+func queryValues(c *fiber.Ctx, key string) []string {
+	var values []string
+	for _, raw := range c.Context().QueryArgs().PeekMulti(key) {
+		for _, value := range strings.Split(string(raw), ",") {
+			if trimmed := strings.TrimSpace(value); trimmed != "" {
+				values = append(values, trimmed)
+			}
+		}
+	}
+	return values
+}
+
+func queryUUIDs(c *fiber.Ctx, key string) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, value := range queryValues(c, key) {
+		if id, err := uuid.Parse(value); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func queryInts(c *fiber.Ctx, key string) []int {
+	var ints []int
+	for _, value := range queryValues(c, key) {
+		if n, err := strconv.Atoi(value); err == nil {
+			ints = append(ints, n)
+		}
+	}
+	return ints
+}
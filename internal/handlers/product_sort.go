@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/utils"
+)
+
+// Product listing sort options.
+const (
+	productSortRelevance  = "relevance"
+	productSortNewest     = "newest"
+	productSortPriceAsc   = "price_asc"
+	productSortPriceDesc  = "price_desc"
+	productSortRating     = "rating"
+	productSortPopularity = "popularity"
+	productSortName       = "name"
+)
+
+// productSort orders products by one key with the product id as tie-breaker,
+// which keeps the order stable and allows keyset pagination.
+type productSort struct {
+	expr    string
+	sqlType string
+	desc    bool
+}
+
+var productSorts = map[string]productSort{
+	productSortNewest: {expr: "products.created_at", sqlType: "timestamptz", desc: true},
+	productSortPriceAsc: {
+		expr:    "COALESCE((SELECT MIN(v.price) FROM product_variants v WHERE v.product_id = products.id AND v.is_active), products.base_price)",
+		sqlType: "numeric",
+	},
+	productSortPriceDesc: {
+		expr:    "COALESCE((SELECT MIN(v.price) FROM product_variants v WHERE v.product_id = products.id AND v.is_active), products.base_price)",
+		sqlType: "numeric",
+		desc:    true,
+	},
+	productSortRating: {expr: "products.rating_average", sqlType: "numeric", desc: true},
+	productSortPopularity: {
+		expr: fmt.Sprintf("COALESCE((SELECT SUM(oi.quantity) FROM order_items oi JOIN orders o ON o.id = oi.order_id WHERE oi.product_id = products.id AND o.status NOT IN ('%s', '%s', '%s')), 0)",
+			models.OrderStatusPending, models.OrderStatusCancelled, models.OrderStatusRefunded),
+		sqlType: "numeric",
+		desc:    true,
+	},
+	productSortName: {expr: "products.name", sqlType: "text"},
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func (s productSort) direction() string {
+	if s.desc {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// order applies the sort to query.
+func (s productSort) order(query *gorm.DB) *gorm.DB {
+	return query.Order(fmt.Sprintf("%s %s, products.id %s", s.expr, s.direction(), s.direction()))
+}
+
+// after restricts query to the rows following the cursor position.
+func (s productSort) after(query *gorm.DB, cursor utils.Cursor) (*gorm.DB, error) {
+	id, err := uuid.Parse(cursor.ID)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	op := ">"
+	if s.desc {
+		op = "<"
+	}
+	return query.Where(
+		fmt.Sprintf("(%s, products.id) %s (CAST(? AS %s), ?)", s.expr, op, s.sqlType),
+		cursor.Value, id,
+	), nil
+}
+
+// cursorFor returns the cursor pointing after the given product.
+func (s productSort) cursorFor(db *gorm.DB, name string, productID uuid.UUID) (string, error) {
+	var value string
+	if err := db.Model(&models.Product{}).
+		Select(fmt.Sprintf("CAST(%s AS text)", s.expr)).
+		Where("products.id = ?", productID).
+		Scan(&value).Error; err != nil {
+		return "", err
+	}
+	return utils.EncodeCursor(utils.Cursor{Sort: name, Value: value, ID: productID.String()}), nil
+}
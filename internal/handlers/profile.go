@@ -1,25 +1,30 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/example/shafran/internal/middleware"
 	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
 	"github.com/example/shafran/internal/utils"
 )
 
 // ProfileHandler manages user profile endpoints.
 type ProfileHandler struct {
-	db *gorm.DB
+	db       *gorm.DB
+	sessions *services.SessionService
 }
 
 // NewProfileHandler constructs ProfileHandler.
-func NewProfileHandler(db *gorm.DB) *ProfileHandler {
-	return &ProfileHandler{db: db}
+func NewProfileHandler(db *gorm.DB, sessions *services.SessionService) *ProfileHandler {
+	return &ProfileHandler{db: db, sessions: sessions}
 }
 
 // GetProfile returns authenticated user profile.
@@ -43,6 +48,7 @@ func (h *ProfileHandler) GetProfile(c *fiber.Ctx) error {
 			"display_name":  user.DisplayName,
 			"phone":         user.Phone,
 			"is_verified":   user.IsVerified,
+			"role":          user.Role,
 			"created_at":    user.CreatedAt,
 			"updated_at":    user.UpdatedAt,
 		},
@@ -267,4 +273,249 @@ func (h *ProfileHandler) ListBonusTransactions(c *fiber.Ctx) error {
 		},
 	})
 }
+// GetBonusBalance returns the user's spendable bonus and the next expiry.
+func (h *ProfileHandler) GetBonusBalance(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	balance, err := services.GetBonusBalance(h.db, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": balance})
+}
+
+// Wishlist endpoints
+
+// ListWishlist returns the user's saved products.
+func (h *ProfileHandler) ListWishlist(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	var items []models.WishlistItem
+	if err := h.db.Where("user_id = ?", userID).
+		Preload("Product").
+		Preload("Product.Brand").
+		Preload("Product.Category").
+		Preload("Product.Variants").
+		Preload("Product.Media").
+		Preload("ProductVariant").
+		Order("created_at desc").
+		Find(&items).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": items})
+}
+
+type addWishlistItemRequest struct {
+	ProductID         string `json:"product_id"`
+	VariantID         string `json:"variant_id"`
+	NotifyBackInStock bool   `json:"notify_back_in_stock"`
+}
+
+// AddWishlistItem saves a product, or variant, to the wishlist. Adding an
+// item that is already saved only updates its back-in-stock flag.
+func (h *ProfileHandler) AddWishlistItem(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	var req addWishlistItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	productID, err := uuid.Parse(req.ProductID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid product_id")
+	}
+
+	var product models.Product
+	if err := h.db.Select("id").First(&product, "id = ?", productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "product not found")
+		}
+		return err
+	}
+
+	query := h.db.Where("user_id = ? AND product_id = ?", userID, productID)
+	var variantID *uuid.UUID
+	if req.VariantID != "" {
+		id, err := uuid.Parse(req.VariantID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid variant_id")
+		}
+		var variant models.ProductVariant
+		if err := h.db.Select("id").
+			First(&variant, "id = ? AND product_id = ?", id, productID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return fiber.NewError(fiber.StatusNotFound, "variant not found")
+			}
+			return err
+		}
+		variantID = &id
+		query = query.Where("product_variant_id = ?", id)
+	} else {
+		query = query.Where("product_variant_id IS NULL")
+	}
+
+	// The unique wishlist indexes settle concurrent adds: only one insert
+	// wins and the others fall through to the saved item.
+	item := models.WishlistItem{
+		UserID:            userID,
+		ProductID:         productID,
+		ProductVariantID:  variantID,
+		NotifyBackInStock: req.NotifyBackInStock,
+	}
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&item)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"success": true, "data": item})
+	}
+
+	var saved models.WishlistItem
+	if err := query.First(&saved).Error; err != nil {
+		return err
+	}
+	if saved.NotifyBackInStock != req.NotifyBackInStock {
+		if err := h.db.Model(&saved).Update("notify_back_in_stock", req.NotifyBackInStock).Error; err != nil {
+			return err
+		}
+	}
+	return c.JSON(fiber.Map{"success": true, "data": saved})
+}
+
+type updateWishlistItemRequest struct {
+	NotifyBackInStock bool `json:"notify_back_in_stock"`
+}
+
+// UpdateWishlistItem toggles the back-in-stock flag of a saved item.
+func (h *ProfileHandler) UpdateWishlistItem(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	itemID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
 
+	var req updateWishlistItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+
+	var item models.WishlistItem
+	if err := h.db.Where("id = ? AND user_id = ?", itemID, userID).First(&item).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "wishlist item not found")
+		}
+		return err
+	}
+
+	if err := h.db.Model(&item).Update("notify_back_in_stock", req.NotifyBackInStock).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": item})
+}
+
+// RemoveWishlistItem deletes a saved item.
+func (h *ProfileHandler) RemoveWishlistItem(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	itemID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	result := h.db.Where("id = ? AND user_id = ?", itemID, userID).Delete(&models.WishlistItem{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "wishlist item not found")
+	}
+
+	return c.JSON(fiber.Map{"success": true, "message": "wishlist item removed"})
+}
+
+// ListSessions returns the devices the user is signed in on.
+func (h *ProfileHandler) ListSessions(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+	currentID, _ := middleware.GetCurrentSessionID(c)
+
+	sessions, err := h.sessions.List(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+
+	data := make([]fiber.Map, 0, len(sessions))
+	for _, session := range sessions {
+		data = append(data, fiber.Map{
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == currentID,
+		})
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": data})
+}
+
+// RevokeSession signs the user out of one device.
+func (h *ProfileHandler) RevokeSession(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	sessionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	if err := h.sessions.Revoke(context.Background(), userID, sessionID); err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, "session not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "message": "session revoked"})
+}
+
+// RevokeOtherSessions signs the user out of every device but the current one.
+func (h *ProfileHandler) RevokeOtherSessions(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+	currentID, _ := middleware.GetCurrentSessionID(c)
+
+	revoked, err := h.sessions.RevokeAll(context.Background(), userID, currentID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": fiber.Map{"revoked": revoked}})
+}
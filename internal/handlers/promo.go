@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+	"github.com/example/shafran/internal/utils"
+)
+
+// PromoHandler manages promo codes and their preview.
+type PromoHandler struct {
+	db *gorm.DB
+}
+
+// NewPromoHandler constructs PromoHandler.
+func NewPromoHandler(db *gorm.DB) *PromoHandler {
+	return &PromoHandler{db: db}
+}
+
+// promoError turns a promo rejection into a 422 response. Other errors are
+// returned unchanged.
+func promoError(c *fiber.Ctx, err error) error {
+	var promoErr *services.PromoError
+	if !errors.As(err, &promoErr) {
+		return err
+	}
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+		"success": false,
+		"error":   promoErr.Message,
+		"code":    promoErr.Code,
+	})
+}
+
+type validatePromoRequest struct {
+	Code     string                `json:"code"`
+	Products []orderProductRequest `json:"products"`
+}
+
+// ValidatePromo previews the discount of a promo code on the given lines, or
+// on the current cart when no lines are sent.
+func (h *PromoHandler) ValidatePromo(c *fiber.Ctx) error {
+	var req validatePromoRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if strings.TrimSpace(req.Code) == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "code is required")
+	}
+
+	userID, token := cartOwner(c)
+	if len(req.Products) == 0 {
+		cart, err := services.FindActiveCart(h.db, userID, token)
+		if err != nil && !errors.Is(err, services.ErrCartNotFound) {
+			return err
+		}
+		if cart != nil {
+			if err := h.db.Model(cart).Association("Items").Find(&cart.Items); err != nil {
+				return err
+			}
+			req.Products = cartOrderLines(cart)
+		}
+	}
+	if len(req.Products) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "products are required")
+	}
+
+	priced, lineErrors, err := priceOrderLines(h.db, req.Products)
+	if err != nil {
+		return err
+	}
+	if len(lineErrors) > 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"success": false,
+			"error":   "some order lines could not be accepted",
+			"lines":   lineErrors,
+		})
+	}
+
+	lines, err := services.PromoLinesForItems(h.db, priced.Items)
+	if err != nil {
+		return err
+	}
+	result, err := services.EvaluatePromo(h.db, req.Code, userID, lines)
+	if err != nil {
+		return promoError(c, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data": fiber.Map{
+			"code":              result.Code,
+			"description":       result.Promo.Description,
+			"type":              result.Promo.Type,
+			"value":             result.Promo.Value,
+			"subtotal":          result.Subtotal,
+			"eligible_subtotal": result.EligibleSubtotal,
+			"discount":          result.Discount,
+			"total":             result.Subtotal - result.Discount,
+			"currency":          priced.Currency,
+		},
+	})
+}
+
+// ListPromoCodes returns promo codes for the back office.
+func (h *PromoHandler) ListPromoCodes(c *fiber.Ctx) error {
+	pg := utils.ParsePagination(c)
+	query := h.db.Model(&models.PromoCode{})
+	if search := strings.TrimSpace(c.Query("search")); search != "" {
+		query = query.Where("code ILIKE ?", "%"+search+"%")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
+	}
+
+	var items []models.PromoCode
+	if err := query.Order("created_at desc").
+		Limit(pg.Limit).Offset(pg.Offset).
+		Find(&items).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    items,
+		"pagination": fiber.Map{
+			"current_page":   pg.Page,
+			"items_per_page": pg.Limit,
+			"total_items":    total,
+		},
+	})
+}
+
+func validatePromoCode(item *models.PromoCode) error {
+	item.Code = services.NormalizePromoCode(item.Code)
+	if item.Code == "" {
+		return errors.New("code is required")
+	}
+	if item.Type != models.PromoTypePercent && item.Type != models.PromoTypeFixed {
+		return errors.New("type must be percent or fixed")
+	}
+	if item.Value <= 0 || (item.Type == models.PromoTypePercent && item.Value > 100) {
+		return errors.New("invalid value")
+	}
+	if item.StartsAt != nil && item.EndsAt != nil && item.EndsAt.Before(*item.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	for _, ids := range [][]string{item.BrandIDs, item.CategoryIDs, item.ProductIDs} {
+		for _, id := range ids {
+			if _, err := uuid.Parse(id); err != nil {
+				return errors.New("invalid restriction id " + id)
+			}
+		}
+	}
+	return nil
+}
+
+// CreatePromoCode adds a promo code.
+func (h *PromoHandler) CreatePromoCode(c *fiber.Ctx) error {
+	var item models.PromoCode
+	if err := c.BodyParser(&item); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	item.ID = uuid.Nil
+	item.UsedCount = 0
+	if err := validatePromoCode(&item); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	var existing int64
+	if err := h.db.Model(&models.PromoCode{}).Where("code = ?", item.Code).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return fiber.NewError(fiber.StatusConflict, "promo code already exists")
+	}
+
+	if err := h.db.Create(&item).Error; err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"success": true, "data": item})
+}
+
+// UpdatePromoCode edits a promo code. The usage counter is kept.
+func (h *PromoHandler) UpdatePromoCode(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+	var item models.PromoCode
+	if err := h.db.First(&item, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "promo code not found")
+		}
+		return err
+	}
+	usedCount := item.UsedCount
+	if err := c.BodyParser(&item); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	item.ID = id
+	item.UsedCount = usedCount
+	if err := validatePromoCode(&item); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	var existing int64
+	if err := h.db.Model(&models.PromoCode{}).
+		Where("code = ? AND id <> ?", item.Code, id).
+		Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return fiber.NewError(fiber.StatusConflict, "promo code already exists")
+	}
+
+	if err := h.db.Save(&item).Error; err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"success": true, "data": item})
+}
+
+// DeletePromoCode removes a promo code. Orders keep the code they used.
+func (h *PromoHandler) DeletePromoCode(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+	if err := h.db.Delete(&models.PromoCode{}, "id = ?", id).Error; err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/middleware"
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
+	"github.com/example/shafran/internal/utils"
+)
+
+const maxReviewPhotos = 5
+
+// ReviewHandler manages product reviews and their moderation.
+type ReviewHandler struct {
+	db *gorm.DB
+}
+
+// NewReviewHandler constructs ReviewHandler.
+func NewReviewHandler(db *gorm.DB) *ReviewHandler {
+	return &ReviewHandler{db: db}
+}
+
+type reviewRequest struct {
+	Rating int      `json:"rating"`
+	Text   string   `json:"text"`
+	Photos []string `json:"photos"`
+}
+
+func (r *reviewRequest) validate() error {
+	if r.Rating < 1 || r.Rating > 5 {
+		return errors.New("rating must be between 1 and 5")
+	}
+	r.Text = strings.TrimSpace(r.Text)
+	if len(r.Photos) > maxReviewPhotos {
+		return errors.New("too many photos")
+	}
+	return nil
+}
+
+// ListProductReviews returns the approved reviews of a product.
+func (h *ReviewHandler) ListProductReviews(c *fiber.Ctx) error {
+	productID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	pg := utils.ParsePagination(c)
+	query := h.db.Model(&models.ProductReview{}).
+		Where("product_id = ? AND status = ?", productID, models.ReviewStatusApproved)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
+	}
+
+	var reviews []models.ProductReview
+	if err := query.Preload("User", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "first_name", "display_name")
+	}).
+		Order("created_at desc").
+		Limit(pg.Limit).Offset(pg.Offset).
+		Find(&reviews).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    reviews,
+		"pagination": fiber.Map{
+			"current_page":   pg.Page,
+			"items_per_page": pg.Limit,
+			"total_items":    total,
+		},
+	})
+}
+
+// ListMyReviews returns the authenticated user's reviews in any status.
+func (h *ReviewHandler) ListMyReviews(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	var reviews []models.ProductReview
+	if err := h.db.Where("user_id = ?", userID).
+		Preload("Product", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "slug", "name", "hero_image")
+		}).
+		Order("created_at desc").
+		Find(&reviews).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": reviews})
+}
+
+// CreateReview adds the authenticated user's review of a product. New reviews
+// wait for moderation before they count towards the rating.
+func (h *ReviewHandler) CreateReview(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	productID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req reviewRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := req.validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	var product models.Product
+	if err := h.db.Select("id").First(&product, "id = ?", productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "product not found")
+		}
+		return err
+	}
+
+	var existing int64
+	if err := h.db.Model(&models.ProductReview{}).
+		Where("product_id = ? AND user_id = ?", productID, userID).
+		Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return fiber.NewError(fiber.StatusConflict, "you have already reviewed this product")
+	}
+
+	verified, err := services.HasDeliveredPurchase(h.db, userID, productID)
+	if err != nil {
+		return err
+	}
+
+	review := models.ProductReview{
+		ProductID:          productID,
+		UserID:             userID,
+		Rating:             req.Rating,
+		Text:               req.Text,
+		Photos:             pq.StringArray(req.Photos),
+		IsVerifiedPurchase: verified,
+		Status:             models.ReviewStatusPending,
+	}
+	if err := h.db.Create(&review).Error; err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"success": true, "data": review})
+}
+
+// UpdateReview edits the authenticated user's review and sends it back to
+// moderation.
+func (h *ReviewHandler) UpdateReview(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req reviewRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if err := req.validate(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	var review models.ProductReview
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND user_id = ?", reviewID, userID).First(&review).Error; err != nil {
+			return err
+		}
+
+		verified, err := services.HasDeliveredPurchase(tx, userID, review.ProductID)
+		if err != nil {
+			return err
+		}
+
+		review.Rating = req.Rating
+		review.Text = req.Text
+		review.Photos = pq.StringArray(req.Photos)
+		review.IsVerifiedPurchase = verified
+		review.Status = models.ReviewStatusPending
+		review.ModeratedByID = nil
+		review.ModeratedAt = nil
+		if err := tx.Save(&review).Error; err != nil {
+			return err
+		}
+
+		return services.RecomputeProductRating(tx, review.ProductID)
+	}); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "review not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": review})
+}
+
+// DeleteReview removes the authenticated user's review.
+func (h *ReviewHandler) DeleteReview(c *fiber.Ctx) error {
+	userID, ok := middleware.GetCurrentUserID(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		var review models.ProductReview
+		if err := tx.Where("id = ? AND user_id = ?", reviewID, userID).First(&review).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&review).Error; err != nil {
+			return err
+		}
+		return services.RecomputeProductRating(tx, review.ProductID)
+	}); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "review not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "message": "review deleted"})
+}
+
+// AdminListReviews returns reviews for moderation, optionally filtered by
+// status and product.
+func (h *ReviewHandler) AdminListReviews(c *fiber.Ctx) error {
+	pg := utils.ParsePagination(c)
+	query := h.db.Model(&models.ProductReview{})
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if v := c.Query("product_id"); v != "" {
+		if id, err := uuid.Parse(v); err == nil {
+			query = query.Where("product_id = ?", id)
+		}
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return err
+	}
+
+	var reviews []models.ProductReview
+	if err := query.Preload("User").
+		Preload("Product", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "slug", "name")
+		}).
+		Order("created_at desc").
+		Limit(pg.Limit).Offset(pg.Offset).
+		Find(&reviews).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    reviews,
+		"pagination": fiber.Map{
+			"current_page":   pg.Page,
+			"items_per_page": pg.Limit,
+			"total_items":    total,
+		},
+	})
+}
+
+type moderateReviewRequest struct {
+	Status string `json:"status"`
+}
+
+// ModerateReview approves or hides a review and refreshes the product rating.
+func (h *ReviewHandler) ModerateReview(c *fiber.Ctx) error {
+	reviewID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid id")
+	}
+
+	var req moderateReviewRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid request body")
+	}
+	if !models.IsValidReviewStatus(req.Status) {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid status")
+	}
+
+	actorID, _ := middleware.GetCurrentUserID(c)
+
+	var review models.ProductReview
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&review, "id = ?", reviewID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		review.Status = req.Status
+		review.ModeratedByID = &actorID
+		review.ModeratedAt = &now
+		if err := tx.Save(&review).Error; err != nil {
+			return err
+		}
+
+		return services.RecomputeProductRating(tx, review.ProductID)
+	}); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return fiber.NewError(fiber.StatusNotFound, "review not found")
+		}
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true, "data": review})
+}
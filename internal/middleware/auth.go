@@ -1,40 +1,110 @@
 package middleware
 
 import (
+	"context"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 
 	"github.com/example/shafran/internal/config"
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/services"
 	"github.com/example/shafran/internal/utils"
 )
 
-const userContextKey = "currentUserID"
+const (
+	userContextKey    = "currentUserID"
+	roleContextKey    = "currentUserRole"
+	sessionContextKey = "currentSessionID"
+)
 
-// AuthMiddleware validates JWT tokens and loads the authenticated user ID into context.
-func AuthMiddleware(cfg *config.Config) fiber.Handler {
+// AuthMiddleware validates JWT tokens, rejects tokens of revoked sessions and
+// loads the authenticated user ID into context.
+func AuthMiddleware(cfg *config.Config, sessions *services.SessionService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
 			return fiber.NewError(fiber.StatusUnauthorized, "missing authorization header")
 		}
 
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
-			return fiber.NewError(fiber.StatusUnauthorized, "invalid authorization header")
+		if err := authenticate(c, cfg, sessions, authHeader); err != nil {
+			return err
 		}
+		return c.Next()
+	}
+}
 
-		userID, err := utils.ParseToken(cfg.JWTSecret, parts[1])
-		if err != nil {
-			return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+// OptionalAuthMiddleware authenticates the request when an Authorization
+// header is present and lets anonymous requests through. A header that is
+// present but invalid is still rejected so clients know to refresh.
+func OptionalAuthMiddleware(cfg *config.Config, sessions *services.SessionService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		authHeader := c.Get("Authorization")
+		if authHeader == "" {
+			return c.Next()
 		}
 
-		c.Locals(userContextKey, userID)
+		if err := authenticate(c, cfg, sessions, authHeader); err != nil {
+			return err
+		}
 		return c.Next()
 	}
 }
 
+func authenticate(c *fiber.Ctx, cfg *config.Config, sessions *services.SessionService, authHeader string) error {
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid authorization header")
+	}
+
+	claims, err := utils.ParseToken(cfg.JWTSecret, parts[1])
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+	}
+
+	active, err := sessions.IsActive(context.Background(), claims.UserID, claims.SessionID)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fiber.NewError(fiber.StatusUnauthorized, "session revoked")
+	}
+
+	role := claims.Role
+	if role == "" {
+		role = models.RoleCustomer
+	}
+
+	c.Locals(userContextKey, claims.UserID)
+	c.Locals(roleContextKey, role)
+	c.Locals(sessionContextKey, claims.SessionID)
+	return nil
+}
+
+// RequireRole allows the request through only when the authenticated user has
+// one of the given roles. Super admins are always allowed. It must be mounted
+// after AuthMiddleware.
+func RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, ok := GetCurrentUserRole(c)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "unauthorized")
+		}
+
+		if role == models.RoleSuperAdmin {
+			return c.Next()
+		}
+		for _, allowed := range roles {
+			if role == allowed {
+				return c.Next()
+			}
+		}
+
+		return fiber.NewError(fiber.StatusForbidden, "insufficient permissions")
+	}
+}
+
 // GetCurrentUserID extracts the authenticated user ID from context.
 func GetCurrentUserID(c *fiber.Ctx) (uuid.UUID, bool) {
 	value := c.Locals(userContextKey)
@@ -48,3 +118,18 @@ func GetCurrentUserID(c *fiber.Ctx) (uuid.UUID, bool) {
 
 	return uuid.Nil, false
 }
+
+// GetCurrentUserRole extracts the authenticated user role from context.
+func GetCurrentUserRole(c *fiber.Ctx) (string, bool) {
+	role, ok := c.Locals(roleContextKey).(string)
+	if !ok || role == "" {
+		return "", false
+	}
+	return role, true
+}
+
+// GetCurrentSessionID extracts the authenticated session ID from context.
+func GetCurrentSessionID(c *fiber.Ctx) (uuid.UUID, bool) {
+	id, ok := c.Locals(sessionContextKey).(uuid.UUID)
+	return id, ok
+}
@@ -1,9 +1,7 @@
 package middleware
 
 import (
-	"encoding/base64"
 	"encoding/json"
-	"strings"
 
 	"github.com/gofiber/fiber/v2"
 
@@ -20,19 +18,7 @@ func PaymeAuthMiddleware(merchantKey string) fiber.Handler {
 		var reqID paymeRequestID
 		_ = json.Unmarshal(c.Body(), &reqID)
 
-		authHeader := c.Get("Authorization")
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 {
-			return writePaymeAuthError(c, reqID.ID)
-		}
-
-		token := parts[1]
-		decoded, err := base64.StdEncoding.DecodeString(token)
-		if err != nil {
-			return writePaymeAuthError(c, reqID.ID)
-		}
-
-		if !strings.Contains(string(decoded), merchantKey) {
+		if !services.VerifyPaymeAuthorization(c.Get("Authorization"), merchantKey) {
 			return writePaymeAuthError(c, reqID.ID)
 		}
 
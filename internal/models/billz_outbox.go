@@ -0,0 +1,44 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Billz outbox entry kinds.
+const (
+	BillzOutboxKindOrder       = "order"       // cash order, pushed from Payload
+	BillzOutboxKindTransaction = "transaction" // paid payment transaction
+)
+
+// Billz outbox states.
+const (
+	BillzOutboxStatusPending    = "pending"
+	BillzOutboxStatusProcessing = "processing"
+	BillzOutboxStatusDone       = "done"
+	BillzOutboxStatusDead       = "dead"
+)
+
+// BillzOutbox is a durable request to create the Billz order of an order or
+// payment transaction. Each subject has at most one entry. The Billz order id
+// and the steps already completed are stored as the push goes, so a retry
+// continues the same Billz order instead of opening another one.
+type BillzOutbox struct {
+	BaseModel
+	Kind             string          `gorm:"uniqueIndex:idx_billz_outbox_subject" json:"kind"`
+	SubjectID        uuid.UUID       `gorm:"type:uuid;uniqueIndex:idx_billz_outbox_subject" json:"subject_id"`
+	Status           string          `gorm:"index" json:"status"`
+	Attempts         int             `json:"attempts"`
+	NextAttemptAt    time.Time       `gorm:"index" json:"next_attempt_at"`
+	LastError        string          `json:"last_error,omitempty"`
+	Payload          json.RawMessage `gorm:"type:jsonb" json:"payload,omitempty"`
+	BillzOrderID     string          `json:"billz_order_id,omitempty"`
+	BillzOrderNumber string          `json:"billz_order_number,omitempty"`
+	BillzOrderType   string          `json:"billz_order_type,omitempty"`
+	ItemsAdded       int             `json:"items_added"`
+	CustomerAttached bool            `json:"customer_attached"`
+	PaidAt           *time.Time      `json:"paid_at,omitempty"`
+	CompletedAt      *time.Time      `json:"completed_at,omitempty"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Billz sync run states.
+const (
+	BillzSyncStatusRunning   = "running"
+	BillzSyncStatusSucceeded = "succeeded"
+	BillzSyncStatusFailed    = "failed"
+)
+
+// BillzSyncRun records one pull of the Billz catalog into local variants.
+// Report holds the changed variants and the items that could not be matched.
+type BillzSyncRun struct {
+	BaseModel
+	Trigger        string          `json:"trigger"` // schedule|manual
+	Status         string          `gorm:"index" json:"status"`
+	StartedAt      time.Time       `json:"started_at"`
+	FinishedAt     *time.Time      `json:"finished_at"`
+	BillzProducts  int             `json:"billz_products"`
+	Matched        int             `json:"matched"`
+	Updated        int             `json:"updated"`
+	UnmatchedLocal int             `json:"unmatched_local"`
+	UnmatchedBillz int             `json:"unmatched_billz"`
+	Error          string          `json:"error,omitempty"`
+	Report         json.RawMessage `gorm:"type:jsonb" json:"report,omitempty"`
+}
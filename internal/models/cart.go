@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cart states. A guest cart becomes merged once it is folded into a user's
+// cart, and ordered once it is checked out.
+const (
+	CartStatusActive  = "active"
+	CartStatusMerged  = "merged"
+	CartStatusOrdered = "ordered"
+)
+
+// Cart is a persisted shopping cart. Guest carts are addressed by Token; once
+// a customer signs in the cart is attached to UserID.
+type Cart struct {
+	BaseModel
+	UserID         *uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	User           *User      `json:"user,omitempty"`
+	Token          string     `gorm:"uniqueIndex" json:"token"`
+	Status         string     `gorm:"default:active;index" json:"status"`
+	Currency       string     `json:"currency"`
+	OrderID        *uuid.UUID `gorm:"type:uuid" json:"order_id"`
+	LastActivityAt time.Time  `gorm:"index" json:"last_activity_at"`
+	Items          []CartItem `json:"items,omitempty"`
+}
+
+// CartItem is a variant line in a cart. UnitPrice is the price the customer
+// last saw, used to flag price changes.
+type CartItem struct {
+	BaseModel
+	CartID           uuid.UUID       `gorm:"type:uuid;index" json:"cart_id"`
+	ProductID        uuid.UUID       `gorm:"type:uuid" json:"product_id"`
+	Product          *Product        `json:"product,omitempty"`
+	ProductVariantID uuid.UUID       `gorm:"type:uuid;index" json:"product_variant_id"`
+	ProductVariant   *ProductVariant `json:"product_variant,omitempty"`
+	Quantity         int             `json:"quantity"`
+	UnitPrice        float64         `json:"unit_price"`
+}
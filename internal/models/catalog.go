@@ -19,6 +19,7 @@ type Category struct {
 type Brand struct {
 	BaseModel
 	Name         string     `json:"name"`
+	Slug         string     `gorm:"uniqueIndex" json:"slug"`
 	Description  string     `json:"description"`
 	Country      string     `json:"country"`
 	Image        string     `json:"image"`
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Inventory reservation states.
+const (
+	ReservationStatusReserved  = "reserved"
+	ReservationStatusCommitted = "committed"
+	ReservationStatusReleased  = "released"
+)
+
+// InventoryReservation is a stock ledger entry that holds variant quantity for
+// an order until it is either committed (stock decremented) or released.
+type InventoryReservation struct {
+	BaseModel
+	OrderID          uuid.UUID  `gorm:"type:uuid;index" json:"order_id"`
+	ProductVariantID uuid.UUID  `gorm:"type:uuid;index" json:"product_variant_id"`
+	Quantity         int        `json:"quantity"`
+	Status           string     `gorm:"index" json:"status"`
+	ExpiresAt        *time.Time `gorm:"index" json:"expires_at"`
+	CommittedAt      *time.Time `json:"committed_at"`
+	ReleasedAt       *time.Time `json:"released_at"`
+	ReleaseReason    string     `json:"release_reason"`
+}
@@ -19,8 +19,23 @@ type PickupBranch struct {
 	WorkingHours string  `json:"working_hours"`
 	ContactPhone string  `json:"contact_phone"`
 	IsActive     bool    `json:"is_active"`
+
+	// Billz store pickup orders of the branch are booked in. Empty values
+	// fall back to the configured default store.
+	BillzShopID             string `json:"billz_shop_id"`
+	BillzCashboxID          string `json:"billz_cashbox_id"`
+	BillzCashPaymentTypeID  string `json:"billz_cash_payment_type_id"`
+	BillzPaymePaymentTypeID string `json:"billz_payme_payment_type_id"`
+	BillzClickPaymentTypeID string `json:"billz_click_payment_type_id"`
 }
 
+// Payment provider types. Online types are backed by a payment gateway.
+const (
+	PaymentTypeCash  = "cash"
+	PaymentTypePayme = "payme"
+	PaymentTypeClick = "click"
+)
+
 type PaymentProvider struct {
 	BaseModel
 	Name       string `json:"name"`
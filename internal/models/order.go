@@ -27,8 +27,12 @@ type Order struct {
 	PaymentMethod       string     `json:"payment_method"`
 	TransactionID       string     `json:"transaction_id"`
 	BonusAmount         float64    `json:"bonus_amount"`
+	DiscountAmount      float64    `json:"discount_amount"`
+	PromoCodeID         *uuid.UUID `gorm:"type:uuid" json:"promo_code_id"`
+	PromoCode           string     `json:"promo_code"`
 	Notes               string     `json:"notes"`
 	Items               []OrderItem `json:"items,omitempty"`
+	StatusHistory       []OrderStatusHistory `json:"status_history,omitempty"`
 
 	// Billz integration fields
 	BillzOrderID     string     `json:"billz_order_id,omitempty"`
@@ -50,3 +54,87 @@ type OrderItem struct {
 	LineTotal        float64    `json:"line_total"`
 }
 
+
+// Order lifecycle statuses.
+const (
+	OrderStatusPending        = "pending"
+	OrderStatusPaid           = "paid"
+	OrderStatusConfirmed      = "confirmed"
+	OrderStatusPacked         = "packed"
+	OrderStatusShipped        = "shipped"
+	OrderStatusReadyForPickup = "ready_for_pickup"
+	OrderStatusDelivered      = "delivered"
+	OrderStatusCancelled      = "cancelled"
+	OrderStatusRefunded       = "refunded"
+)
+
+// orderStatusTransitions lists the statuses each status may move to.
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPending:        {OrderStatusPaid, OrderStatusConfirmed, OrderStatusCancelled},
+	OrderStatusPaid:           {OrderStatusConfirmed, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusConfirmed:      {OrderStatusPacked, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusPacked:         {OrderStatusShipped, OrderStatusReadyForPickup, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusShipped:        {OrderStatusDelivered, OrderStatusRefunded},
+	OrderStatusReadyForPickup: {OrderStatusDelivered, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusDelivered:      {OrderStatusRefunded},
+}
+
+// IsValidOrderStatus reports whether status belongs to the order lifecycle.
+func IsValidOrderStatus(status string) bool {
+	if _, ok := orderStatusTransitions[status]; ok {
+		return true
+	}
+	return status == OrderStatusCancelled || status == OrderStatusRefunded
+}
+
+// CanTransitionOrderStatus reports whether an order may move from one status to another.
+func CanTransitionOrderStatus(from, to string) bool {
+	for _, next := range orderStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOrderStatuses returns the statuses reachable from the given status.
+func NextOrderStatuses(from string) []string {
+	return append([]string(nil), orderStatusTransitions[from]...)
+}
+
+// IsAdminOrderTransition reports whether admins may move an order paid with
+// paymentMethod from one status to another. Only a settled payment transaction
+// marks an order as paid, so only cash orders are confirmed straight from
+// pending; online orders have to be paid through their provider first.
+func IsAdminOrderTransition(from, to, paymentMethod string) bool {
+	if to == OrderStatusPaid {
+		return false
+	}
+	if from == OrderStatusPending && to == OrderStatusConfirmed && paymentMethod != PaymentTypeCash {
+		return false
+	}
+	return CanTransitionOrderStatus(from, to)
+}
+
+// AdminNextOrderStatuses returns the statuses an admin may move an order paid
+// with paymentMethod to from the given status.
+func AdminNextOrderStatuses(from, paymentMethod string) []string {
+	next := make([]string, 0, len(orderStatusTransitions[from]))
+	for _, status := range orderStatusTransitions[from] {
+		if IsAdminOrderTransition(from, status, paymentMethod) {
+			next = append(next, status)
+		}
+	}
+	return next
+}
+
+// OrderStatusHistory records every status change of an order.
+type OrderStatusHistory struct {
+	BaseModel
+	OrderID     uuid.UUID  `gorm:"type:uuid;index" json:"order_id"`
+	FromStatus  string     `json:"from_status"`
+	ToStatus    string     `json:"to_status"`
+	ChangedByID *uuid.UUID `gorm:"type:uuid" json:"changed_by_id"`
+	ChangedBy   *User      `gorm:"foreignKey:ChangedByID" json:"changed_by,omitempty"`
+	Note        string     `json:"note"`
+}
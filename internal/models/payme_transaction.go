@@ -15,6 +15,7 @@ type PaymeTransaction struct {
 	Status           int        `json:"status"`
 	Amount           int64      `json:"amount"`
 	OrderID          string     `json:"order_id"`
+	InternalOrderID  *uuid.UUID `gorm:"type:uuid;index" json:"internal_order_id"`
 	CreateTime       int64      `json:"create_time"`
 	PerformTime      int64      `json:"perform_time"`
 	CancelTime       int64      `json:"cancel_time"`
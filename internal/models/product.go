@@ -39,22 +39,48 @@ type Product struct {
 	ProductTypes      []ProductType      `gorm:"many2many:product_types_products;" json:"product_types,omitempty"`
 	RelatedTitle      string             `json:"related_title"`
 	RelatedProducts   []ProductRelation  `json:"related_products,omitempty"`
+
+	// Search columns are maintained by services.RefreshProductSearch. The
+	// search_vector column is generated from them by the database.
+	SearchKey       string                  `gorm:"not null;default:''" json:"-"`
+	SearchDocument  string                  `gorm:"not null;default:''" json:"-"`
+	SearchHighlight *ProductSearchHighlight `gorm:"-" json:"search_highlight,omitempty"`
+}
+
+// ProductSearchHighlight carries the parts of a search hit that matched the
+// query, with matches wrapped in <mark> tags.
+type ProductSearchHighlight struct {
+	Name    string `json:"name"`
+	Snippet string `json:"snippet"`
 }
 
 type ProductVariant struct {
 	BaseModel
 	ProductID        uuid.UUID `gorm:"type:uuid;index" json:"product_id"`
 	SKU              string    `json:"sku"`
+	// BillzProductID is the Billz product matched by SKU, kept by the
+	// catalog sync.
+	BillzProductID   string    `gorm:"index" json:"billz_product_id,omitempty"`
 	Label            string    `json:"label"`
 	VolumeML         int       `json:"volume_ml"`
 	Price            float64   `json:"price"`
 	Currency         string    `json:"currency"`
 	IsTester         bool      `json:"is_tester"`
 	InventoryQuantity int      `json:"inventory_quantity"`
+	ReservedQuantity int       `json:"reserved_quantity"`
 	IsActive         bool      `json:"is_active"`
 	InStock          bool      `json:"in_stock"`
 }
 
+// AvailableQuantity returns the stock that is not held by open reservations.
+func (v ProductVariant) AvailableQuantity() int {
+	available := v.InventoryQuantity - v.ReservedQuantity
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
 type ProductMedia struct {
 	BaseModel
 	ProductID    uuid.UUID `gorm:"type:uuid;index" json:"product_id"`
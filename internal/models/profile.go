@@ -18,6 +18,22 @@ type UserAddress struct {
 	IsDefault   bool      `json:"is_default"`
 }
 
+// Bonus ledger entry types. Earn and refund entries credit the balance;
+// redeem, revoke and expire entries debit it.
+const (
+	BonusTypeEarn   = "earn"
+	BonusTypeRedeem = "redeem"
+	BonusTypeRefund = "refund"
+	BonusTypeRevoke = "revoke"
+	BonusTypeExpire = "expire"
+)
+
+// BonusStatusCompleted marks a bonus entry that has been applied.
+const BonusStatusCompleted = "completed"
+
+// BonusTransaction is a loyalty ledger entry. Amount is always positive and
+// Type tells its direction. Credit entries track the unspent part in
+// Remaining so points can be spent and expired oldest first.
 type BonusTransaction struct {
 	BaseModel
 	UserID             uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
@@ -25,8 +41,23 @@ type BonusTransaction struct {
 	Type               string     `json:"type"`
 	Status             string     `json:"status"`
 	Amount             float64    `json:"amount"`
+	Remaining          float64    `json:"remaining"`
 	Currency           string     `json:"currency"`
-	OrderID            *uuid.UUID `gorm:"type:uuid" json:"order_id"`
+	OrderID            *uuid.UUID `gorm:"type:uuid;index" json:"order_id"`
+	Description        string     `json:"description"`
+	ExpiresAt          *time.Time `json:"expires_at"`
 	OccurredAt         time.Time  `json:"occurred_at"`
 }
 
+// WishlistItem is a product a customer saved for later, optionally pinned to a
+// variant. NotifyBackInStock asks to be told when the item is available again;
+// it is cleared once the customer has been notified.
+type WishlistItem struct {
+	BaseModel
+	UserID            uuid.UUID       `gorm:"type:uuid;index" json:"user_id"`
+	ProductID         uuid.UUID       `gorm:"type:uuid;index" json:"product_id"`
+	Product           *Product        `json:"product,omitempty"`
+	ProductVariantID  *uuid.UUID      `gorm:"type:uuid" json:"product_variant_id"`
+	ProductVariant    *ProductVariant `json:"product_variant,omitempty"`
+	NotifyBackInStock bool            `json:"notify_back_in_stock"`
+}
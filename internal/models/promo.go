@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Promo code discount types.
+const (
+	PromoTypePercent = "percent"
+	PromoTypeFixed   = "fixed"
+)
+
+// PromoCode is a marketing discount applied to orders. Restrictions to brands,
+// categories or products limit which order lines the discount applies to;
+// empty restrictions apply to the whole order.
+type PromoCode struct {
+	BaseModel
+	Code           string         `gorm:"uniqueIndex" json:"code"`
+	Description    string         `json:"description"`
+	Type           string         `json:"type"` // percent|fixed
+	Value          float64        `json:"value"`
+	MaxDiscount    float64        `json:"max_discount"`
+	MinOrderAmount float64        `json:"min_order_amount"`
+	StartsAt       *time.Time     `json:"starts_at"`
+	EndsAt         *time.Time     `json:"ends_at"`
+	UsageLimit     int            `json:"usage_limit"`
+	PerUserLimit   int            `json:"per_user_limit"`
+	UsedCount      int            `json:"used_count"`
+	IsActive       bool           `gorm:"default:true" json:"is_active"`
+	BrandIDs       pq.StringArray `gorm:"type:text[]" json:"brand_ids"`
+	CategoryIDs    pq.StringArray `gorm:"type:text[]" json:"category_ids"`
+	ProductIDs     pq.StringArray `gorm:"type:text[]" json:"product_ids"`
+}
+
+// PromoRedemption records a promo code used by an order. Redemptions of
+// cancelled orders are released and no longer count towards the limits.
+type PromoRedemption struct {
+	BaseModel
+	PromoCodeID uuid.UUID  `gorm:"type:uuid;index" json:"promo_code_id"`
+	UserID      uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	OrderID     uuid.UUID  `gorm:"type:uuid;uniqueIndex" json:"order_id"`
+	Amount      float64    `json:"amount"`
+	ReleasedAt  *time.Time `json:"released_at"`
+}
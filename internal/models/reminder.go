@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reminder kinds.
+const (
+	ReminderKindAbandonedCart = "abandoned_cart"
+	ReminderKindUnpaidPayment = "unpaid_payment"
+)
+
+// Reminder delivery states.
+const (
+	ReminderStatusPending = "pending"
+	ReminderStatusSent    = "sent"
+	ReminderStatusFailed  = "failed"
+)
+
+// Reminder records a follow-up sent for an abandoned cart or an unpaid
+// order. There is at most one reminder per subject, so customers are never
+// reminded twice about the same thing.
+type Reminder struct {
+	BaseModel
+	Kind      string     `gorm:"uniqueIndex:idx_reminder_kind_subject" json:"kind"`
+	SubjectID uuid.UUID  `gorm:"type:uuid;uniqueIndex:idx_reminder_kind_subject" json:"subject_id"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	Channel   string     `json:"channel"`
+	Status    string     `gorm:"index" json:"status"`
+	Error     string     `json:"error,omitempty"`
+	SentAt    *time.Time `json:"sent_at"`
+}
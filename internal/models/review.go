@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Review moderation statuses. Only approved reviews are shown on the
+// storefront and counted in the product rating.
+const (
+	ReviewStatusPending  = "pending"
+	ReviewStatusApproved = "approved"
+	ReviewStatusHidden   = "hidden"
+)
+
+// IsValidReviewStatus reports whether status is a known review status.
+func IsValidReviewStatus(status string) bool {
+	switch status {
+	case ReviewStatusPending, ReviewStatusApproved, ReviewStatusHidden:
+		return true
+	}
+	return false
+}
+
+// ProductReview is a customer's rating of a product. A customer has at most
+// one review per product.
+type ProductReview struct {
+	BaseModel
+	ProductID          uuid.UUID      `gorm:"type:uuid;uniqueIndex:idx_product_review_user" json:"product_id"`
+	Product            *Product       `json:"product,omitempty"`
+	UserID             uuid.UUID      `gorm:"type:uuid;uniqueIndex:idx_product_review_user;index" json:"user_id"`
+	User               *User          `json:"user,omitempty"`
+	Rating             int            `json:"rating"`
+	Text               string         `json:"text"`
+	Photos             pq.StringArray `gorm:"type:text[]" json:"photos"`
+	IsVerifiedPurchase bool           `json:"is_verified_purchase"`
+	Status             string         `gorm:"default:pending;index" json:"status"`
+	ModeratedByID      *uuid.UUID     `gorm:"type:uuid" json:"moderated_by_id"`
+	ModeratedAt        *time.Time     `json:"moderated_at"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "github.com/google/uuid"
+
+// Entity kinds that carry a slug.
+const (
+	SlugKindProduct  = "product"
+	SlugKindCategory = "category"
+	SlugKindBrand    = "brand"
+)
+
+// SlugRedirect remembers a slug an entity used before, so old URLs can be
+// sent to the current one.
+type SlugRedirect struct {
+	BaseModel
+	EntityType string    `gorm:"uniqueIndex:idx_slug_redirects_old_slug" json:"entity_type"`
+	OldSlug    string    `gorm:"uniqueIndex:idx_slug_redirects_old_slug" json:"old_slug"`
+	EntityID   uuid.UUID `gorm:"type:uuid;index" json:"entity_id"`
+}
@@ -2,8 +2,28 @@ package models
 
 import (
 	"time"
+
+	"github.com/google/uuid"
+)
+
+// User roles. Customers shop on the storefront; the remaining roles grant
+// access to the back-office endpoints.
+const (
+	RoleCustomer       = "customer"
+	RoleContentManager = "content_manager"
+	RoleOrderManager   = "order_manager"
+	RoleSuperAdmin     = "super_admin"
 )
 
+// IsValidRole reports whether role is one of the known user roles.
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleCustomer, RoleContentManager, RoleOrderManager, RoleSuperAdmin:
+		return true
+	}
+	return false
+}
+
 // User represents an authenticated customer.
 type User struct {
 	BaseModel
@@ -13,6 +33,8 @@ type User struct {
 	DisplayName      string             `json:"display_name"`
 	PasswordHash     string             `json:"-"`
 	IsVerified       bool               `json:"is_verified"`
+	Role             string             `gorm:"default:customer;index" json:"role"`
+	BillzCustomerID  string             `gorm:"index" json:"-"`
 	Addresses        []UserAddress      `json:"addresses,omitempty"`
 	BonusTransactions []BonusTransaction `json:"bonus_transactions,omitempty"`
 	Orders           []Order            `json:"orders,omitempty"`
@@ -26,6 +48,8 @@ type SMSVerification struct {
 	ExpiresAt time.Time `json:"expires_at"`
 	Verified  bool      `json:"verified"`
 	UsedAt    *time.Time `json:"used_at"`
+	Attempts  int       `gorm:"default:0" json:"-"`
+	RequestIP string    `json:"-"`
 }
 
 // PasswordResetToken stores tokens for the forgot-password flow.
@@ -38,5 +62,33 @@ type PasswordResetToken struct {
 	ExpiresAt time.Time  `json:"expires_at"`
 	Verified  bool       `json:"verified"`
 	UsedAt    *time.Time `json:"used_at"`
+	Attempts  int        `gorm:"default:0" json:"-"`
+	RequestIP string     `json:"-"`
 }
 
+// OTPThrottle counts OTP sends and failed guesses for a phone or client IP
+// within a window, and holds the lockout once a limit is reached.
+type OTPThrottle struct {
+	BaseModel
+	Kind        string     `gorm:"uniqueIndex:idx_otp_throttle_kind_key" json:"kind"`
+	Key         string     `gorm:"uniqueIndex:idx_otp_throttle_kind_key" json:"key"`
+	Count       int        `json:"count"`
+	WindowStart time.Time  `json:"window_start"`
+	LockedUntil *time.Time `json:"locked_until"`
+}
+
+
+// UserSession is a signed-in device. Access tokens carry the session ID and
+// are rejected once the session is revoked; the refresh token is rotated on
+// every use and only its hash is stored.
+type UserSession struct {
+	BaseModel
+	UserID                   uuid.UUID  `gorm:"type:uuid;index" json:"user_id"`
+	RefreshTokenHash         string     `gorm:"uniqueIndex" json:"-"`
+	PreviousRefreshTokenHash string     `gorm:"index" json:"-"`
+	UserAgent                string     `json:"user_agent"`
+	IP                       string     `json:"ip"`
+	LastUsedAt               time.Time  `json:"last_used_at"`
+	ExpiresAt                time.Time  `json:"expires_at"`
+	RevokedAt                *time.Time `json:"revoked_at"`
+}
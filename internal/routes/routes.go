@@ -7,119 +7,220 @@ import (
 	"github.com/example/shafran/internal/config"
 	"github.com/example/shafran/internal/handlers"
 	"github.com/example/shafran/internal/middleware"
+	"github.com/example/shafran/internal/models"
 	"github.com/example/shafran/internal/services"
 )
 
-// Register wires up all HTTP routes.
-func Register(app *fiber.App, db *gorm.DB, cfg *config.Config) {
-	// Initialize Telegram service
-	telegramService := services.NewTelegramService(cfg.TelegramBotToken, cfg.TelegramAdminChat)
+// Dependencies are the services the handlers share with the background
+// workers, built once at startup.
+type Dependencies struct {
+	SMS         services.SMSSender
+	BackInStock *services.BackInStockNotifier
+	BillzSync   *services.BillzSyncService
+	BillzOutbox *services.BillzOutbox
+}
 
-	authHandler := handlers.NewAuthHandler(db, cfg)
-	passwordResetHandler := handlers.NewPasswordResetHandler(db, cfg)
+// Register wires up all HTTP routes.
+func Register(app *fiber.App, db *gorm.DB, cfg *config.Config, deps Dependencies) {
+	otpGuard := services.NewOTPGuard(db, services.OTPGuardConfig{
+		MaxAttempts:    cfg.OTPMaxAttempts,
+		IPMaxAttempts:  cfg.OTPIPMaxAttempts,
+		IPMaxSends:     cfg.OTPIPMaxSends,
+		Lockout:        cfg.OTPLockout,
+		ResendCooldown: cfg.OTPResendCooldown,
+	})
+	sessionService := services.NewSessionService(db, services.SessionConfig{
+		Secret:     cfg.JWTSecret,
+		AccessTTL:  cfg.AccessTokenTTL,
+		RefreshTTL: cfg.RefreshTokenTTL,
+	})
+	authHandler := handlers.NewAuthHandler(db, cfg, deps.SMS, otpGuard, sessionService)
+	passwordResetHandler := handlers.NewPasswordResetHandler(db, cfg, deps.SMS, otpGuard, sessionService)
 	catalogHandler := handlers.NewCatalogHandler(db)
-	productHandler := handlers.NewProductHandler(db)
-	orderHandler := handlers.NewOrderHandler(db, telegramService)
-	paymeHandler := handlers.NewPaymeHandler(db, cfg.PaymeMerchantID, telegramService)
-	profileHandler := handlers.NewProfileHandler(db)
+	productHandler := handlers.NewProductHandler(db, deps.BackInStock)
+	reviewHandler := handlers.NewReviewHandler(db)
+	cartHandler := handlers.NewCartHandler(db)
+	promoHandler := handlers.NewPromoHandler(db)
+	// Payment gateways, keyed by PaymentProvider.Type
+	paymeService := services.NewPaymeService(db, services.PaymeConfig{
+		MerchantID:  cfg.PaymeMerchantID,
+		MerchantKey: cfg.PaymeMerchantKey,
+	}, deps.BillzOutbox)
+	clickService := services.NewClickService(db, services.ClickConfig{
+		ServiceID:      cfg.ClickServiceID,
+		MerchantID:     cfg.ClickMerchantID,
+		MerchantUserID: cfg.ClickMerchantUser,
+		SecretKey:      cfg.ClickSecretKey,
+		CheckoutURL:    cfg.ClickCheckoutURL,
+	}, deps.BillzOutbox)
+	paymentRegistry := services.NewPaymentRegistry(db, paymeService, clickService)
+
+	orderHandler := handlers.NewOrderHandler(db, cfg, deps.BillzOutbox, paymentRegistry)
+	paymentHandler := handlers.NewPaymentHandler(db, paymentRegistry)
+	paymeHandler := handlers.NewPaymeHandler(db, paymeService)
+	clickHandler := handlers.NewClickHandler(clickService)
+	profileHandler := handlers.NewProfileHandler(db, sessionService)
 	marketingHandler := handlers.NewMarketingHandler(db)
-	billzHandler := handlers.NewBillzHandler()
+	billzHandler := handlers.NewBillzHandler(db, deps.BillzSync, deps.BillzOutbox, services.NewBillzProxy(services.BillzProxyConfig{
+		PublicPaths: cfg.BillzProxyPublicPaths,
+		CacheTTL:    cfg.BillzProxyCacheTTL,
+		RateLimit:   cfg.BillzProxyRateLimit,
+	}))
 	adminHandler := handlers.NewAdminHandler(db)
 	footerHandler := handlers.NewFooterHandler(db)
 
+	requireAuth := middleware.AuthMiddleware(cfg, sessionService)
+	optionalAuth := middleware.OptionalAuthMiddleware(cfg, sessionService)
+	manageContent := middleware.RequireRole(models.RoleContentManager)
+	manageOrders := middleware.RequireRole(models.RoleOrderManager)
+	superAdmin := middleware.RequireRole()
+
 	api := app.Group("/api")
 
 	// Auth routes
 	auth := api.Group("/auth")
 	auth.Post("/register", authHandler.Register)
 	auth.Post("/login", authHandler.Login)
+	auth.Post("/refresh", authHandler.Refresh)
+	auth.Post("/logout", authHandler.Logout)
 	auth.Post("/verify", authHandler.Verify)
+	auth.Post("/resend-code", authHandler.ResendCode)
 	auth.Post("/forgot-password", passwordResetHandler.ForgotPassword)
 	auth.Post("/verify-reset-code", passwordResetHandler.VerifyResetCode)
 	auth.Post("/reset-password", passwordResetHandler.ResetPassword)
 
-	// Catalog routes
+	// Catalog routes (public reads, content manager writes)
 	categories := api.Group("/categories")
 	categories.Get("/", catalogHandler.ListCategories)
-	categories.Post("/", catalogHandler.CreateCategory)
+	categories.Post("/", requireAuth, manageContent, catalogHandler.CreateCategory)
+	categories.Get("/by-slug/:slug", catalogHandler.GetCategoryBySlug)
 	categories.Get("/:id", catalogHandler.GetCategory)
-	categories.Put("/:id", catalogHandler.UpdateCategory)
-	categories.Delete("/:id", catalogHandler.DeleteCategory)
+	categories.Put("/:id", requireAuth, manageContent, catalogHandler.UpdateCategory)
+	categories.Delete("/:id", requireAuth, manageContent, catalogHandler.DeleteCategory)
 
 	brands := api.Group("/brands")
 	brands.Get("/", catalogHandler.ListBrands)
-	brands.Post("/", catalogHandler.CreateBrand)
+	brands.Post("/", requireAuth, manageContent, catalogHandler.CreateBrand)
+	brands.Get("/by-slug/:slug", catalogHandler.GetBrandBySlug)
 	brands.Get("/:id", catalogHandler.GetBrand)
-	brands.Put("/:id", catalogHandler.UpdateBrand)
-	brands.Delete("/:id", catalogHandler.DeleteBrand)
+	brands.Put("/:id", requireAuth, manageContent, catalogHandler.UpdateBrand)
+	brands.Delete("/:id", requireAuth, manageContent, catalogHandler.DeleteBrand)
 
 	fragranceNotes := api.Group("/fragrance-notes")
 	fragranceNotes.Get("/", catalogHandler.ListFragranceNotes)
-	fragranceNotes.Post("/", catalogHandler.CreateFragranceNote)
+	fragranceNotes.Post("/", requireAuth, manageContent, catalogHandler.CreateFragranceNote)
 	fragranceNotes.Get("/:id", catalogHandler.GetFragranceNote)
-	fragranceNotes.Put("/:id", catalogHandler.UpdateFragranceNote)
-	fragranceNotes.Delete("/:id", catalogHandler.DeleteFragranceNote)
+	fragranceNotes.Put("/:id", requireAuth, manageContent, catalogHandler.UpdateFragranceNote)
+	fragranceNotes.Delete("/:id", requireAuth, manageContent, catalogHandler.DeleteFragranceNote)
 
 	seasons := api.Group("/seasons")
 	seasons.Get("/", catalogHandler.ListSeasons)
-	seasons.Post("/", catalogHandler.CreateSeason)
+	seasons.Post("/", requireAuth, manageContent, catalogHandler.CreateSeason)
 	seasons.Get("/:id", catalogHandler.GetSeason)
-	seasons.Put("/:id", catalogHandler.UpdateSeason)
-	seasons.Delete("/:id", catalogHandler.DeleteSeason)
+	seasons.Put("/:id", requireAuth, manageContent, catalogHandler.UpdateSeason)
+	seasons.Delete("/:id", requireAuth, manageContent, catalogHandler.DeleteSeason)
 
 	productTypes := api.Group("/product-types")
 	productTypes.Get("/", catalogHandler.ListProductTypes)
-	productTypes.Post("/", catalogHandler.CreateProductType)
+	productTypes.Post("/", requireAuth, manageContent, catalogHandler.CreateProductType)
 	productTypes.Get("/:id", catalogHandler.GetProductType)
-	productTypes.Put("/:id", catalogHandler.UpdateProductType)
-	productTypes.Delete("/:id", catalogHandler.DeleteProductType)
+	productTypes.Put("/:id", requireAuth, manageContent, catalogHandler.UpdateProductType)
+	productTypes.Delete("/:id", requireAuth, manageContent, catalogHandler.DeleteProductType)
 
 	// Products
 	products := api.Group("/products")
-	productHandler.RegisterProductRoutes(products)
+	productHandler.RegisterProductRoutes(products, requireAuth, manageContent)
+	products.Get("/:id/reviews", reviewHandler.ListProductReviews)
+	products.Post("/:id/reviews", requireAuth, reviewHandler.CreateReview)
+
+	// Reviews (owner edits)
+	reviews := api.Group("/reviews")
+	reviews.Put("/:id", requireAuth, reviewHandler.UpdateReview)
+	reviews.Delete("/:id", requireAuth, reviewHandler.DeleteReview)
+
+	// Cart (guests by X-Cart-Token, customers by account)
+	cart := api.Group("/cart", optionalAuth)
+	cart.Get("/", cartHandler.GetCart)
+	cart.Delete("/", cartHandler.ClearCart)
+	cart.Post("/items", cartHandler.AddItem)
+	cart.Put("/items/:id", cartHandler.UpdateItem)
+	cart.Delete("/items/:id", cartHandler.RemoveItem)
+	cart.Post("/merge", requireAuth, cartHandler.MergeCart)
+
+	// Promo code preview
+	api.Post("/promo/validate", optionalAuth, promoHandler.ValidatePromo)
 
 	// Marketing resources
 	api.Get("/banner", marketingHandler.ListBanners)
-	api.Post("/banner", marketingHandler.CreateBanner)
-	api.Put("/banner/:id", marketingHandler.UpdateBanner)
-	api.Delete("/banner/:id", marketingHandler.DeleteBanner)
-
-	billz := api.Group("/billz")
+	api.Post("/banner", requireAuth, manageContent, marketingHandler.CreateBanner)
+	api.Put("/banner/:id", requireAuth, manageContent, marketingHandler.UpdateBanner)
+	api.Delete("/banner/:id", requireAuth, manageContent, marketingHandler.DeleteBanner)
+
+	// Billz proxy (public allowlisted reads, content manager for other
+	// reads, super admin for writes)
+	billzAccess := billzHandler.ProxyAccess(manageContent, superAdmin)
+	billz := api.Group("/billz", optionalAuth, billzAccess)
 	billz.All("/", billzHandler.Proxy)
 	billz.All("/*", billzHandler.Proxy)
 
 	pickup := api.Group("/pickup-branches")
 	pickup.Get("/", marketingHandler.ListPickupBranches)
-	pickup.Post("/", marketingHandler.CreatePickupBranch)
-	pickup.Put("/:id", marketingHandler.UpdatePickupBranch)
-	pickup.Delete("/:id", marketingHandler.DeletePickupBranch)
+	pickup.Post("/", requireAuth, manageContent, marketingHandler.CreatePickupBranch)
+	pickup.Put("/:id", requireAuth, manageContent, marketingHandler.UpdatePickupBranch)
+	pickup.Delete("/:id", requireAuth, manageContent, marketingHandler.DeletePickupBranch)
 
 	payments := api.Group("/payment-providers")
 	payments.Get("/", marketingHandler.ListPaymentProviders)
-	payments.Post("/", marketingHandler.CreatePaymentProvider)
-	payments.Put("/:id", marketingHandler.UpdatePaymentProvider)
-	payments.Delete("/:id", marketingHandler.DeletePaymentProvider)
+	payments.Post("/", requireAuth, manageContent, marketingHandler.CreatePaymentProvider)
+	payments.Put("/:id", requireAuth, manageContent, marketingHandler.UpdatePaymentProvider)
+	payments.Delete("/:id", requireAuth, manageContent, marketingHandler.DeletePaymentProvider)
+
+	// Provider-agnostic checkout
+	api.Post("/payments/checkout", requireAuth, paymentHandler.Checkout)
 
 	// Payme payment routes
 	payme := api.Group("/payme")
-	payme.Get("/transactions", paymeHandler.ListTransactions)
-	payme.Post("/checkout", paymeHandler.Checkout)
+	payme.Get("/transactions", requireAuth, manageOrders, paymeHandler.ListTransactions)
+	payme.Post("/checkout", requireAuth, paymentHandler.ProviderCheckout(models.PaymentTypePayme))
 	payme.Post("/pay", middleware.PaymeAuthMiddleware(cfg.PaymeMerchantKey), paymeHandler.Pay)
-	payme.Post("/fake-transaction", paymeHandler.CreateFakeTransaction)
+	payme.Post("/fake-transaction", requireAuth, superAdmin, paymeHandler.CreateFakeTransaction)
+
+	// Click payment routes
+	click := api.Group("/click")
+	click.Post("/checkout", requireAuth, paymentHandler.ProviderCheckout(models.PaymentTypeClick))
+	click.Post("/prepare", clickHandler.Prepare)
+	click.Post("/complete", clickHandler.Complete)
 
 	// Footer (public GET, admin PUT)
 	api.Get("/footer", footerHandler.GetFooter)
-	api.Put("/footer", footerHandler.UpdateFooter)
+	api.Put("/footer", requireAuth, manageContent, footerHandler.UpdateFooter)
 
-	// Admin routes
-	admin := api.Group("/admin")
+	// Admin routes (any back-office role, narrowed per route)
+	admin := api.Group("/admin", requireAuth, middleware.RequireRole(models.RoleContentManager, models.RoleOrderManager))
 	admin.Get("/stats", adminHandler.DashboardStats)
-	admin.Get("/orders", adminHandler.ListAllOrders)
-	admin.Get("/users", adminHandler.ListAllUsers)
-	admin.Get("/recent-orders", adminHandler.RecentOrders)
+	admin.Get("/orders", manageOrders, adminHandler.ListAllOrders)
+	admin.Get("/orders/:id", manageOrders, adminHandler.GetOrder)
+	admin.Put("/orders/:id/status", manageOrders, adminHandler.UpdateOrderStatus)
+	admin.Get("/recent-orders", manageOrders, adminHandler.RecentOrders)
+	admin.Post("/payments/:id/mark-refunded", manageOrders, paymentHandler.MarkTransactionRefunded)
+	admin.Get("/carts/abandoned", manageOrders, cartHandler.ListAbandonedCarts)
+	admin.Get("/promo-codes", manageContent, promoHandler.ListPromoCodes)
+	admin.Post("/promo-codes", manageContent, promoHandler.CreatePromoCode)
+	admin.Put("/promo-codes/:id", manageContent, promoHandler.UpdatePromoCode)
+	admin.Delete("/promo-codes/:id", manageContent, promoHandler.DeletePromoCode)
+	admin.Post("/billz/sync", manageContent, billzHandler.RunSync)
+	admin.Get("/billz/sync-runs", manageContent, billzHandler.ListSyncRuns)
+	admin.Get("/billz/sync-runs/:id", manageContent, billzHandler.GetSyncRun)
+	admin.Get("/billz/outbox", manageContent, billzHandler.ListOutbox)
+	admin.Get("/billz/shops", manageContent, billzHandler.ListShops)
+	admin.Post("/billz/outbox/:id/replay", manageContent, billzHandler.ReplayOutbox)
+	admin.Get("/reviews", manageContent, reviewHandler.AdminListReviews)
+	admin.Put("/reviews/:id/status", manageContent, reviewHandler.ModerateReview)
+	admin.Get("/users", superAdmin, adminHandler.ListAllUsers)
+	admin.Put("/users/:id/role", superAdmin, adminHandler.UpdateUserRole)
 
 	// Protected routes
-	protected := api.Group("", middleware.AuthMiddleware(cfg))
+	protected := api.Group("", requireAuth)
 
 	protected.Post("/orders", orderHandler.CreateOrder)
 	protected.Get("/orders", orderHandler.ListOrders)
@@ -132,4 +233,13 @@ func Register(app *fiber.App, db *gorm.DB, cfg *config.Config) {
 	protected.Put("/profile/addresses/:id", profileHandler.UpdateAddress)
 	protected.Delete("/profile/addresses/:id", profileHandler.DeleteAddress)
 	protected.Get("/profile/bonus", profileHandler.ListBonusTransactions)
+	protected.Get("/profile/bonus/balance", profileHandler.GetBonusBalance)
+	protected.Get("/profile/wishlist", profileHandler.ListWishlist)
+	protected.Post("/profile/wishlist", profileHandler.AddWishlistItem)
+	protected.Put("/profile/wishlist/:id", profileHandler.UpdateWishlistItem)
+	protected.Delete("/profile/wishlist/:id", profileHandler.RemoveWishlistItem)
+	protected.Get("/profile/reviews", reviewHandler.ListMyReviews)
+	protected.Get("/profile/sessions", profileHandler.ListSessions)
+	protected.Delete("/profile/sessions", profileHandler.RevokeOtherSessions)
+	protected.Delete("/profile/sessions/:id", profileHandler.RevokeSession)
 }
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// BackInStockNotifier tells customers that a wishlisted item they asked to be
+// notified about is available again. Each request is answered once: the flag
+// is cleared when the customer is notified.
+type BackInStockNotifier struct {
+	db            *gorm.DB
+	sms           SMSSender
+	storefrontURL string
+}
+
+func NewBackInStockNotifier(db *gorm.DB, sms SMSSender, storefrontURL string) *BackInStockNotifier {
+	return &BackInStockNotifier{
+		db:            db,
+		sms:           sms,
+		storefrontURL: strings.TrimRight(storefrontURL, "/"),
+	}
+}
+
+type backInStockRow struct {
+	WishlistItemID uuid.UUID
+	Phone          string
+	ProductName    string
+	ProductSlug    string
+}
+
+// Notify messages the customers waiting for variants that just came back in
+// stock, either for the variant itself or for any variant of its product. It
+// returns the number of customers notified.
+func (n *BackInStockNotifier) Notify(variantIDs []uuid.UUID) int {
+	if n == nil || len(variantIDs) == 0 {
+		return 0
+	}
+
+	var rows []backInStockRow
+	if err := n.db.Table("wishlist_items").
+		Select("wishlist_items.id AS wishlist_item_id, users.phone, products.name AS product_name, products.slug AS product_slug").
+		Joins("JOIN product_variants ON product_variants.id IN ? AND (wishlist_items.product_variant_id = product_variants.id OR (wishlist_items.product_variant_id IS NULL AND wishlist_items.product_id = product_variants.product_id))", variantIDs).
+		Joins("JOIN products ON products.id = wishlist_items.product_id").
+		Joins("JOIN users ON users.id = wishlist_items.user_id").
+		Where("wishlist_items.notify_back_in_stock = ?", true).
+		Scan(&rows).Error; err != nil {
+		log.Printf("[BackInStock] failed to load wishlist subscriptions: %v", err)
+		return 0
+	}
+
+	sent := 0
+	for _, row := range rows {
+		// Clearing the flag claims the item, so a product-level item matched
+		// by several variants is only notified once.
+		res := n.db.Model(&models.WishlistItem{}).
+			Where("id = ? AND notify_back_in_stock = ?", row.WishlistItemID, true).
+			Update("notify_back_in_stock", false)
+		if res.Error != nil {
+			log.Printf("[BackInStock] failed to claim wishlist item %s: %v", row.WishlistItemID, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 || row.Phone == "" {
+			continue
+		}
+
+		link := fmt.Sprintf("%s/products/%s", n.storefrontURL, row.ProductSlug)
+		msg := fmt.Sprintf("Shafran: %s yana sotuvda. Xarid qiling: %s", row.ProductName, link)
+		if err := n.sms.Send(row.Phone, msg); err != nil {
+			log.Printf("[BackInStock] failed to notify wishlist item %s: %v", row.WishlistItemID, err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
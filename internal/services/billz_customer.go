@@ -0,0 +1,191 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// billzCustomerMu serializes customer resolution so concurrent orders of one
+// user do not create the same Billz customer twice.
+var billzCustomerMu sync.Mutex
+
+type billzClient struct {
+	ID           string   `json:"id"`
+	FirstName    string   `json:"first_name"`
+	LastName     string   `json:"last_name"`
+	PhoneNumbers []string `json:"phone_numbers"`
+}
+
+type billzClientsResponse struct {
+	Count   int           `json:"count"`
+	Clients []billzClient `json:"clients"`
+}
+
+type billzCreateClientResponse struct {
+	ID   string `json:"id"`
+	Data struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// NormalizePhone reduces a phone number to its digits with the Uzbek country
+// code, e.g. "+998 (90) 123-45-67" and "901234567" both become
+// "998901234567".
+func NormalizePhone(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	digits := b.String()
+	if len(digits) == 9 {
+		digits = "998" + digits
+	}
+	return digits
+}
+
+// ResolveBillzCustomer returns the Billz customer of a user, matching Billz
+// customers by phone and creating one when none matches. The id is cached on
+// the user. Users without a phone have no Billz customer and get "".
+func ResolveBillzCustomer(db *gorm.DB, userID uuid.UUID) (string, error) {
+	billzCustomerMu.Lock()
+	defer billzCustomerMu.Unlock()
+
+	var user models.User
+	if err := db.First(&user, "id = ?", userID).Error; err != nil {
+		return "", err
+	}
+	if user.BillzCustomerID != "" {
+		return user.BillzCustomerID, nil
+	}
+
+	phone := NormalizePhone(user.Phone)
+	if phone == "" {
+		return "", nil
+	}
+
+	customerID, err := findBillzCustomer(phone)
+	if err != nil {
+		return "", err
+	}
+	if customerID == "" {
+		if customerID, err = createBillzCustomer(user, phone); err != nil {
+			return "", err
+		}
+	}
+
+	if err := db.Model(&models.User{}).
+		Where("id = ?", user.ID).
+		UpdateColumn("billz_customer_id", customerID).Error; err != nil {
+		return "", err
+	}
+	return customerID, nil
+}
+
+// resolvePayloadCustomer sets the customer of a Billz push to the user's Billz
+// customer. Users without a phone have none, so their orders are pushed
+// without a customer even when the payload requires one.
+func resolvePayloadCustomer(db *gorm.DB, payload *BillzOrderPayload, userID uuid.UUID) error {
+	payload.CustomerID = ""
+	if userID != uuid.Nil {
+		customerID, err := ResolveBillzCustomer(db, userID)
+		if err != nil {
+			return err
+		}
+		payload.CustomerID = customerID
+	}
+	if payload.CustomerID == "" {
+		payload.RequireCustomer = false
+	}
+	return nil
+}
+
+// findBillzCustomer searches Billz customers by phone and returns the one
+// whose number matches exactly.
+func findBillzCustomer(phone string) (string, error) {
+	resp, err := DoBillzRequest(BillzRequestOpts{
+		Method: http.MethodGet,
+		Path:   "v1/client",
+		Query: map[string]string{
+			"search": phone,
+			"limit":  "20",
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("search billz customer: %w", err)
+	}
+	if resp.Status < 200 || resp.Status >= 300 {
+		return "", fmt.Errorf("search billz customer: status %d body %.200s", resp.Status, string(resp.Body))
+	}
+
+	var body billzClientsResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return "", fmt.Errorf("parse billz customers: %w", err)
+	}
+	for _, client := range body.Clients {
+		for _, number := range client.PhoneNumbers {
+			if NormalizePhone(number) == phone {
+				return client.ID, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// createBillzCustomer registers the user as a Billz customer.
+func createBillzCustomer(user models.User, phone string) (string, error) {
+	firstName := strings.TrimSpace(user.FirstName)
+	if firstName == "" {
+		firstName = strings.TrimSpace(user.DisplayName)
+	}
+	if firstName == "" {
+		firstName = phone
+	}
+
+	resp, err := DoBillzRequest(BillzRequestOpts{
+		Method: http.MethodPost,
+		Path:   "v1/client",
+		Body: map[string]any{
+			"first_name":    firstName,
+			"last_name":     strings.TrimSpace(user.LastName),
+			"phone_numbers": []string{phone},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("create billz customer: %w", err)
+	}
+	if resp.Status < 200 || resp.Status >= 300 {
+		return "", fmt.Errorf("create billz customer: status %d body %.200s", resp.Status, string(resp.Body))
+	}
+
+	var body billzCreateClientResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return "", fmt.Errorf("parse billz customer: %w", err)
+	}
+	if body.ID != "" {
+		return body.ID, nil
+	}
+	if body.Data.ID != "" {
+		return body.Data.ID, nil
+	}
+
+	// Some responses carry no id; the customer can be found by phone now.
+	customerID, err := findBillzCustomer(phone)
+	if err != nil {
+		return "", err
+	}
+	if customerID == "" {
+		return "", errors.New("billz customer response missing id")
+	}
+	return customerID, nil
+}
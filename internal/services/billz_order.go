@@ -8,6 +8,9 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
 	"github.com/example/shafran/internal/models"
 )
 
@@ -34,189 +37,98 @@ type billzCreateOrderResponse struct {
 	} `json:"data"`
 }
 
-type paymeOrderDetails struct {
-	Items    []paymeOrderItem `json:"items"`
-	Checkout paymeCheckout    `json:"checkout"`
-	Totals   paymeTotals      `json:"totals"`
-	User     paymeUser        `json:"user"`
-}
-
-type paymeOrderItem struct {
-	ProductID      string  `json:"productId"`
-	ProductIDSnake string  `json:"product_id"`
-	Quantity       float64 `json:"quantity"`
-	Qty            float64 `json:"qty"`
-}
-
-func (i paymeOrderItem) normalizedProductID() string {
-	if id := strings.TrimSpace(i.ProductID); id != "" {
-		return id
+// CreateBillzOrderFromPaymeTransaction creates the Billz order of a paid
+// transaction from the order it pays for.
+func CreateBillzOrderFromPaymeTransaction(db *gorm.DB, txn models.PaymeTransaction) (*BillzOrderResult, error) {
+	payload, err := billzPayloadFromTransaction(db, txn)
+	if err != nil || payload == nil {
+		return nil, err
 	}
-	return strings.TrimSpace(i.ProductIDSnake)
-}
-
-func (i paymeOrderItem) normalizedQuantity() float64 {
-	if i.Quantity > 0 {
-		return i.Quantity
+	var userID uuid.UUID
+	if txn.UserID != nil {
+		userID = *txn.UserID
 	}
-	return i.Qty
-}
-
-type paymeCheckout struct {
-	PaymentMethod      string `json:"paymentMethod"`
-	PaymentMethodSnake string `json:"payment_method"`
-	Comment            string `json:"comment"`
-	Notes              string `json:"notes"`
-}
-
-func (c paymeCheckout) normalizedPaymentMethod() string {
-	if method := strings.TrimSpace(c.PaymentMethod); method != "" {
-		return method
+	if err := resolvePayloadCustomer(db, payload, userID); err != nil {
+		return nil, err
 	}
-	return strings.TrimSpace(c.PaymentMethodSnake)
+	return pushBillzOrder(*payload, &BillzOrderProgress{}, nil)
 }
 
-func (c paymeCheckout) normalizedComment() string {
-	if comment := strings.TrimSpace(c.Comment); comment != "" {
-		return comment
+// billzPayloadFromTransaction builds the Billz push of a paid transaction from
+// its linked order and the order lines. It returns nil for transactions that
+// are not linked to an order. The customer is set by resolvePayloadCustomer.
+func billzPayloadFromTransaction(db *gorm.DB, txn models.PaymeTransaction) (*BillzOrderPayload, error) {
+	orderID, ok := linkedOrderID(txn)
+	if !ok {
+		return nil, nil
 	}
-	return strings.TrimSpace(c.Notes)
-}
-
-type paymeTotals struct {
-	Amount      float64 `json:"amount"`
-	Total       float64 `json:"total"`
-	TotalAmount float64 `json:"total_amount"`
-}
 
-func (t paymeTotals) totalAmount() float64 {
-	if t.Amount > 0 {
-		return t.Amount
+	var order models.Order
+	if err := db.Select("id, notes").First(&order, "id = ?", orderID).Error; err != nil {
+		return nil, fmt.Errorf("load order of transaction %s: %w", txn.ID, err)
 	}
-	if t.Total > 0 {
-		return t.Total
+	items, err := billzOrderItems(db, order.ID)
+	if err != nil {
+		return nil, err
 	}
-	return t.TotalAmount
-}
 
-type paymeUser struct {
-	ID     string `json:"id"`
-	UserID string `json:"user_id"`
+	return &BillzOrderPayload{
+		Items:           items,
+		RequireCustomer: true,
+		PaymentMethod:   txn.Provider,
+		TotalAmount:     float64(txn.Amount),
+		Comment:         paymeOrderPaymentComment(order.Notes),
+	}, nil
 }
 
-func (u paymeUser) normalizedID() string {
-	if id := strings.TrimSpace(u.ID); id != "" {
-		return id
+// billzOrderItems maps the lines of an order to Billz products through the
+// SKU of their variants. Variants the catalog sync has not matched yet are
+// looked up in Billz by SKU and remembered.
+func billzOrderItems(db *gorm.DB, orderID uuid.UUID) ([]BillzOrderItem, error) {
+	var lines []models.OrderItem
+	if err := db.Where("order_id = ?", orderID).Order("created_at, id").Find(&lines).Error; err != nil {
+		return nil, err
 	}
-	return strings.TrimSpace(u.UserID)
-}
-
-// CreateBillzOrderFromPaymeTransaction builds a Billz order using the Payme payload saved with the transaction.
-func CreateBillzOrderFromPaymeTransaction(txn models.PaymeTransaction) (*BillzOrderResult, error) {
-	fmt.Printf("[Billz/Payme] CreateBillzOrderFromPaymeTransaction called for txn %s\n", txn.ID)
-	fmt.Printf("[Billz/Payme] OrderDetails raw (first 200 chars): %.200s\n", string(txn.OrderDetails))
-
-	if len(txn.OrderDetails) == 0 {
-		fmt.Println("[Billz/Payme] OrderDetails is empty, returning nil")
-		return nil, nil
+	if len(lines) == 0 {
+		return nil, errors.New("order has no items")
 	}
 
-	// Handle double-encoded JSON: the web app sends JSON.stringify(payload) so we receive a string
-	orderData := txn.OrderDetails
-	if len(orderData) > 0 && orderData[0] == '"' {
-		// It's a JSON string, need to unmarshal first to get the actual JSON
-		var jsonStr string
-		if err := json.Unmarshal(orderData, &jsonStr); err != nil {
-			fmt.Printf("[Billz/Payme] Failed to unwrap string-encoded JSON: %v\n", err)
-			return nil, fmt.Errorf("unwrap order details string: %w", err)
+	items := make([]BillzOrderItem, 0, len(lines))
+	for _, line := range lines {
+		if line.ProductVariantID == nil {
+			return nil, fmt.Errorf("order item %q has no variant", line.ProductName)
+		}
+		var variant models.ProductVariant
+		if err := db.First(&variant, "id = ?", *line.ProductVariantID).Error; err != nil {
+			return nil, fmt.Errorf("load variant of order item %q: %w", line.ProductName, err)
 		}
-		orderData = []byte(jsonStr)
-		fmt.Printf("[Billz/Payme] Unwrapped string-encoded JSON (first 200 chars): %.200s\n", string(orderData))
-	}
-
-	var details paymeOrderDetails
-	if err := json.Unmarshal(orderData, &details); err != nil {
-		fmt.Printf("[Billz/Payme] Failed to parse order details: %v\n", err)
-		return nil, fmt.Errorf("parse order details: %w", err)
-	}
-
-	fmt.Printf("[Billz/Payme] Parsed details: items=%d, user=%s, totalAmount=%.2f\n",
-		len(details.Items), details.User.normalizedID(), details.Totals.totalAmount())
-
-	if len(details.Items) == 0 {
-		fmt.Println("[Billz/Payme] No items found in order details")
-		return nil, errors.New("order details missing items")
-	}
-
-	customerID := details.User.normalizedID()
-	if customerID == "" && txn.UserID != nil {
-		customerID = txn.UserID.String()
-	}
-	if customerID == "" {
-		return nil, errors.New("customer id missing")
-	}
-
-	draft, err := createBillzDraftOrder()
-	if err != nil {
-		return nil, err
-	}
 
-	addedProduct := false
-	for i, item := range details.Items {
-		productID := item.normalizedProductID()
-		fmt.Printf("[Billz/Payme] Item %d: productID=%s, qty=%.2f\n", i, productID, item.normalizedQuantity())
+		productID := variant.BillzProductID
 		if productID == "" {
-			fmt.Printf("[Billz/Payme] Skipping item %d: empty product ID\n", i)
-			continue
-		}
-		qty := item.normalizedQuantity()
-		if qty <= 0 {
-			fmt.Printf("[Billz/Payme] Skipping item %d: invalid quantity\n", i)
-			continue
+			found, err := findBillzProductBySKU(variant.SKU)
+			if err != nil {
+				return nil, fmt.Errorf("order item %q: %w", line.ProductName, err)
+			}
+			productID = found
+			if err := db.Model(&models.ProductVariant{}).
+				Where("id = ?", variant.ID).
+				Update("billz_product_id", productID).Error; err != nil {
+				return nil, err
+			}
 		}
-		if err := addBillzOrderProduct(draft.ID, item); err != nil {
-			fmt.Printf("[Billz/Payme] Failed to add product %s: %v\n", productID, err)
-			return nil, err
-		}
-		fmt.Printf("[Billz/Payme] Product %s added successfully\n", productID)
-		addedProduct = true
-	}
-	if !addedProduct {
-		fmt.Println("[Billz/Payme] No valid products were added")
-		return nil, errors.New("no valid products in order details")
-	}
 
-	if err := attachBillzOrderCustomer(draft.ID, customerID); err != nil {
-		return nil, err
-	}
-
-	paymentAmount := details.Totals.totalAmount()
-	if paymentAmount <= 0 {
-		paymentAmount = float64(txn.Amount)
-	}
-	if paymentAmount <= 0 {
-		return nil, errors.New("payment amount missing")
+		items = append(items, BillzOrderItem{
+			ProductID: productID,
+			Quantity:  float64(line.Quantity),
+		})
 	}
-
-	comment := paymeOrderPaymentComment(details.Checkout.normalizedComment())
-	fmt.Printf("[Billz/Payme] Registering payment: amount=%.2f, method=%s\n", paymentAmount, details.Checkout.normalizedPaymentMethod())
-	if err := registerBillzOrderPayment(draft.ID, paymentAmount, details.Checkout.normalizedPaymentMethod(), comment); err != nil {
-		fmt.Printf("[Billz/Payme] Failed to register payment: %v\n", err)
-		return nil, err
-	}
-
-	fmt.Printf("[Billz/Payme] Order completed: ID=%s, Number=%s, Type=%s\n", draft.ID, draft.Data.OrderNumber, draft.Data.OrderType)
-	return &BillzOrderResult{
-		OrderID:     draft.ID,
-		OrderNumber: draft.Data.OrderNumber,
-		OrderType:   draft.Data.OrderType,
-	}, nil
+	return items, nil
 }
 
-func createBillzDraftOrder() (*billzCreateOrderResponse, error) {
+func createBillzDraftOrder(shopID, cashboxID string) (*billzCreateOrderResponse, error) {
 	payload := map[string]any{
-		"shop_id":    billzShopID,
-		"cashbox_id": billzCashboxID,
+		"shop_id":    shopID,
+		"cashbox_id": cashboxID,
 	}
 
 	opts := BillzRequestOpts{
@@ -246,33 +158,6 @@ func createBillzDraftOrder() (*billzCreateOrderResponse, error) {
 	return &result, nil
 }
 
-func addBillzOrderProduct(orderID string, item paymeOrderItem) error {
-	payload := map[string]any{
-		"sold_measurement_value": item.normalizedQuantity(),
-		"product_id":             item.normalizedProductID(),
-		"used_wholesale_price":   false,
-		"is_manual":              false,
-		"response_type":          "HTTP",
-	}
-
-	opts := BillzRequestOpts{
-		Method:  http.MethodPost,
-		Path:    fmt.Sprintf("v2/order-product/%s", orderID),
-		Body:    payload,
-		Query:   map[string]string{"Billz-Response-Channel": billzResponseChannel},
-		Headers: map[string]string{"Billz-Response-Channel": billzResponseChannel},
-	}
-
-	resp, err := DoBillzRequest(opts)
-	if err != nil {
-		return fmt.Errorf("add product %s: %w", item.normalizedProductID(), err)
-	}
-	if resp.Status < 200 || resp.Status >= 300 {
-		return fmt.Errorf("add product %s: status %d body %s", item.normalizedProductID(), resp.Status, string(resp.Body))
-	}
-	return nil
-}
-
 func attachBillzOrderCustomer(orderID, customerID string) error {
 	payload := map[string]any{
 		"customer_id":     customerID,
@@ -297,7 +182,7 @@ func attachBillzOrderCustomer(orderID, customerID string) error {
 	return nil
 }
 
-func registerBillzOrderPayment(orderID string, amount float64, method, comment string) error {
+func registerBillzOrderPayment(orderID string, amount float64, method, paymentTypeID, comment string) error {
 	paidAmount := int64(math.Round(amount))
 	if paidAmount <= 0 {
 		return errors.New("invalid payment amount")
@@ -306,7 +191,7 @@ func registerBillzOrderPayment(orderID string, amount float64, method, comment s
 	payload := map[string]any{
 		"payments": []map[string]any{
 			{
-				"company_payment_type_id": billzPaymentTypeID,
+				"company_payment_type_id": paymentTypeID,
 				"paid_amount":             paidAmount,
 				"company_payment_type": map[string]any{
 					"name": billzPaymentTypeName(method),
@@ -360,91 +245,156 @@ func paymeOrderPaymentComment(existing string) string {
 
 // BillzOrderItem represents a single item for direct Billz order creation
 type BillzOrderItem struct {
-	ProductID string
-	Quantity  float64
+	ProductID string  `json:"product_id"`
+	Quantity  float64 `json:"quantity"`
 }
 
 // BillzOrderPayload contains data for creating a Billz order directly
 type BillzOrderPayload struct {
-	Items         []BillzOrderItem
-	CustomerID    string
-	PaymentMethod string
-	TotalAmount   float64
-	Comment       string
+	Items      []BillzOrderItem `json:"items"`
+	CustomerID string           `json:"customer_id,omitempty"`
+	// RequireCustomer fails the push when the customer cannot be attached
+	// instead of leaving the order anonymous.
+	RequireCustomer bool    `json:"require_customer,omitempty"`
+	PaymentMethod   string  `json:"payment_method"`
+	TotalAmount     float64 `json:"total_amount"`
+	Comment         string  `json:"comment,omitempty"`
+	// Target is the Billz store to book the order in; empty fields use the
+	// configured default store.
+	Target BillzTarget `json:"target"`
+}
+
+// target fills the missing parts of the payload target with the defaults.
+func (p BillzOrderPayload) target() BillzTarget {
+	target := p.Target
+	fallback := defaultBillzTarget(p.PaymentMethod)
+	if target.ShopID == "" {
+		target.ShopID = fallback.ShopID
+		target.CashboxID = fallback.CashboxID
+	}
+	if target.PaymentTypeID == "" {
+		target.PaymentTypeID = fallback.PaymentTypeID
+	}
+	return target
+}
+
+// BillzOrderProgress records the steps of a Billz order push that already
+// succeeded. Pushing again with the same progress resumes the same Billz
+// order.
+type BillzOrderProgress struct {
+	OrderID          string
+	OrderNumber      string
+	OrderType        string
+	ItemsAdded       int
+	CustomerAttached bool
+	Paid             bool
+}
+
+func (p *BillzOrderProgress) result() *BillzOrderResult {
+	return &BillzOrderResult{
+		OrderID:     p.OrderID,
+		OrderNumber: p.OrderNumber,
+		OrderType:   p.OrderType,
+	}
 }
 
 // CreateBillzOrderDirect creates a Billz order from a direct payload (for cash orders)
 func CreateBillzOrderDirect(payload BillzOrderPayload) (*BillzOrderResult, error) {
-	fmt.Printf("[Billz] CreateBillzOrderDirect called with %d items, total: %.2f\n", len(payload.Items), payload.TotalAmount)
+	return pushBillzOrder(payload, &BillzOrderProgress{}, nil)
+}
 
-	if len(payload.Items) == 0 {
-		return nil, errors.New("no items provided")
-	}
+// pushBillzOrder runs the steps of a Billz order that progress does not
+// mark as done, calling save after each one.
+func pushBillzOrder(payload BillzOrderPayload, progress *BillzOrderProgress, save func(*BillzOrderProgress) error) (*BillzOrderResult, error) {
+	fmt.Printf("[Billz] pushBillzOrder called with %d items, total: %.2f, billz order: %q\n", len(payload.Items), payload.TotalAmount, progress.OrderID)
 
-	// 1. Create draft order
-	fmt.Println("[Billz] Step 1: Creating draft order...")
-	draft, err := createBillzDraftOrder()
-	if err != nil {
-		fmt.Printf("[Billz] Failed to create draft order: %v\n", err)
-		return nil, err
+	if save == nil {
+		save = func(*BillzOrderProgress) error { return nil }
 	}
-	fmt.Printf("[Billz] Draft order created: ID=%s, Number=%s\n", draft.ID, draft.Data.OrderNumber)
 
-	// 2. Add products
-	fmt.Println("[Billz] Step 2: Adding products...")
-	addedProduct := false
+	items := make([]BillzOrderItem, 0, len(payload.Items))
 	for i, item := range payload.Items {
-		productID := strings.TrimSpace(item.ProductID)
-		if productID == "" {
+		item.ProductID = strings.TrimSpace(item.ProductID)
+		if item.ProductID == "" {
 			fmt.Printf("[Billz] Skipping item %d: empty product ID\n", i)
 			continue
 		}
-		qty := item.Quantity
-		if qty <= 0 {
-			qty = 1
+		if item.Quantity <= 0 {
+			item.Quantity = 1
 		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return nil, errors.New("no valid products in order")
+	}
+	if payload.TotalAmount <= 0 {
+		return nil, errors.New("invalid payment amount")
+	}
+	if payload.RequireCustomer && payload.CustomerID == "" && !progress.CustomerAttached {
+		return nil, errors.New("customer id missing")
+	}
+	target := payload.target()
 
-		fmt.Printf("[Billz] Adding product %d: ID=%s, qty=%.2f\n", i, productID, qty)
-		if err := addBillzOrderProductDirect(draft.ID, productID, qty); err != nil {
-			fmt.Printf("[Billz] Failed to add product %s: %v\n", productID, err)
+	// 1. Create draft order
+	if progress.OrderID == "" {
+		fmt.Printf("[Billz] Step 1: Creating draft order in shop %s...\n", target.ShopID)
+		draft, err := createBillzDraftOrder(target.ShopID, target.CashboxID)
+		if err != nil {
+			fmt.Printf("[Billz] Failed to create draft order: %v\n", err)
+			return nil, err
+		}
+		fmt.Printf("[Billz] Draft order created: ID=%s, Number=%s\n", draft.ID, draft.Data.OrderNumber)
+		progress.OrderID = draft.ID
+		progress.OrderNumber = draft.Data.OrderNumber
+		progress.OrderType = draft.Data.OrderType
+		if err := save(progress); err != nil {
 			return nil, err
 		}
-		addedProduct = true
-		fmt.Printf("[Billz] Product %s added successfully\n", productID)
 	}
 
-	if !addedProduct {
-		return nil, errors.New("no valid products added to order")
+	// 2. Add products
+	for i := progress.ItemsAdded; i < len(items); i++ {
+		fmt.Printf("[Billz] Step 2: Adding product %d: ID=%s, qty=%.2f\n", i, items[i].ProductID, items[i].Quantity)
+		if err := addBillzOrderProductDirect(progress.OrderID, items[i].ProductID, items[i].Quantity); err != nil {
+			fmt.Printf("[Billz] Failed to add product %s: %v\n", items[i].ProductID, err)
+			return nil, err
+		}
+		progress.ItemsAdded = i + 1
+		if err := save(progress); err != nil {
+			return nil, err
+		}
 	}
 
-	// 3. Attach customer (optional - skip if no valid Billz customer ID)
-	if payload.CustomerID != "" {
+	// 3. Attach customer (optional unless required by the payload)
+	if !progress.CustomerAttached && payload.CustomerID != "" {
 		fmt.Printf("[Billz] Step 3: Attaching customer %s...\n", payload.CustomerID)
-		if err := attachBillzOrderCustomer(draft.ID, payload.CustomerID); err != nil {
-			fmt.Printf("[Billz] Warning: failed to attach customer %s to order %s: %v\n", payload.CustomerID, draft.ID, err)
+		if err := attachBillzOrderCustomer(progress.OrderID, payload.CustomerID); err != nil {
+			if payload.RequireCustomer {
+				return nil, err
+			}
+			fmt.Printf("[Billz] Warning: failed to attach customer %s to order %s: %v\n", payload.CustomerID, progress.OrderID, err)
+		}
+		progress.CustomerAttached = true
+		if err := save(progress); err != nil {
+			return nil, err
 		}
-	} else {
-		fmt.Println("[Billz] Step 3: Skipping customer attachment (no customer ID)")
 	}
 
 	// 4. Register payment
-	fmt.Printf("[Billz] Step 4: Registering payment %.2f (%s)...\n", payload.TotalAmount, payload.PaymentMethod)
-	if payload.TotalAmount <= 0 {
-		return nil, errors.New("invalid payment amount")
-	}
-
-	if err := registerBillzOrderPayment(draft.ID, payload.TotalAmount, payload.PaymentMethod, payload.Comment); err != nil {
-		fmt.Printf("[Billz] Failed to register payment: %v\n", err)
-		return nil, err
+	if !progress.Paid {
+		fmt.Printf("[Billz] Step 4: Registering payment %.2f (%s)...\n", payload.TotalAmount, payload.PaymentMethod)
+		if err := registerBillzOrderPayment(progress.OrderID, payload.TotalAmount, payload.PaymentMethod, target.PaymentTypeID, payload.Comment); err != nil {
+			fmt.Printf("[Billz] Failed to register payment: %v\n", err)
+			return nil, err
+		}
+		progress.Paid = true
+		if err := save(progress); err != nil {
+			return nil, err
+		}
 	}
-	fmt.Println("[Billz] Payment registered successfully")
 
-	fmt.Printf("[Billz] Order completed: ID=%s, Number=%s, Type=%s\n", draft.ID, draft.Data.OrderNumber, draft.Data.OrderType)
-	return &BillzOrderResult{
-		OrderID:     draft.ID,
-		OrderNumber: draft.Data.OrderNumber,
-		OrderType:   draft.Data.OrderType,
-	}, nil
+	fmt.Printf("[Billz] Order completed: ID=%s, Number=%s, Type=%s\n", progress.OrderID, progress.OrderNumber, progress.OrderType)
+	return progress.result(), nil
 }
 
 func addBillzOrderProductDirect(orderID, productID string, quantity float64) error {
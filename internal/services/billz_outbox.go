@@ -0,0 +1,513 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// ErrBillzOutboxNotReplayable is returned when a replay is requested for an
+// entry that is done or currently being pushed.
+var ErrBillzOutboxNotReplayable = errors.New("billz push is not in a failed state")
+
+// billzOutboxLease is how long a claimed entry stays reserved for the process
+// pushing it. An entry left in processing by a crashed process is picked up
+// again once its lease runs out.
+const billzOutboxLease = 10 * time.Minute
+
+// BillzOutboxConfig controls how failed Billz pushes are retried.
+type BillzOutboxConfig struct {
+	// MaxAttempts is the number of attempts before an entry is dead-lettered.
+	MaxAttempts int
+	// BaseDelay is the wait after the first failure; it doubles per attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts.
+	MaxDelay time.Duration
+}
+
+// billzOutboxConfig is set once at startup by ConfigureBillzOutbox.
+var billzOutboxConfig = BillzOutboxConfig{
+	MaxAttempts: 8,
+	BaseDelay:   time.Minute,
+	MaxDelay:    6 * time.Hour,
+}
+
+// ConfigureBillzOutbox sets the retry parameters. Zero values keep the
+// defaults.
+func ConfigureBillzOutbox(cfg BillzOutboxConfig) {
+	if cfg.MaxAttempts > 0 {
+		billzOutboxConfig.MaxAttempts = cfg.MaxAttempts
+	}
+	if cfg.BaseDelay > 0 {
+		billzOutboxConfig.BaseDelay = cfg.BaseDelay
+	}
+	if cfg.MaxDelay > 0 {
+		billzOutboxConfig.MaxDelay = cfg.MaxDelay
+	}
+}
+
+// billzOutboxBackoff returns the wait before the attempt following the given
+// number of failed ones.
+func billzOutboxBackoff(attempts int) time.Duration {
+	delay := billzOutboxConfig.BaseDelay
+	for i := 1; i < attempts && delay < billzOutboxConfig.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > billzOutboxConfig.MaxDelay {
+		delay = billzOutboxConfig.MaxDelay
+	}
+	return delay
+}
+
+// BillzOutbox pushes orders and paid transactions to Billz from the durable
+// outbox table and notifies the admin chat once a push succeeds.
+type BillzOutbox struct {
+	db       *gorm.DB
+	telegram *TelegramService
+}
+
+func NewBillzOutbox(db *gorm.DB, telegram *TelegramService) *BillzOutbox {
+	return &BillzOutbox{db: db, telegram: telegram}
+}
+
+// EnqueueBillzOrder records that a cash order has to be pushed to Billz. Call
+// it inside the transaction creating the order.
+func EnqueueBillzOrder(tx *gorm.DB, orderID uuid.UUID, payload BillzOrderPayload) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return enqueueBillzOutbox(tx, models.BillzOutboxKindOrder, orderID, raw)
+}
+
+// enqueueBillzOutbox adds an entry for the subject unless one exists.
+func enqueueBillzOutbox(tx *gorm.DB, kind string, subjectID uuid.UUID, payload json.RawMessage) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "subject_id"}},
+		DoNothing: true,
+	}).Create(&models.BillzOutbox{
+		Kind:          kind,
+		SubjectID:     subjectID,
+		Status:        models.BillzOutboxStatusPending,
+		NextAttemptAt: time.Now(),
+		Payload:       payload,
+	}).Error
+}
+
+// DispatchOrder pushes a queued cash order now. It does nothing when the entry
+// is not due or is being pushed elsewhere.
+func (o *BillzOutbox) DispatchOrder(orderID uuid.UUID) (*BillzOrderResult, error) {
+	return o.dispatch("kind = ? AND subject_id = ?", models.BillzOutboxKindOrder, orderID)
+}
+
+// DispatchTransaction queues a paid transaction and pushes it now. A
+// transaction already pushed returns its stored Billz order.
+func (o *BillzOutbox) DispatchTransaction(txnID uuid.UUID) (*BillzOrderResult, error) {
+	if err := enqueueBillzOutbox(o.db, models.BillzOutboxKindTransaction, txnID, nil); err != nil {
+		return nil, err
+	}
+	result, err := o.dispatch("kind = ? AND subject_id = ?", models.BillzOutboxKindTransaction, txnID)
+	if err != nil || result != nil {
+		return result, err
+	}
+
+	var entry models.BillzOutbox
+	if err := o.db.Where("kind = ? AND subject_id = ?", models.BillzOutboxKindTransaction, txnID).
+		First(&entry).Error; err != nil {
+		return nil, err
+	}
+	if entry.Status == models.BillzOutboxStatusDone && entry.BillzOrderID != "" {
+		return &BillzOrderResult{
+			OrderID:     entry.BillzOrderID,
+			OrderNumber: entry.BillzOrderNumber,
+			OrderType:   entry.BillzOrderType,
+		}, nil
+	}
+	return nil, nil
+}
+
+// Replay makes a failed or dead-lettered entry due now with a fresh attempt
+// budget and pushes it.
+func (o *BillzOutbox) Replay(id uuid.UUID) (*models.BillzOutbox, error) {
+	res := o.db.Model(&models.BillzOutbox{}).
+		Where("id = ? AND status IN ?", id, []string{models.BillzOutboxStatusPending, models.BillzOutboxStatusDead}).
+		Updates(map[string]any{
+			"status":          models.BillzOutboxStatusPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		var entry models.BillzOutbox
+		if err := o.db.First(&entry, "id = ?", id).Error; err != nil {
+			return nil, err
+		}
+		return nil, ErrBillzOutboxNotReplayable
+	}
+
+	// A failed push is recorded on the entry, which is returned either way.
+	if _, err := o.dispatch("id = ?", id); err != nil {
+		log.Printf("[Billz] replay of outbox entry %s failed: %v", id, err)
+	}
+
+	var entry models.BillzOutbox
+	if err := o.db.First(&entry, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ProcessDue pushes every entry that is due and returns how many were
+// attempted.
+func (o *BillzOutbox) ProcessDue() int {
+	processed := 0
+	for {
+		entry, err := o.claim()
+		if err != nil {
+			log.Printf("[Billz] outbox claim failed: %v", err)
+			return processed
+		}
+		if entry == nil {
+			return processed
+		}
+		processed++
+		if _, err := o.process(entry); err != nil {
+			log.Printf("[Billz] outbox %s %s attempt %d failed: %v", entry.Kind, entry.SubjectID, entry.Attempts, err)
+		}
+	}
+}
+
+func (o *BillzOutbox) dispatch(query string, args ...any) (*BillzOrderResult, error) {
+	entry, err := o.claim(append([]any{query}, args...)...)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return o.process(entry)
+}
+
+// claim locks the next due entry matching conds, counts the attempt and
+// leases the entry to the caller. It returns nil when nothing is due.
+func (o *BillzOutbox) claim(conds ...any) (*models.BillzOutbox, error) {
+	var entry models.BillzOutbox
+	err := o.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND next_attempt_at <= ?",
+				[]string{models.BillzOutboxStatusPending, models.BillzOutboxStatusProcessing}, now)
+		if len(conds) > 0 {
+			query = query.Where(conds[0], conds[1:]...)
+		}
+		if err := query.Order("next_attempt_at").First(&entry).Error; err != nil {
+			return err
+		}
+
+		entry.Status = models.BillzOutboxStatusProcessing
+		entry.Attempts++
+		entry.NextAttemptAt = now.Add(billzOutboxLease)
+		return tx.Model(&models.BillzOutbox{}).
+			Where("id = ?", entry.ID).
+			Updates(map[string]any{
+				"status":          entry.Status,
+				"attempts":        entry.Attempts,
+				"next_attempt_at": entry.NextAttemptAt,
+			}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// process pushes a claimed entry and records the outcome.
+func (o *BillzOutbox) process(entry *models.BillzOutbox) (*BillzOrderResult, error) {
+	result, err := o.push(entry)
+	if err != nil {
+		o.fail(entry, err)
+		return nil, err
+	}
+	if err := o.complete(entry, result); err != nil {
+		o.fail(entry, err)
+		return nil, err
+	}
+	if result != nil {
+		o.notify(entry, result)
+	}
+	return result, nil
+}
+
+// push creates the Billz order of an entry, resuming from its stored
+// progress. A nil result means there is nothing to push.
+func (o *BillzOutbox) push(entry *models.BillzOutbox) (*BillzOrderResult, error) {
+	var payload *BillzOrderPayload
+	var userID uuid.UUID
+	var branchID *uuid.UUID
+	var paymentMethod string
+
+	switch entry.Kind {
+	case models.BillzOutboxKindOrder:
+		var order models.Order
+		if err := o.db.Select("id, user_id, status, pickup_branch_id, payment_method, billz_order_id, billz_order_number, billz_order_type").
+			First(&order, "id = ?", entry.SubjectID).Error; err != nil {
+			return nil, err
+		}
+		if order.BillzOrderID != "" {
+			return &BillzOrderResult{OrderID: order.BillzOrderID, OrderNumber: order.BillzOrderNumber, OrderType: order.BillzOrderType}, nil
+		}
+		// An order cancelled before Billz took the payment is not pushed.
+		if order.Status == models.OrderStatusCancelled && entry.PaidAt == nil {
+			return nil, nil
+		}
+		payload = &BillzOrderPayload{}
+		if err := json.Unmarshal(entry.Payload, payload); err != nil {
+			return nil, fmt.Errorf("parse outbox payload: %w", err)
+		}
+		items, err := billzOrderItems(o.db, order.ID)
+		if err != nil {
+			return nil, err
+		}
+		payload.Items = items
+		userID = order.UserID
+		branchID = order.PickupBranchID
+		paymentMethod = order.PaymentMethod
+	case models.BillzOutboxKindTransaction:
+		var txn models.PaymeTransaction
+		if err := o.db.First(&txn, "id = ?", entry.SubjectID).Error; err != nil {
+			return nil, err
+		}
+		if txn.BillzOrderID != "" {
+			return &BillzOrderResult{OrderID: txn.BillzOrderID, OrderNumber: txn.BillzOrderNumber, OrderType: txn.BillzOrderType}, nil
+		}
+		var err error
+		if payload, err = billzPayloadFromTransaction(o.db, txn); err != nil || payload == nil {
+			return nil, err
+		}
+		if txn.UserID != nil {
+			userID = *txn.UserID
+		}
+		paymentMethod = txn.Provider
+		if orderID, ok := linkedOrderID(txn); ok {
+			var order models.Order
+			if err := o.db.Select("id, pickup_branch_id").First(&order, "id = ?", orderID).Error; err == nil {
+				branchID = order.PickupBranchID
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown outbox kind %q", entry.Kind)
+	}
+
+	target, err := ResolveBillzTarget(o.db, branchID, paymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	payload.Target = target
+
+	if !entry.CustomerAttached {
+		if err := resolvePayloadCustomer(o.db, payload, userID); err != nil {
+			if payload.RequireCustomer {
+				return nil, err
+			}
+			log.Printf("[Billz] customer lookup for user %s failed, pushing %s %s without customer: %v", userID, entry.Kind, entry.SubjectID, err)
+		}
+	}
+
+	progress := &BillzOrderProgress{
+		OrderID:          entry.BillzOrderID,
+		OrderNumber:      entry.BillzOrderNumber,
+		OrderType:        entry.BillzOrderType,
+		ItemsAdded:       entry.ItemsAdded,
+		CustomerAttached: entry.CustomerAttached,
+		Paid:             entry.PaidAt != nil,
+	}
+	return pushBillzOrder(*payload, progress, func(p *BillzOrderProgress) error {
+		updates := map[string]any{
+			"billz_order_id":     p.OrderID,
+			"billz_order_number": p.OrderNumber,
+			"billz_order_type":   p.OrderType,
+			"items_added":        p.ItemsAdded,
+			"customer_attached":  p.CustomerAttached,
+		}
+		if p.Paid && entry.PaidAt == nil {
+			now := time.Now()
+			entry.PaidAt = &now
+			updates["paid_at"] = &now
+		}
+		return o.db.Model(&models.BillzOutbox{}).Where("id = ?", entry.ID).Updates(updates).Error
+	})
+}
+
+// complete stores the Billz order on the subject and closes the entry.
+func (o *BillzOutbox) complete(entry *models.BillzOutbox, result *BillzOrderResult) error {
+	now := time.Now()
+	return o.db.Transaction(func(tx *gorm.DB) error {
+		entryUpdates := map[string]any{
+			"status":       models.BillzOutboxStatusDone,
+			"last_error":   "",
+			"completed_at": &now,
+		}
+		if result == nil {
+			return tx.Model(&models.BillzOutbox{}).Where("id = ?", entry.ID).Updates(entryUpdates).Error
+		}
+		entryUpdates["billz_order_id"] = result.OrderID
+		entryUpdates["billz_order_number"] = result.OrderNumber
+		entryUpdates["billz_order_type"] = result.OrderType
+		if err := tx.Model(&models.BillzOutbox{}).Where("id = ?", entry.ID).Updates(entryUpdates).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]any{
+			"billz_order_id":     result.OrderID,
+			"billz_order_number": result.OrderNumber,
+			"billz_order_type":   result.OrderType,
+			"billz_synced_at":    &now,
+			"billz_sync_error":   "",
+		}
+		if entry.Kind == models.BillzOutboxKindOrder {
+			return tx.Model(&models.Order{}).Where("id = ?", entry.SubjectID).Updates(updates).Error
+		}
+
+		var txn models.PaymeTransaction
+		if err := tx.First(&txn, "id = ?", entry.SubjectID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.PaymeTransaction{}).Where("id = ?", txn.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		if orderID, ok := linkedOrderID(txn); ok {
+			return tx.Model(&models.Order{}).Where("id = ?", orderID).Updates(updates).Error
+		}
+		return nil
+	})
+}
+
+// fail schedules the next attempt with exponential backoff, or dead-letters
+// the entry once its attempts are used up. The error is also shown on the
+// order or transaction.
+func (o *BillzOutbox) fail(entry *models.BillzOutbox, pushErr error) {
+	msg := truncateBillzSyncError(pushErr)
+	updates := map[string]any{
+		"status":          models.BillzOutboxStatusPending,
+		"last_error":      msg,
+		"next_attempt_at": time.Now().Add(billzOutboxBackoff(entry.Attempts)),
+	}
+	if entry.Attempts >= billzOutboxConfig.MaxAttempts {
+		updates["status"] = models.BillzOutboxStatusDead
+		log.Printf("[Billz] outbox %s %s dead-lettered after %d attempts: %s", entry.Kind, entry.SubjectID, entry.Attempts, msg)
+	}
+	if err := o.db.Model(&models.BillzOutbox{}).Where("id = ?", entry.ID).Updates(updates).Error; err != nil {
+		log.Printf("[Billz] failed to record outbox failure for %s: %v", entry.ID, err)
+	}
+
+	now := time.Now()
+	subject := map[string]any{"billz_sync_error": msg, "billz_synced_at": &now}
+	var err error
+	if entry.Kind == models.BillzOutboxKindOrder {
+		err = o.db.Model(&models.Order{}).Where("id = ?", entry.SubjectID).Updates(subject).Error
+	} else {
+		err = o.db.Model(&models.PaymeTransaction{}).Where("id = ?", entry.SubjectID).
+			Update("billz_sync_error", msg).Error
+	}
+	if err != nil {
+		log.Printf("[Billz] failed to record sync error for %s %s: %v", entry.Kind, entry.SubjectID, err)
+	}
+}
+
+// notify tells the admin chat about an order that reached Billz.
+func (o *BillzOutbox) notify(entry *models.BillzOutbox, result *BillzOrderResult) {
+	if o.telegram == nil {
+		return
+	}
+
+	var err error
+	switch entry.Kind {
+	case models.BillzOutboxKindOrder:
+		err = o.notifyOrder(entry.SubjectID, result)
+	case models.BillzOutboxKindTransaction:
+		var txn models.PaymeTransaction
+		if err = o.db.First(&txn, "id = ?", entry.SubjectID).Error; err == nil {
+			err = o.telegram.NotifyPaymentSuccess(PaymentSuccessNotification{
+				OrderID:      txn.OrderID,
+				OrderNumber:  txn.OrderID,
+				BillzOrderID: result.OrderID,
+				Amount:       float64(txn.Amount),
+				Currency:     "UZS",
+			})
+		}
+	}
+	if err != nil {
+		log.Printf("[Billz] Telegram notification for %s %s failed: %v", entry.Kind, entry.SubjectID, err)
+	}
+}
+
+func (o *BillzOutbox) notifyOrder(orderID uuid.UUID, result *BillzOrderResult) error {
+	var order models.Order
+	if err := o.db.Preload("Items").Preload("User").First(&order, "id = ?", orderID).Error; err != nil {
+		return err
+	}
+
+	userName := "Не указано"
+	userPhone := "Не указано"
+	if order.User != nil {
+		if order.User.FirstName != "" || order.User.LastName != "" {
+			userName = order.User.FirstName + " " + order.User.LastName
+		}
+		if order.User.Phone != "" {
+			userPhone = order.User.Phone
+		}
+	}
+
+	items := make([]OrderItemNotification, 0, len(order.Items))
+	for _, item := range order.Items {
+		items = append(items, OrderItemNotification{
+			Name:     item.ProductName,
+			Quantity: item.Quantity,
+			Price:    item.UnitPrice,
+			Currency: order.Currency,
+		})
+	}
+
+	// Use Billz order number if available
+	orderNumber := result.OrderNumber
+	if orderNumber == "" {
+		orderNumber = order.OrderNumber
+	}
+
+	return o.telegram.NotifyNewOrder(OrderNotification{
+		OrderID:       order.ID.String(),
+		OrderNumber:   orderNumber,
+		Items:         items,
+		TotalAmount:   order.TotalAmount,
+		Currency:      order.Currency,
+		UserName:      userName,
+		UserPhone:     userPhone,
+		PaymentMethod: order.PaymentMethod,
+		Status:        order.Status,
+	})
+}
+
+// StartBillzOutboxWorker periodically retries due Billz pushes in the
+// background.
+func StartBillzOutboxWorker(o *BillzOutbox, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if n := o.ProcessDue(); n > 0 {
+				log.Printf("[Billz] outbox: attempted %d push(es)", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBillzProxyPublicPaths are the catalog reads the storefront may make
+// through the proxy without signing in.
+var defaultBillzProxyPublicPaths = []string{
+	"v2/products",
+	"v2/product/*",
+	"v2/category",
+	"v2/category/*",
+	"v2/brand",
+	"v2/brand/*",
+}
+
+// billzProxyCacheSize bounds the number of cached responses.
+const billzProxyCacheSize = 500
+
+// BillzProxyConfig controls what the Billz proxy exposes.
+type BillzProxyConfig struct {
+	// PublicPaths are the paths anyone may read. A trailing "/*" matches any
+	// path below the prefix. Empty means the default catalog paths.
+	PublicPaths []string
+	// CacheTTL is how long public reads are cached; zero disables caching.
+	CacheTTL time.Duration
+	// RateLimit is the number of requests a client may make per RateWindow;
+	// zero disables the limit.
+	RateLimit  int
+	RateWindow time.Duration
+}
+
+// BillzProxyResponse is a cached Billz reply.
+type BillzProxyResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+type billzProxyCacheEntry struct {
+	response  BillzProxyResponse
+	expiresAt time.Time
+}
+
+type billzProxyWindow struct {
+	start time.Time
+	count int
+}
+
+// BillzProxy decides which proxied Billz requests are public, caches public
+// reads and rate limits clients. State is kept in memory per process.
+type BillzProxy struct {
+	cfg BillzProxyConfig
+
+	mu        sync.Mutex
+	cache     map[string]billzProxyCacheEntry
+	windows   map[string]*billzProxyWindow
+	lastPrune time.Time
+}
+
+func NewBillzProxy(cfg BillzProxyConfig) *BillzProxy {
+	if len(cfg.PublicPaths) == 0 {
+		cfg.PublicPaths = defaultBillzProxyPublicPaths
+	}
+	if cfg.RateWindow <= 0 {
+		cfg.RateWindow = time.Minute
+	}
+	return &BillzProxy{
+		cfg:     cfg,
+		cache:   make(map[string]billzProxyCacheEntry),
+		windows: make(map[string]*billzProxyWindow),
+	}
+}
+
+// CleanBillzProxyPath normalizes a proxied path and reports false for paths
+// that try to leave the API root.
+func CleanBillzProxyPath(p string) (string, bool) {
+	p = strings.TrimSpace(p)
+	if p == "" || strings.Contains(p, "..") || strings.Contains(p, "\\") {
+		return "", false
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+p), "/")
+	return cleaned, cleaned != ""
+}
+
+// IsPublic reports whether a request may be made without signing in. Only
+// reads of allowlisted paths are public.
+func (p *BillzProxy) IsPublic(method, apiPath string) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	for _, pattern := range p.cfg.PublicPaths {
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(apiPath, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if apiPath == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow counts a request of the client and returns a *RateLimitError once the
+// client has used up its window.
+func (p *BillzProxy) Allow(client string) error {
+	if p.cfg.RateLimit <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.pruneLocked(now)
+
+	window, ok := p.windows[client]
+	if !ok || now.Sub(window.start) >= p.cfg.RateWindow {
+		window = &billzProxyWindow{start: now}
+		p.windows[client] = window
+	}
+	if window.count >= p.cfg.RateLimit {
+		return &RateLimitError{
+			Message:    "too many requests, try again later",
+			RetryAfter: window.start.Add(p.cfg.RateWindow).Sub(now),
+		}
+	}
+	window.count++
+	return nil
+}
+
+// CacheKey identifies a public read by method, path, query and the request
+// headers passed on to Billz, since those can change the reply.
+func (p *BillzProxy) CacheKey(method, apiPath string, query, headers map[string]string) string {
+	var b strings.Builder
+	b.WriteString(method)
+	b.WriteByte(' ')
+	b.WriteString(apiPath)
+	writeCacheKeyValues(&b, '?', query)
+	writeCacheKeyValues(&b, '#', headers)
+	return b.String()
+}
+
+// writeCacheKeyValues appends values sorted by key, led by sep.
+func writeCacheKeyValues(b *strings.Builder, sep byte, values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(sep)
+		} else {
+			b.WriteByte('&')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(values[k])
+	}
+}
+
+// Cached returns a fresh cached response for key.
+func (p *BillzProxy) Cached(key string) (BillzProxyResponse, bool) {
+	if p.cfg.CacheTTL <= 0 {
+		return BillzProxyResponse{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.cache[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return BillzProxyResponse{}, false
+	}
+	return entry.response, true
+}
+
+// Store caches a successful response for key.
+func (p *BillzProxy) Store(key string, resp BillzProxyResponse) {
+	if p.cfg.CacheTTL <= 0 || resp.Status < 200 || resp.Status >= 300 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if len(p.cache) >= billzProxyCacheSize {
+		for k, entry := range p.cache {
+			if now.After(entry.expiresAt) {
+				delete(p.cache, k)
+			}
+		}
+	}
+	if len(p.cache) >= billzProxyCacheSize {
+		// Everything is still fresh; start over rather than grow unbounded.
+		p.cache = make(map[string]billzProxyCacheEntry)
+	}
+	p.cache[key] = billzProxyCacheEntry{response: resp, expiresAt: now.Add(p.cfg.CacheTTL)}
+}
+
+// pruneLocked drops expired cache entries and rate windows, at most once per
+// rate window.
+func (p *BillzProxy) pruneLocked(now time.Time) {
+	if now.Sub(p.lastPrune) < p.cfg.RateWindow {
+		return
+	}
+	p.lastPrune = now
+	for key, entry := range p.cache {
+		if now.After(entry.expiresAt) {
+			delete(p.cache, key)
+		}
+	}
+	for client, window := range p.windows {
+		if now.Sub(window.start) >= p.cfg.RateWindow {
+			delete(p.windows, client)
+		}
+	}
+}
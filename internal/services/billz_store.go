@@ -0,0 +1,155 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// BillzStoreConfig is the Billz store orders are booked in when their pickup
+// branch does not name one.
+type BillzStoreConfig struct {
+	ShopID    string
+	CashboxID string
+	// PaymentTypeID is used for payment methods missing from PaymentTypeIDs.
+	PaymentTypeID string
+	// PaymentTypeIDs maps payment methods (cash, payme, click) to Billz
+	// company payment types.
+	PaymentTypeIDs map[string]string
+}
+
+// billzStoreConfig is set once at startup by ConfigureBillzStore.
+var billzStoreConfig = BillzStoreConfig{
+	ShopID:        billzShopID,
+	CashboxID:     billzCashboxID,
+	PaymentTypeID: billzPaymentTypeID,
+}
+
+// ConfigureBillzStore sets the default Billz store. Empty values keep the
+// built-in defaults.
+func ConfigureBillzStore(cfg BillzStoreConfig) {
+	if cfg.ShopID != "" {
+		billzStoreConfig.ShopID = cfg.ShopID
+		billzStoreConfig.CashboxID = cfg.CashboxID
+	}
+	if cfg.PaymentTypeID != "" {
+		billzStoreConfig.PaymentTypeID = cfg.PaymentTypeID
+	}
+	billzStoreConfig.PaymentTypeIDs = make(map[string]string, len(cfg.PaymentTypeIDs))
+	for method, id := range cfg.PaymentTypeIDs {
+		if id != "" {
+			billzStoreConfig.PaymentTypeIDs[strings.ToLower(method)] = id
+		}
+	}
+}
+
+// BillzTarget is the Billz shop, cashbox and payment type an order is booked
+// with.
+type BillzTarget struct {
+	ShopID        string `json:"shop_id"`
+	CashboxID     string `json:"cashbox_id"`
+	PaymentTypeID string `json:"payment_type_id"`
+}
+
+// defaultBillzTarget returns the configured store for a payment method.
+func defaultBillzTarget(paymentMethod string) BillzTarget {
+	paymentTypeID := billzStoreConfig.PaymentTypeIDs[strings.ToLower(strings.TrimSpace(paymentMethod))]
+	if paymentTypeID == "" {
+		paymentTypeID = billzStoreConfig.PaymentTypeID
+	}
+	return BillzTarget{
+		ShopID:        billzStoreConfig.ShopID,
+		CashboxID:     billzStoreConfig.CashboxID,
+		PaymentTypeID: paymentTypeID,
+	}
+}
+
+// ResolveBillzTarget picks the Billz store for an order: the pickup branch's
+// shop and payment types where set, the configured defaults otherwise.
+func ResolveBillzTarget(db *gorm.DB, branchID *uuid.UUID, paymentMethod string) (BillzTarget, error) {
+	target := defaultBillzTarget(paymentMethod)
+	if branchID == nil || *branchID == uuid.Nil {
+		return target, nil
+	}
+
+	var branch models.PickupBranch
+	err := db.First(&branch, "id = ?", *branchID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return target, nil
+	}
+	if err != nil {
+		return target, err
+	}
+
+	if branch.BillzShopID != "" {
+		target.ShopID = branch.BillzShopID
+		target.CashboxID = branch.BillzCashboxID
+	}
+	if id := branchBillzPaymentTypeID(branch, paymentMethod); id != "" {
+		target.PaymentTypeID = id
+	}
+	return target, nil
+}
+
+func branchBillzPaymentTypeID(branch models.PickupBranch, paymentMethod string) string {
+	switch strings.ToLower(strings.TrimSpace(paymentMethod)) {
+	case models.PaymentTypeCash:
+		return branch.BillzCashPaymentTypeID
+	case models.PaymentTypePayme:
+		return branch.BillzPaymePaymentTypeID
+	case models.PaymentTypeClick:
+		return branch.BillzClickPaymentTypeID
+	}
+	return ""
+}
+
+// BillzShop is a Billz store with its cashboxes.
+type BillzShop struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Cashboxes []BillzCashbox `json:"cashboxes"`
+}
+
+// BillzCashbox is a cash register of a Billz shop.
+type BillzCashbox struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type billzShopsResponse struct {
+	Count int         `json:"count"`
+	Shops []BillzShop `json:"shops"`
+}
+
+// ListBillzShops returns the shops of the Billz company.
+func ListBillzShops() ([]BillzShop, error) {
+	resp, err := DoBillzRequest(BillzRequestOpts{
+		Method: http.MethodGet,
+		Path:   "v1/shop",
+		Query:  map[string]string{"limit": "100"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status < 200 || resp.Status >= 300 {
+		return nil, fmt.Errorf("billz shops request failed: status %d, body: %.200s", resp.Status, string(resp.Body))
+	}
+
+	var body billzShopsResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return nil, fmt.Errorf("parse billz shops: %w", err)
+	}
+	for i := range body.Shops {
+		if body.Shops[i].Cashboxes == nil {
+			body.Shops[i].Cashboxes = []BillzCashbox{}
+		}
+	}
+	return body.Shops, nil
+}
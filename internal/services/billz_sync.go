@@ -0,0 +1,375 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// ErrBillzSyncRunning is returned when a sync is started while another one is
+// still in progress.
+var ErrBillzSyncRunning = errors.New("billz sync is already running")
+
+const billzProductsPageSize = 100
+
+// billzSyncRunning keeps scheduled and manual syncs from overlapping.
+var billzSyncRunning sync.Mutex
+
+// BillzSyncConfig selects the Billz shops the catalog sync reads.
+type BillzSyncConfig struct {
+	// ShopIDs are the shops whose stock is summed into InventoryQuantity.
+	// Prices are read from the first one. Empty means the default shop.
+	ShopIDs []string
+}
+
+// BillzSyncService pulls prices and stock from Billz into local variants,
+// matching them by SKU. Customers waiting for a variant that comes back in
+// stock are notified.
+type BillzSyncService struct {
+	db       *gorm.DB
+	cfg      BillzSyncConfig
+	notifier *BackInStockNotifier
+}
+
+func NewBillzSyncService(db *gorm.DB, cfg BillzSyncConfig, notifier *BackInStockNotifier) *BillzSyncService {
+	if len(cfg.ShopIDs) == 0 {
+		cfg.ShopIDs = []string{billzStoreConfig.ShopID}
+	}
+	return &BillzSyncService{db: db, cfg: cfg, notifier: notifier}
+}
+
+type billzProductsResponse struct {
+	Count    int            `json:"count"`
+	Products []billzProduct `json:"products"`
+}
+
+type billzProduct struct {
+	ID                    string                 `json:"id"`
+	Name                  string                 `json:"name"`
+	SKU                   string                 `json:"sku"`
+	Barcode               string                 `json:"barcode"`
+	ShopPrices            []billzShopPrice       `json:"shop_prices"`
+	ShopMeasurementValues []billzShopMeasurement `json:"shop_measurement_values"`
+}
+
+type billzShopPrice struct {
+	ShopID         string  `json:"shop_id"`
+	RetailPrice    float64 `json:"retail_price"`
+	RetailCurrency string  `json:"retail_currency"`
+}
+
+type billzShopMeasurement struct {
+	ShopID                 string  `json:"shop_id"`
+	ActiveMeasurementValue float64 `json:"active_measurement_value"`
+}
+
+// BillzSyncChange describes a variant the sync changed.
+type BillzSyncChange struct {
+	VariantID   uuid.UUID `json:"variant_id"`
+	ProductID   uuid.UUID `json:"product_id"`
+	SKU         string    `json:"sku"`
+	OldPrice    float64   `json:"old_price"`
+	NewPrice    float64   `json:"new_price"`
+	OldQuantity int       `json:"old_quantity"`
+	NewQuantity int       `json:"new_quantity"`
+	OldInStock  bool      `json:"old_in_stock"`
+	NewInStock  bool      `json:"new_in_stock"`
+}
+
+// BillzSyncUnmatched is an item found on only one side of the sync.
+type BillzSyncUnmatched struct {
+	ID   string `json:"id"`
+	SKU  string `json:"sku"`
+	Name string `json:"name"`
+}
+
+// BillzSyncReport is the diff stored with each sync run.
+type BillzSyncReport struct {
+	Changes        []BillzSyncChange    `json:"changes"`
+	UnmatchedLocal []BillzSyncUnmatched `json:"unmatched_local"`
+	UnmatchedBillz []BillzSyncUnmatched `json:"unmatched_billz"`
+	DuplicateSKUs  []string             `json:"duplicate_skus"`
+}
+
+// Run pulls the Billz catalog and applies it to local variants. The run is
+// recorded even when it fails.
+func (s *BillzSyncService) Run(trigger string) (*models.BillzSyncRun, error) {
+	if !billzSyncRunning.TryLock() {
+		return nil, ErrBillzSyncRunning
+	}
+	defer billzSyncRunning.Unlock()
+
+	run := models.BillzSyncRun{
+		Trigger:   trigger,
+		Status:    models.BillzSyncStatusRunning,
+		StartedAt: time.Now(),
+	}
+	if err := s.db.Create(&run).Error; err != nil {
+		return nil, err
+	}
+
+	report, syncErr := s.sync(&run)
+	if report != nil {
+		var restocked []uuid.UUID
+		for _, change := range report.Changes {
+			if !change.OldInStock && change.NewInStock {
+				restocked = append(restocked, change.VariantID)
+			}
+		}
+		go s.notifier.Notify(restocked)
+	}
+
+	now := time.Now()
+	run.FinishedAt = &now
+	run.Status = models.BillzSyncStatusSucceeded
+	if syncErr != nil {
+		run.Status = models.BillzSyncStatusFailed
+		run.Error = syncErr.Error()
+	}
+	if report != nil {
+		if raw, err := json.Marshal(report); err == nil {
+			run.Report = raw
+		}
+	}
+	if err := s.db.Save(&run).Error; err != nil {
+		return nil, err
+	}
+	return &run, syncErr
+}
+
+func (s *BillzSyncService) sync(run *models.BillzSyncRun) (*BillzSyncReport, error) {
+	products, err := fetchBillzProducts()
+	if err != nil {
+		return nil, err
+	}
+	run.BillzProducts = len(products)
+
+	// A SKU shared by several Billz products is ambiguous: it is reported
+	// and none of those products is applied.
+	report := &BillzSyncReport{}
+	bySKU := make(map[string]billzProduct, len(products))
+	duplicates := make(map[string]bool)
+	for _, p := range products {
+		key := normalizeSKU(p.SKU)
+		if key == "" || duplicates[key] {
+			continue
+		}
+		if _, dup := bySKU[key]; dup {
+			duplicates[key] = true
+			delete(bySKU, key)
+			report.DuplicateSKUs = append(report.DuplicateSKUs, p.SKU)
+			continue
+		}
+		bySKU[key] = p
+	}
+
+	var variants []models.ProductVariant
+	if err := s.db.Where("sku <> ''").Find(&variants).Error; err != nil {
+		return report, err
+	}
+
+	matched := make(map[string]bool, len(variants))
+	for _, variant := range variants {
+		key := normalizeSKU(variant.SKU)
+		product, ok := bySKU[key]
+		if !ok {
+			// An ambiguous SKU no longer identifies the Billz product.
+			if duplicates[key] && variant.BillzProductID != "" {
+				if err := s.db.Model(&models.ProductVariant{}).
+					Where("id = ?", variant.ID).
+					Update("billz_product_id", "").Error; err != nil {
+					return report, err
+				}
+			}
+			report.UnmatchedLocal = append(report.UnmatchedLocal, BillzSyncUnmatched{
+				ID:   variant.ID.String(),
+				SKU:  variant.SKU,
+				Name: variant.Label,
+			})
+			continue
+		}
+		matched[key] = true
+		run.Matched++
+
+		price, quantity := s.priceAndStock(product)
+		if price <= 0 {
+			price = variant.Price
+		}
+		inStock := quantity > 0
+		if product.ID != variant.BillzProductID {
+			if err := s.db.Model(&models.ProductVariant{}).
+				Where("id = ?", variant.ID).
+				Update("billz_product_id", product.ID).Error; err != nil {
+				return report, err
+			}
+		}
+		if price == variant.Price && quantity == variant.InventoryQuantity && inStock == variant.InStock {
+			continue
+		}
+
+		// Reserved stock belongs to open orders and is left untouched.
+		if err := s.db.Model(&models.ProductVariant{}).
+			Where("id = ?", variant.ID).
+			Updates(map[string]any{
+				"price":              price,
+				"inventory_quantity": quantity,
+				"in_stock":           inStock,
+			}).Error; err != nil {
+			return report, err
+		}
+		run.Updated++
+		report.Changes = append(report.Changes, BillzSyncChange{
+			VariantID:   variant.ID,
+			ProductID:   variant.ProductID,
+			SKU:         variant.SKU,
+			OldPrice:    variant.Price,
+			NewPrice:    price,
+			OldQuantity: variant.InventoryQuantity,
+			NewQuantity: quantity,
+			OldInStock:  variant.InStock,
+			NewInStock:  inStock,
+		})
+	}
+
+	for key, product := range bySKU {
+		if !matched[key] {
+			report.UnmatchedBillz = append(report.UnmatchedBillz, BillzSyncUnmatched{
+				ID:   product.ID,
+				SKU:  product.SKU,
+				Name: product.Name,
+			})
+		}
+	}
+	run.UnmatchedLocal = len(report.UnmatchedLocal)
+	run.UnmatchedBillz = len(report.UnmatchedBillz)
+	return report, nil
+}
+
+// priceAndStock reads the retail price of the first configured shop and the
+// stock summed over all configured shops.
+func (s *BillzSyncService) priceAndStock(product billzProduct) (float64, int) {
+	var price float64
+	for _, sp := range product.ShopPrices {
+		if sp.ShopID == s.cfg.ShopIDs[0] {
+			price = sp.RetailPrice
+			break
+		}
+	}
+
+	var stock float64
+	for _, m := range product.ShopMeasurementValues {
+		for _, shopID := range s.cfg.ShopIDs {
+			if m.ShopID == shopID && m.ActiveMeasurementValue > 0 {
+				stock += m.ActiveMeasurementValue
+			}
+		}
+	}
+	return price, int(math.Floor(stock))
+}
+
+// fetchBillzProducts pages through the Billz product list.
+func fetchBillzProducts() ([]billzProduct, error) {
+	var all []billzProduct
+	for page := 1; ; page++ {
+		resp, err := DoBillzRequest(BillzRequestOpts{
+			Method: http.MethodGet,
+			Path:   "v2/products",
+			Query: map[string]string{
+				"limit": strconv.Itoa(billzProductsPageSize),
+				"page":  strconv.Itoa(page),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status < 200 || resp.Status >= 300 {
+			return nil, fmt.Errorf("billz products request failed: status %d, body: %.200s", resp.Status, string(resp.Body))
+		}
+
+		var body billzProductsResponse
+		if err := json.Unmarshal(resp.Body, &body); err != nil {
+			return nil, fmt.Errorf("parse billz products: %w", err)
+		}
+		all = append(all, body.Products...)
+		if len(body.Products) < billzProductsPageSize || (body.Count > 0 && len(all) >= body.Count) {
+			return all, nil
+		}
+	}
+}
+
+// findBillzProductBySKU returns the id of the Billz product whose SKU matches
+// exactly. A SKU shared by several Billz products is an error.
+func findBillzProductBySKU(sku string) (string, error) {
+	key := normalizeSKU(sku)
+	if key == "" {
+		return "", errors.New("variant has no sku")
+	}
+
+	resp, err := DoBillzRequest(BillzRequestOpts{
+		Method: http.MethodGet,
+		Path:   "v2/products",
+		Query: map[string]string{
+			"search": strings.TrimSpace(sku),
+			"limit":  "20",
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("search billz product: %w", err)
+	}
+	if resp.Status < 200 || resp.Status >= 300 {
+		return "", fmt.Errorf("search billz product: status %d body %.200s", resp.Status, string(resp.Body))
+	}
+
+	var body billzProductsResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return "", fmt.Errorf("parse billz products: %w", err)
+	}
+	var productID string
+	for _, p := range body.Products {
+		if normalizeSKU(p.SKU) != key {
+			continue
+		}
+		if productID != "" && productID != p.ID {
+			return "", fmt.Errorf("sku %q matches several billz products", sku)
+		}
+		productID = p.ID
+	}
+	if productID == "" {
+		return "", fmt.Errorf("no billz product with sku %q", sku)
+	}
+	return productID, nil
+}
+
+func normalizeSKU(sku string) string {
+	return strings.ToLower(strings.TrimSpace(sku))
+}
+
+// StartBillzSyncWorker periodically syncs the Billz catalog in the background.
+func StartBillzSyncWorker(s *BillzSyncService, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			run, err := s.Run("schedule")
+			if err != nil {
+				log.Printf("[Billz] catalog sync failed: %v", err)
+				continue
+			}
+			log.Printf("[Billz] catalog sync: %d matched, %d updated, %d local and %d Billz items unmatched",
+				run.Matched, run.Updated, run.UnmatchedLocal, run.UnmatchedBillz)
+		}
+	}()
+}
@@ -0,0 +1,344 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+var (
+	ErrCartNotFound        = errors.New("cart not found")
+	ErrCartItemNotFound    = errors.New("cart item not found")
+	ErrCartVariantNotFound = errors.New("product variant not found")
+	ErrCartVariantInactive = errors.New("product variant is no longer available")
+)
+
+// CartLine is a cart item priced against the current catalog.
+type CartLine struct {
+	ID               uuid.UUID `json:"id"`
+	ProductID        uuid.UUID `json:"product_id"`
+	ProductVariantID uuid.UUID `json:"product_variant_id"`
+	ProductName      string    `json:"product_name"`
+	ProductSlug      string    `json:"product_slug"`
+	HeroImage        string    `json:"hero_image"`
+	VariantLabel     string    `json:"variant_label"`
+	Quantity         int       `json:"quantity"`
+	UnitPrice        float64   `json:"unit_price"`
+	PreviousPrice    float64   `json:"previous_price,omitempty"`
+	PriceChanged     bool      `json:"price_changed"`
+	LineTotal        float64   `json:"line_total"`
+	Available        int       `json:"available"`
+	IsAvailable      bool      `json:"is_available"`
+}
+
+// CartSummary is the priced view of a cart returned to clients.
+type CartSummary struct {
+	ID        uuid.UUID  `json:"id"`
+	Token     string     `json:"token"`
+	Status    string     `json:"status"`
+	Currency  string     `json:"currency"`
+	Items     []CartLine `json:"items"`
+	ItemCount int        `json:"item_count"`
+	Subtotal  float64    `json:"subtotal"`
+	HasIssues bool       `json:"has_issues"`
+}
+
+// FindActiveCart returns the active cart of the user, or of the guest token
+// when there is no user. Guest tokens never resolve to a user's cart.
+func FindActiveCart(db *gorm.DB, userID *uuid.UUID, token string) (*models.Cart, error) {
+	query := db.Where("status = ?", models.CartStatusActive)
+	switch {
+	case userID != nil:
+		query = query.Where("user_id = ?", *userID).Order("last_activity_at desc")
+	case token != "":
+		query = query.Where("token = ? AND user_id IS NULL", token)
+	default:
+		return nil, ErrCartNotFound
+	}
+
+	var cart models.Cart
+	if err := query.First(&cart).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrCartNotFound
+		}
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// OpenCart returns the active cart, creating an empty one when there is none.
+func OpenCart(db *gorm.DB, userID *uuid.UUID, token string) (*models.Cart, error) {
+	cart, err := FindActiveCart(db, userID, token)
+	if err == nil {
+		return cart, nil
+	}
+	if !errors.Is(err, ErrCartNotFound) {
+		return nil, err
+	}
+
+	newToken, err := newCartToken()
+	if err != nil {
+		return nil, err
+	}
+	cart = &models.Cart{
+		UserID:         userID,
+		Token:          newToken,
+		Status:         models.CartStatusActive,
+		LastActivityAt: time.Now(),
+	}
+	if err := db.Create(cart).Error; err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+// AddCartItem adds quantity of a variant to the cart, merging with an
+// existing line for the same variant.
+func AddCartItem(db *gorm.DB, cart *models.Cart, variantID uuid.UUID, quantity int) error {
+	var variant models.ProductVariant
+	if err := db.First(&variant, "id = ?", variantID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCartVariantNotFound
+		}
+		return err
+	}
+	if !variant.IsActive {
+		return ErrCartVariantInactive
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var item models.CartItem
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("cart_id = ? AND product_variant_id = ?", cart.ID, variantID).
+			First(&item).Error
+		switch {
+		case err == nil:
+			if err := tx.Model(&item).Updates(map[string]any{
+				"quantity":   item.Quantity + quantity,
+				"unit_price": variant.Price,
+			}).Error; err != nil {
+				return err
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := tx.Create(&models.CartItem{
+				CartID:           cart.ID,
+				ProductID:        variant.ProductID,
+				ProductVariantID: variant.ID,
+				Quantity:         quantity,
+				UnitPrice:        variant.Price,
+			}).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		updates := map[string]any{"last_activity_at": time.Now()}
+		if cart.Currency == "" {
+			updates["currency"] = variant.Currency
+		}
+		return tx.Model(cart).Updates(updates).Error
+	})
+}
+
+// SetCartItemQuantity changes the quantity of a line; zero removes it.
+func SetCartItemQuantity(db *gorm.DB, cart *models.Cart, itemID uuid.UUID, quantity int) error {
+	if quantity <= 0 {
+		return RemoveCartItem(db, cart, itemID)
+	}
+
+	res := db.Model(&models.CartItem{}).
+		Where("id = ? AND cart_id = ?", itemID, cart.ID).
+		Update("quantity", quantity)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCartItemNotFound
+	}
+	return touchCart(db, cart)
+}
+
+// RemoveCartItem deletes a line from the cart.
+func RemoveCartItem(db *gorm.DB, cart *models.Cart, itemID uuid.UUID) error {
+	res := db.Where("id = ? AND cart_id = ?", itemID, cart.ID).Delete(&models.CartItem{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrCartItemNotFound
+	}
+	return touchCart(db, cart)
+}
+
+// ClearCart removes every line from the cart.
+func ClearCart(db *gorm.DB, cart *models.Cart) error {
+	if err := db.Where("cart_id = ?", cart.ID).Delete(&models.CartItem{}).Error; err != nil {
+		return err
+	}
+	return touchCart(db, cart)
+}
+
+// MergeGuestCart folds the guest cart behind token into the user's active
+// cart. Without a user cart the guest cart is simply claimed. It returns the
+// user's cart, or ErrCartNotFound when neither exists.
+func MergeGuestCart(db *gorm.DB, userID uuid.UUID, token string) (*models.Cart, error) {
+	var result *models.Cart
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var guest models.Cart
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token = ? AND user_id IS NULL AND status = ?", token, models.CartStatusActive).
+			First(&guest).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			cart, err := FindActiveCart(tx, &userID, "")
+			result = cart
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		cart, err := FindActiveCart(tx, &userID, "")
+		if errors.Is(err, ErrCartNotFound) {
+			if err := tx.Model(&guest).Updates(map[string]any{
+				"user_id":          userID,
+				"last_activity_at": time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+			result = &guest
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var guestItems []models.CartItem
+		if err := tx.Where("cart_id = ?", guest.ID).Find(&guestItems).Error; err != nil {
+			return err
+		}
+		for _, item := range guestItems {
+			res := tx.Model(&models.CartItem{}).
+				Where("cart_id = ? AND product_variant_id = ?", cart.ID, item.ProductVariantID).
+				Update("quantity", gorm.Expr("quantity + ?", item.Quantity))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				if err := tx.Delete(&item).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Model(&item).Update("cart_id", cart.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&guest).Update("status", models.CartStatusMerged).Error; err != nil {
+			return err
+		}
+		if cart.Currency == "" && guest.Currency != "" {
+			if err := tx.Model(cart).Update("currency", guest.Currency).Error; err != nil {
+				return err
+			}
+		}
+		result = cart
+		return touchCart(tx, cart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PriceCart prices every line against the current variant price and stock.
+// Lines whose price changed since the customer last saw them are flagged
+// once and then updated to the new price.
+func PriceCart(db *gorm.DB, cart *models.Cart) (*CartSummary, error) {
+	var items []models.CartItem
+	if err := db.Where("cart_id = ?", cart.ID).
+		Preload("Product", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id", "slug", "name", "hero_image")
+		}).
+		Preload("ProductVariant").
+		Order("created_at asc").
+		Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	summary := &CartSummary{
+		ID:       cart.ID,
+		Token:    cart.Token,
+		Status:   cart.Status,
+		Currency: cart.Currency,
+		Items:    make([]CartLine, 0, len(items)),
+	}
+
+	for _, item := range items {
+		line := CartLine{
+			ID:               item.ID,
+			ProductID:        item.ProductID,
+			ProductVariantID: item.ProductVariantID,
+			Quantity:         item.Quantity,
+			UnitPrice:        item.UnitPrice,
+		}
+		if item.Product != nil {
+			line.ProductName = item.Product.Name
+			line.ProductSlug = item.Product.Slug
+			line.HeroImage = item.Product.HeroImage
+		}
+
+		if variant := item.ProductVariant; variant != nil && item.Product != nil {
+			line.VariantLabel = variant.Label
+			line.Available = variant.AvailableQuantity()
+			line.IsAvailable = variant.IsActive && variant.InStock && line.Available >= item.Quantity
+
+			if math.Abs(variant.Price-item.UnitPrice) > 0.005 {
+				line.PreviousPrice = item.UnitPrice
+				line.PriceChanged = true
+				line.UnitPrice = variant.Price
+				if err := db.Model(&item).Update("unit_price", variant.Price).Error; err != nil {
+					return nil, err
+				}
+			}
+			if summary.Currency == "" {
+				summary.Currency = variant.Currency
+			}
+		}
+
+		line.LineTotal = line.UnitPrice * float64(line.Quantity)
+		if line.IsAvailable {
+			summary.Subtotal += line.LineTotal
+		} else {
+			summary.HasIssues = true
+		}
+		if line.PriceChanged {
+			summary.HasIssues = true
+		}
+		summary.ItemCount += line.Quantity
+		summary.Items = append(summary.Items, line)
+	}
+
+	return summary, nil
+}
+
+func touchCart(db *gorm.DB, cart *models.Cart) error {
+	return db.Model(cart).Update("last_activity_at", time.Now()).Error
+}
+
+func newCartToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
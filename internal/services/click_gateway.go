@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// ClickService implements PaymentGateway.
+var _ PaymentGateway = (*ClickService)(nil)
+
+// Provider returns the payment provider type handled by Click.
+func (s *ClickService) Provider() string {
+	return models.PaymentTypeClick
+}
+
+// CreateCheckout creates a Click transaction for the order and returns the
+// Click payment page URL.
+func (s *ClickService) CreateCheckout(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	amount := int64(req.Order.TotalAmount)
+	txn, err := startTransaction(ctx, s.db, models.PaymentTypeClick, req, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CheckoutSession{
+		Provider:      models.PaymentTypeClick,
+		TransactionID: txn.ID,
+		URL:           s.CheckoutURL(*txn, req.ReturnURL),
+		Amount:        amount,
+	}, nil
+}
+
+// MarkRefunded records the refund of a paid Click transaction. The money
+// itself is returned from the Click merchant cabinet.
+func (s *ClickService) MarkRefunded(ctx context.Context, txnID uuid.UUID, reason int) error {
+	return refundProviderTransaction(ctx, s.db, models.PaymentTypeClick, txnID, reason)
+}
+
+// Statement lists Click transactions created in the given range.
+func (s *ClickService) Statement(ctx context.Context, from, to time.Time) ([]models.PaymeTransaction, error) {
+	return providerStatement(ctx, s.db, models.PaymentTypeClick, from, to)
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// Click merchant API actions.
+const (
+	ClickActionPrepare  = 0
+	ClickActionComplete = 1
+)
+
+// Click merchant API error codes.
+const (
+	ClickErrorSuccess             = 0
+	ClickErrorSignCheckFailed     = -1
+	ClickErrorInvalidAmount       = -2
+	ClickErrorActionNotFound      = -3
+	ClickErrorAlreadyPaid         = -4
+	ClickErrorOrderNotFound       = -5
+	ClickErrorTransactionNotFound = -6
+	ClickErrorUpdateFailed        = -7
+	ClickErrorBadRequest          = -8
+	ClickErrorTransactionCanceled = -9
+)
+
+var clickErrorNotes = map[int]string{
+	ClickErrorSuccess:             "Success",
+	ClickErrorSignCheckFailed:     "SIGN CHECK FAILED!",
+	ClickErrorInvalidAmount:       "Incorrect parameter amount",
+	ClickErrorActionNotFound:      "Action not found",
+	ClickErrorAlreadyPaid:         "Already paid",
+	ClickErrorOrderNotFound:       "Order does not exist",
+	ClickErrorTransactionNotFound: "Transaction does not exist",
+	ClickErrorUpdateFailed:        "Failed to update order",
+	ClickErrorBadRequest:          "Error in request from click",
+	ClickErrorTransactionCanceled: "Transaction cancelled",
+}
+
+// ClickConfig holds Click merchant credentials.
+type ClickConfig struct {
+	ServiceID      string
+	MerchantID     string
+	MerchantUserID string
+	SecretKey      string
+	CheckoutURL    string
+}
+
+// ClickRequest is the form payload Click sends to Prepare and Complete.
+// Values are kept as sent so the sign string can be rebuilt exactly.
+type ClickRequest struct {
+	ClickTransID      string `form:"click_trans_id"`
+	ServiceID         string `form:"service_id"`
+	ClickPaydocID     string `form:"click_paydoc_id"`
+	MerchantTransID   string `form:"merchant_trans_id"`
+	MerchantPrepareID string `form:"merchant_prepare_id"`
+	Amount            string `form:"amount"`
+	Action            string `form:"action"`
+	Error             string `form:"error"`
+	ErrorNote         string `form:"error_note"`
+	SignTime          string `form:"sign_time"`
+	SignString        string `form:"sign_string"`
+}
+
+// ClickResponse is returned to Click for both Prepare and Complete.
+type ClickResponse struct {
+	ClickTransID      string `json:"click_trans_id"`
+	MerchantTransID   string `json:"merchant_trans_id"`
+	MerchantPrepareID int64  `json:"merchant_prepare_id,omitempty"`
+	MerchantConfirmID int64  `json:"merchant_confirm_id,omitempty"`
+	Error             int    `json:"error"`
+	ErrorNote         string `json:"error_note"`
+}
+
+// ClickService implements the Click Prepare/Complete merchant API on top of
+// the shared payment transaction table.
+type ClickService struct {
+	db     *gorm.DB
+	cfg    ClickConfig
+	outbox *BillzOutbox
+}
+
+func NewClickService(db *gorm.DB, cfg ClickConfig, outbox *BillzOutbox) *ClickService {
+	return &ClickService{db: db, cfg: cfg, outbox: outbox}
+}
+
+// CheckoutURL builds the Click payment page URL for a transaction.
+func (s *ClickService) CheckoutURL(txn models.PaymeTransaction, returnURL string) string {
+	query := url.Values{}
+	query.Set("service_id", s.cfg.ServiceID)
+	query.Set("merchant_id", s.cfg.MerchantID)
+	if s.cfg.MerchantUserID != "" {
+		query.Set("merchant_user_id", s.cfg.MerchantUserID)
+	}
+	query.Set("amount", strconv.FormatInt(txn.Amount, 10))
+	query.Set("transaction_param", txn.ID.String())
+	if returnURL != "" {
+		query.Set("return_url", returnURL)
+	}
+	return strings.TrimRight(s.cfg.CheckoutURL, "?") + "?" + query.Encode()
+}
+
+// Prepare validates a payment attempt and registers Click's transaction id.
+func (s *ClickService) Prepare(ctx context.Context, req ClickRequest) ClickResponse {
+	resp := ClickResponse{ClickTransID: req.ClickTransID, MerchantTransID: req.MerchantTransID}
+
+	if !s.verifySign(req, false) {
+		return clickError(resp, ClickErrorSignCheckFailed)
+	}
+	if req.Action != strconv.Itoa(ClickActionPrepare) {
+		return clickError(resp, ClickErrorActionNotFound)
+	}
+
+	txn, code := s.findTransaction(ctx, req.MerchantTransID)
+	if code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+	if code := checkClickAmount(req.Amount, txn.Amount); code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+	if code := clickStateError(txn.Status); code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+	if code := s.checkLinkedOrder(ctx, *txn); code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+
+	// Click may repeat Prepare for the same payment; answer with the
+	// prepare id issued the first time.
+	if txn.Status == TransactionStatePending && txn.TransactionID == req.ClickTransID && txn.PrepareID != "" {
+		prepareID, _ := strconv.ParseInt(txn.PrepareID, 10, 64)
+		resp.MerchantPrepareID = prepareID
+		return clickError(resp, ClickErrorSuccess)
+	}
+
+	now := time.Now()
+	prepareID := now.UnixMicro()
+	if err := s.db.WithContext(ctx).
+		Model(&models.PaymeTransaction{}).
+		Where("id = ?", txn.ID).
+		Updates(map[string]any{
+			"transaction_id": req.ClickTransID,
+			"prepare_id":     strconv.FormatInt(prepareID, 10),
+			"status":         TransactionStatePending,
+			"create_time":    now.UnixMilli(),
+		}).Error; err != nil {
+		log.Printf("[Click] prepare update failed for transaction %s: %v", txn.ID, err)
+		return clickError(resp, ClickErrorUpdateFailed)
+	}
+
+	resp.MerchantPrepareID = prepareID
+	return clickError(resp, ClickErrorSuccess)
+}
+
+// Complete finalises or cancels a prepared payment.
+func (s *ClickService) Complete(ctx context.Context, req ClickRequest) ClickResponse {
+	resp := ClickResponse{ClickTransID: req.ClickTransID, MerchantTransID: req.MerchantTransID}
+
+	if !s.verifySign(req, true) {
+		return clickError(resp, ClickErrorSignCheckFailed)
+	}
+	if req.Action != strconv.Itoa(ClickActionComplete) {
+		return clickError(resp, ClickErrorActionNotFound)
+	}
+
+	txn, code := s.findTransaction(ctx, req.MerchantTransID)
+	if code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+	if txn.PrepareID == "" || txn.PrepareID != req.MerchantPrepareID || txn.TransactionID != req.ClickTransID {
+		return clickError(resp, ClickErrorTransactionNotFound)
+	}
+	prepareID, _ := strconv.ParseInt(txn.PrepareID, 10, 64)
+	resp.MerchantPrepareID = prepareID
+
+	if code := clickStateError(txn.Status); code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+	if code := checkClickAmount(req.Amount, txn.Amount); code != ClickErrorSuccess {
+		return clickError(resp, code)
+	}
+
+	// A negative error from Click means the payment failed on their side.
+	// The order stays pending so the customer can retry; its reservation
+	// expires on its own otherwise.
+	if clickErr, _ := strconv.Atoi(req.Error); clickErr < 0 {
+		if err := s.markCancelled(ctx, txn.ID); err != nil {
+			log.Printf("[Click] cancel update failed for transaction %s: %v", txn.ID, err)
+			return clickError(resp, ClickErrorUpdateFailed)
+		}
+		return clickError(resp, ClickErrorTransactionCanceled)
+	}
+
+	err := settleTransaction(ctx, s.db, *txn, time.Now().UnixMilli(), "paid via click")
+	if err != nil {
+		var transitionErr *OrderTransitionError
+		if errors.As(err, &transitionErr) {
+			if err := s.markCancelled(ctx, txn.ID); err != nil {
+				log.Printf("[Click] cancel update failed for transaction %s: %v", txn.ID, err)
+			}
+			return clickError(resp, ClickErrorTransactionCanceled)
+		}
+		log.Printf("[Click] complete failed for transaction %s: %v", txn.ID, err)
+		return clickError(resp, ClickErrorUpdateFailed)
+	}
+
+	go s.afterPayment(*txn)
+
+	resp.MerchantConfirmID = prepareID
+	return clickError(resp, ClickErrorSuccess)
+}
+
+func (s *ClickService) afterPayment(txn models.PaymeTransaction) {
+	if s.outbox == nil {
+		return
+	}
+	res, err := s.outbox.DispatchTransaction(txn.ID)
+	if err != nil {
+		log.Printf("[Click] billz order creation failed for transaction %s: %v", txn.ID, err)
+		return
+	}
+	if res != nil {
+		log.Printf("[Click] billz order %s created for transaction %s", res.OrderID, txn.ID)
+	}
+}
+
+func (s *ClickService) findTransaction(ctx context.Context, merchantTransID string) (*models.PaymeTransaction, int) {
+	id, err := uuid.Parse(strings.TrimSpace(merchantTransID))
+	if err != nil {
+		return nil, ClickErrorOrderNotFound
+	}
+
+	var txn models.PaymeTransaction
+	if err := s.db.WithContext(ctx).
+		Where("id = ? AND provider = ?", id, models.PaymentTypeClick).
+		First(&txn).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[Click] transaction lookup failed for %s: %v", id, err)
+			return nil, ClickErrorUpdateFailed
+		}
+		return nil, ClickErrorOrderNotFound
+	}
+	return &txn, ClickErrorSuccess
+}
+
+func (s *ClickService) checkLinkedOrder(ctx context.Context, txn models.PaymeTransaction) int {
+	orderID, ok := linkedOrderID(txn)
+	if !ok {
+		return ClickErrorSuccess
+	}
+
+	var order models.Order
+	if err := s.db.WithContext(ctx).Select("id, status").First(&order, "id = ?", orderID).Error; err != nil {
+		return ClickErrorOrderNotFound
+	}
+	switch order.Status {
+	case models.OrderStatusPending:
+		return ClickErrorSuccess
+	case models.OrderStatusPaid:
+		return ClickErrorAlreadyPaid
+	default:
+		return ClickErrorTransactionCanceled
+	}
+}
+
+func (s *ClickService) markCancelled(ctx context.Context, txnID uuid.UUID) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var txn models.PaymeTransaction
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&txn, "id = ?", txnID).Error; err != nil {
+			return err
+		}
+		if txn.Status != TransactionStatePending {
+			return nil
+		}
+		return tx.Model(&models.PaymeTransaction{}).
+			Where("id = ?", txnID).
+			Updates(map[string]any{
+				"status":      TransactionStatePendingCanceled,
+				"cancel_time": time.Now().UnixMilli(),
+			}).Error
+	})
+}
+
+// verifySign rebuilds Click's MD5 sign string. Complete requests include the
+// merchant prepare id between the merchant transaction id and the amount.
+func (s *ClickService) verifySign(req ClickRequest, complete bool) bool {
+	if s.cfg.SecretKey == "" || req.ServiceID != s.cfg.ServiceID {
+		return false
+	}
+
+	var b strings.Builder
+	b.WriteString(req.ClickTransID)
+	b.WriteString(req.ServiceID)
+	b.WriteString(s.cfg.SecretKey)
+	b.WriteString(req.MerchantTransID)
+	if complete {
+		b.WriteString(req.MerchantPrepareID)
+	}
+	b.WriteString(req.Amount)
+	b.WriteString(req.Action)
+	b.WriteString(req.SignTime)
+
+	sum := md5.Sum([]byte(b.String()))
+	expected := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(req.SignString))) == 1
+}
+
+func checkClickAmount(raw string, expected int64) int {
+	amount, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return ClickErrorBadRequest
+	}
+	if math.Abs(amount-float64(expected)) > 0.01 {
+		return ClickErrorInvalidAmount
+	}
+	return ClickErrorSuccess
+}
+
+func clickStateError(status int) int {
+	switch {
+	case status == TransactionStatePaid:
+		return ClickErrorAlreadyPaid
+	case status < 0:
+		return ClickErrorTransactionCanceled
+	}
+	return ClickErrorSuccess
+}
+
+func clickError(resp ClickResponse, code int) ClickResponse {
+	resp.Error = code
+	resp.ErrorNote = clickErrorNotes[code]
+	if resp.ErrorNote == "" {
+		resp.ErrorNote = fmt.Sprintf("error %d", code)
+	}
+	return resp
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/example/shafran/internal/models"
+)
+
+const (
+	testClickServiceID = "12345"
+	testClickSecretKey = "secret"
+)
+
+// newTestClickService returns a ClickService on an in-memory database holding
+// a pending order and a started Click transaction for it.
+func newTestClickService(t *testing.T) (*ClickService, *gorm.DB, models.PaymeTransaction) {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("database handle: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(
+		&models.Order{},
+		&models.OrderStatusHistory{},
+		&models.InventoryReservation{},
+		&models.PaymeTransaction{},
+	); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	order := models.Order{
+		OrderNumber:   "ORD-1",
+		Status:        models.OrderStatusPending,
+		PlacedAt:      time.Now(),
+		TotalAmount:   50000,
+		Currency:      "UZS",
+		PaymentMethod: models.PaymentTypeClick,
+	}
+	if err := db.Create(&order).Error; err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	txn := models.PaymeTransaction{
+		OrderID:         order.OrderNumber,
+		InternalOrderID: &order.ID,
+		Provider:        models.PaymentTypeClick,
+		Amount:          50000,
+	}
+	if err := db.Create(&txn).Error; err != nil {
+		t.Fatalf("create transaction: %v", err)
+	}
+
+	svc := &ClickService{
+		db:  db,
+		cfg: ClickConfig{ServiceID: testClickServiceID, SecretKey: testClickSecretKey},
+	}
+	return svc, db, txn
+}
+
+// signClickRequest fills in the sign string the way Click builds it.
+func signClickRequest(req *ClickRequest, secret string) {
+	raw := req.ClickTransID + req.ServiceID + secret + req.MerchantTransID
+	if req.Action == strconv.Itoa(ClickActionComplete) {
+		raw += req.MerchantPrepareID
+	}
+	raw += req.Amount + req.Action + req.SignTime
+	sum := md5.Sum([]byte(raw))
+	req.SignString = hex.EncodeToString(sum[:])
+}
+
+func clickPrepareRequest(txn models.PaymeTransaction, amount string) ClickRequest {
+	req := ClickRequest{
+		ClickTransID:    "987654",
+		ServiceID:       testClickServiceID,
+		MerchantTransID: txn.ID.String(),
+		Amount:          amount,
+		Action:          strconv.Itoa(ClickActionPrepare),
+		SignTime:        "2024-01-01 10:00:00",
+	}
+	signClickRequest(&req, testClickSecretKey)
+	return req
+}
+
+func clickCompleteRequest(txn models.PaymeTransaction, prepareID int64, clickErr string) ClickRequest {
+	req := ClickRequest{
+		ClickTransID:      "987654",
+		ServiceID:         testClickServiceID,
+		MerchantTransID:   txn.ID.String(),
+		MerchantPrepareID: strconv.FormatInt(prepareID, 10),
+		Amount:            "50000",
+		Action:            strconv.Itoa(ClickActionComplete),
+		Error:             clickErr,
+		SignTime:          "2024-01-01 10:01:00",
+	}
+	signClickRequest(&req, testClickSecretKey)
+	return req
+}
+
+func reloadTransaction(t *testing.T, db *gorm.DB, txn models.PaymeTransaction) models.PaymeTransaction {
+	t.Helper()
+	var got models.PaymeTransaction
+	if err := db.First(&got, "id = ?", txn.ID).Error; err != nil {
+		t.Fatalf("reload transaction: %v", err)
+	}
+	return got
+}
+
+func reloadOrderStatus(t *testing.T, db *gorm.DB, txn models.PaymeTransaction) string {
+	t.Helper()
+	var order models.Order
+	if err := db.First(&order, "id = ?", *txn.InternalOrderID).Error; err != nil {
+		t.Fatalf("reload order: %v", err)
+	}
+	return order.Status
+}
+
+func TestClickVerifySign(t *testing.T) {
+	svc := &ClickService{cfg: ClickConfig{ServiceID: testClickServiceID, SecretKey: testClickSecretKey}}
+	txn := models.PaymeTransaction{}
+
+	prepare := clickPrepareRequest(txn, "50000")
+	if !svc.verifySign(prepare, false) {
+		t.Fatal("valid prepare sign was rejected")
+	}
+
+	tampered := prepare
+	tampered.Amount = "1000"
+	if svc.verifySign(tampered, false) {
+		t.Error("sign of a changed amount was accepted")
+	}
+
+	otherService := prepare
+	otherService.ServiceID = "999"
+	signClickRequest(&otherService, testClickSecretKey)
+	if svc.verifySign(otherService, false) {
+		t.Error("request for another service was accepted")
+	}
+
+	wrongSecret := prepare
+	signClickRequest(&wrongSecret, "other-secret")
+	if svc.verifySign(wrongSecret, false) {
+		t.Error("sign made with another secret was accepted")
+	}
+
+	complete := clickCompleteRequest(txn, 42, "0")
+	if !svc.verifySign(complete, true) {
+		t.Fatal("valid complete sign was rejected")
+	}
+	// The complete sign string includes the merchant prepare id.
+	complete.MerchantPrepareID = "43"
+	if svc.verifySign(complete, true) {
+		t.Error("complete sign with another prepare id was accepted")
+	}
+}
+
+func TestClickPrepareComplete(t *testing.T) {
+	svc, db, txn := newTestClickService(t)
+	ctx := context.Background()
+
+	prepared := svc.Prepare(ctx, clickPrepareRequest(txn, "50000"))
+	if prepared.Error != ClickErrorSuccess {
+		t.Fatalf("prepare error = %d (%s), want success", prepared.Error, prepared.ErrorNote)
+	}
+	if prepared.MerchantPrepareID == 0 {
+		t.Fatal("prepare returned no merchant_prepare_id")
+	}
+	if got := reloadTransaction(t, db, txn); got.Status != TransactionStatePending || got.TransactionID != "987654" {
+		t.Fatalf("after prepare: status %d, click id %q", got.Status, got.TransactionID)
+	}
+
+	// Click may repeat Prepare; the first prepare id is returned again.
+	repeated := svc.Prepare(ctx, clickPrepareRequest(txn, "50000"))
+	if repeated.Error != ClickErrorSuccess || repeated.MerchantPrepareID != prepared.MerchantPrepareID {
+		t.Fatalf("repeated prepare = %+v, want prepare id %d", repeated, prepared.MerchantPrepareID)
+	}
+
+	completed := svc.Complete(ctx, clickCompleteRequest(txn, prepared.MerchantPrepareID, "0"))
+	if completed.Error != ClickErrorSuccess {
+		t.Fatalf("complete error = %d (%s), want success", completed.Error, completed.ErrorNote)
+	}
+	if completed.MerchantConfirmID != prepared.MerchantPrepareID {
+		t.Errorf("merchant_confirm_id = %d, want %d", completed.MerchantConfirmID, prepared.MerchantPrepareID)
+	}
+	if got := reloadTransaction(t, db, txn); got.Status != TransactionStatePaid || got.PerformTime == 0 {
+		t.Errorf("after complete: status %d, perform time %d", got.Status, got.PerformTime)
+	}
+	if status := reloadOrderStatus(t, db, txn); status != models.OrderStatusPaid {
+		t.Errorf("order status = %q, want %q", status, models.OrderStatusPaid)
+	}
+
+	again := svc.Complete(ctx, clickCompleteRequest(txn, prepared.MerchantPrepareID, "0"))
+	if again.Error != ClickErrorAlreadyPaid {
+		t.Errorf("repeated complete error = %d, want %d", again.Error, ClickErrorAlreadyPaid)
+	}
+}
+
+func TestClickPrepareAmountMismatch(t *testing.T) {
+	svc, db, txn := newTestClickService(t)
+
+	resp := svc.Prepare(context.Background(), clickPrepareRequest(txn, "40000"))
+	if resp.Error != ClickErrorInvalidAmount {
+		t.Fatalf("prepare error = %d, want %d", resp.Error, ClickErrorInvalidAmount)
+	}
+	if got := reloadTransaction(t, db, txn); got.Status != 0 || got.PrepareID != "" {
+		t.Errorf("transaction changed: status %d, prepare id %q", got.Status, got.PrepareID)
+	}
+}
+
+func TestClickCompleteCancelledByClick(t *testing.T) {
+	svc, db, txn := newTestClickService(t)
+	ctx := context.Background()
+
+	prepared := svc.Prepare(ctx, clickPrepareRequest(txn, "50000"))
+	if prepared.Error != ClickErrorSuccess {
+		t.Fatalf("prepare error = %d (%s), want success", prepared.Error, prepared.ErrorNote)
+	}
+
+	resp := svc.Complete(ctx, clickCompleteRequest(txn, prepared.MerchantPrepareID, "-5017"))
+	if resp.Error != ClickErrorTransactionCanceled {
+		t.Fatalf("complete error = %d, want %d", resp.Error, ClickErrorTransactionCanceled)
+	}
+	got := reloadTransaction(t, db, txn)
+	if got.Status != TransactionStatePendingCanceled || got.CancelTime == 0 {
+		t.Errorf("after failed payment: status %d, cancel time %d", got.Status, got.CancelTime)
+	}
+	// The order stays open so the customer can pay again.
+	if status := reloadOrderStatus(t, db, txn); status != models.OrderStatusPending {
+		t.Errorf("order status = %q, want %q", status, models.OrderStatusPending)
+	}
+}
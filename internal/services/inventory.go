@@ -0,0 +1,267 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// StockError reports that a variant cannot cover the requested quantity.
+type StockError struct {
+	VariantID uuid.UUID
+	Requested int
+	Available int
+}
+
+func (e *StockError) Error() string {
+	return fmt.Sprintf("insufficient stock for variant %s: requested %d, available %d", e.VariantID, e.Requested, e.Available)
+}
+
+// ReservationLine is a variant quantity to hold for an order.
+type ReservationLine struct {
+	VariantID uuid.UUID
+	Quantity  int
+}
+
+// ReserveStock holds stock for every line of an order. Variant rows are locked
+// in a stable order so concurrent checkouts cannot oversell the same variant.
+// It must be called inside a transaction.
+func ReserveStock(tx *gorm.DB, orderID uuid.UUID, lines []ReservationLine, expiresAt *time.Time) error {
+	quantities := make(map[uuid.UUID]int, len(lines))
+	for _, line := range lines {
+		if line.Quantity > 0 {
+			quantities[line.VariantID] += line.Quantity
+		}
+	}
+	if len(quantities) == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, 0, len(quantities))
+	for id := range quantities {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	var variants []models.ProductVariant
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", ids).
+		Order("id").
+		Find(&variants).Error; err != nil {
+		return err
+	}
+	variantsByID := make(map[uuid.UUID]models.ProductVariant, len(variants))
+	for _, v := range variants {
+		variantsByID[v.ID] = v
+	}
+
+	for _, id := range ids {
+		requested := quantities[id]
+		variant, ok := variantsByID[id]
+		if !ok || !variant.IsActive || !variant.InStock {
+			return &StockError{VariantID: id, Requested: requested}
+		}
+		if available := variant.AvailableQuantity(); requested > available {
+			return &StockError{VariantID: id, Requested: requested, Available: available}
+		}
+
+		if err := tx.Model(&models.ProductVariant{}).
+			Where("id = ?", id).
+			Update("reserved_quantity", gorm.Expr("reserved_quantity + ?", requested)).Error; err != nil {
+			return err
+		}
+
+		reservation := models.InventoryReservation{
+			OrderID:          orderID,
+			ProductVariantID: id,
+			Quantity:         requested,
+			Status:           models.ReservationStatusReserved,
+			ExpiresAt:        expiresAt,
+		}
+		if err := tx.Create(&reservation).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CommitReservedStock turns the open reservations of an order into a real
+// stock decrement. Orders without reservations are left untouched.
+func CommitReservedStock(tx *gorm.DB, orderID uuid.UUID) error {
+	reservations, err := lockOpenReservations(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, r := range reservations {
+		if err := tx.Model(&models.ProductVariant{}).
+			Where("id = ?", r.ProductVariantID).
+			Updates(map[string]any{
+				"inventory_quantity": gorm.Expr("GREATEST(inventory_quantity - ?, 0)", r.Quantity),
+				"reserved_quantity":  gorm.Expr("GREATEST(reserved_quantity - ?, 0)", r.Quantity),
+				"in_stock":           gorm.Expr("inventory_quantity - ? > 0", r.Quantity),
+			}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.InventoryReservation{}).
+			Where("id = ?", r.ID).
+			Updates(map[string]any{
+				"status":       models.ReservationStatusCommitted,
+				"committed_at": &now,
+			}).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReleaseReservedStock returns the open reservations of an order to the
+// available pool. Committed stock is restored by RestockCommittedStock.
+func ReleaseReservedStock(tx *gorm.DB, orderID uuid.UUID, reason string) error {
+	reservations, err := lockOpenReservations(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, r := range reservations {
+		if err := tx.Model(&models.ProductVariant{}).
+			Where("id = ?", r.ProductVariantID).
+			Update("reserved_quantity", gorm.Expr("GREATEST(reserved_quantity - ?, 0)", r.Quantity)).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.InventoryReservation{}).
+			Where("id = ?", r.ID).
+			Updates(map[string]any{
+				"status":         models.ReservationStatusReleased,
+				"released_at":    &now,
+				"release_reason": reason,
+			}).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestockCommittedStock puts the stock an order already took out of inventory
+// back and marks its committed reservations released. It is used when a paid
+// or confirmed order is cancelled or refunded.
+func RestockCommittedStock(tx *gorm.DB, orderID uuid.UUID, reason string) error {
+	reservations, err := lockReservations(tx, orderID, models.ReservationStatusCommitted)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, r := range reservations {
+		if err := tx.Model(&models.ProductVariant{}).
+			Where("id = ?", r.ProductVariantID).
+			Updates(map[string]any{
+				"inventory_quantity": gorm.Expr("inventory_quantity + ?", r.Quantity),
+				"in_stock":           gorm.Expr("inventory_quantity + ? > 0", r.Quantity),
+			}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.InventoryReservation{}).
+			Where("id = ?", r.ID).
+			Updates(map[string]any{
+				"status":         models.ReservationStatusReleased,
+				"released_at":    &now,
+				"release_reason": reason,
+			}).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func lockOpenReservations(tx *gorm.DB, orderID uuid.UUID) ([]models.InventoryReservation, error) {
+	return lockReservations(tx, orderID, models.ReservationStatusReserved)
+}
+
+func lockReservations(tx *gorm.DB, orderID uuid.UUID, status string) ([]models.InventoryReservation, error) {
+	var reservations []models.InventoryReservation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status = ?", orderID, status).
+		Order("product_variant_id").
+		Find(&reservations).Error
+	return reservations, err
+}
+
+// ReleaseExpiredReservations releases reservations whose hold has expired and
+// cancels the pending orders they belonged to, together with their unpaid
+// provider transactions. It returns the number of orders that were released.
+func ReleaseExpiredReservations(db *gorm.DB) (int, error) {
+	var orderIDs []uuid.UUID
+	if err := db.Model(&models.InventoryReservation{}).
+		Where("status = ? AND expires_at IS NOT NULL AND expires_at < ?", models.ReservationStatusReserved, time.Now()).
+		Distinct("order_id").
+		Pluck("order_id", &orderIDs).Error; err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, orderID := range orderIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := ReleaseReservedStock(tx, orderID, "expired"); err != nil {
+				return err
+			}
+
+			var status string
+			if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Pluck("status", &status).Error; err != nil {
+				return err
+			}
+			if status != models.OrderStatusPending {
+				return nil
+			}
+			// Reason 4 is the Payme code for a transaction cancelled on timeout.
+			if err := cancelOpenOrderTransactions(tx, orderID, 4); err != nil {
+				return err
+			}
+			_, err := TransitionOrderStatus(tx, orderID, models.OrderStatusCancelled, nil, "stock reservation expired")
+			return err
+		})
+		if err != nil {
+			log.Printf("[Inventory] failed to release expired reservation for order %s: %v", orderID, err)
+			continue
+		}
+		released++
+	}
+
+	return released, nil
+}
+
+// StartReservationExpiryWorker periodically releases expired reservations in
+// the background.
+func StartReservationExpiryWorker(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			released, err := ReleaseExpiredReservations(db)
+			if err != nil {
+				log.Printf("[Inventory] reservation expiry sweep failed: %v", err)
+				continue
+			}
+			if released > 0 {
+				log.Printf("[Inventory] released expired reservations for %d order(s)", released)
+			}
+		}
+	}()
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// ErrInsufficientBonus is returned when a redemption exceeds the bonus balance.
+var ErrInsufficientBonus = errors.New("insufficient bonus balance")
+
+// LoyaltyConfig controls how bonus points are earned and expire.
+type LoyaltyConfig struct {
+	// EarnPercent is the share of the paid order total credited as bonus.
+	EarnPercent float64
+	// TTL is how long credited points stay spendable; zero keeps them forever.
+	TTL time.Duration
+}
+
+// loyaltyConfig is set once at startup by ConfigureLoyalty.
+var loyaltyConfig LoyaltyConfig
+
+// ConfigureLoyalty sets the loyalty program parameters.
+func ConfigureLoyalty(cfg LoyaltyConfig) {
+	loyaltyConfig = cfg
+}
+
+// BonusBalance is the spendable bonus of a user.
+type BonusBalance struct {
+	Balance       float64    `json:"balance"`
+	NextExpiring  float64    `json:"next_expiring"`
+	NextExpiresAt *time.Time `json:"next_expires_at"`
+	EarnPercent   float64    `json:"earn_percent"`
+}
+
+// GetBonusBalance sums the unspent, unexpired credits of a user.
+func GetBonusBalance(db *gorm.DB, userID uuid.UUID) (*BonusBalance, error) {
+	var credits []models.BonusTransaction
+	if err := spendableCredits(db, userID).Find(&credits).Error; err != nil {
+		return nil, err
+	}
+
+	balance := &BonusBalance{EarnPercent: loyaltyConfig.EarnPercent}
+	for _, credit := range credits {
+		balance.Balance += credit.Remaining
+		if credit.ExpiresAt == nil {
+			continue
+		}
+		if balance.NextExpiresAt == nil || credit.ExpiresAt.Before(*balance.NextExpiresAt) {
+			balance.NextExpiresAt = credit.ExpiresAt
+			balance.NextExpiring = credit.Remaining
+		} else if credit.ExpiresAt.Equal(*balance.NextExpiresAt) {
+			balance.NextExpiring += credit.Remaining
+		}
+	}
+	balance.Balance = roundBonus(balance.Balance)
+	balance.NextExpiring = roundBonus(balance.NextExpiring)
+	return balance, nil
+}
+
+// RedeemBonus spends amount of the user's bonus on an order, using the points
+// that expire first. The credits are locked so concurrent orders cannot spend
+// the same points. It must be called inside a transaction.
+func RedeemBonus(tx *gorm.DB, userID, orderID uuid.UUID, amount float64, currency string) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	var credits []models.BonusTransaction
+	if err := spendableCredits(tx, userID).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Find(&credits).Error; err != nil {
+		return err
+	}
+
+	var available float64
+	for _, credit := range credits {
+		available += credit.Remaining
+	}
+	if roundBonus(available) < roundBonus(amount) {
+		return ErrInsufficientBonus
+	}
+
+	left := amount
+	for _, credit := range credits {
+		if left <= 0 {
+			break
+		}
+		spent := math.Min(credit.Remaining, left)
+		if err := tx.Model(&models.BonusTransaction{}).
+			Where("id = ?", credit.ID).
+			Update("remaining", roundBonus(credit.Remaining-spent)).Error; err != nil {
+			return err
+		}
+		left -= spent
+	}
+
+	return createBonusEntry(tx, models.BonusTransaction{
+		UserID:      userID,
+		Type:        models.BonusTypeRedeem,
+		Amount:      roundBonus(amount),
+		Currency:    currency,
+		OrderID:     &orderID,
+		Description: "spent on order",
+	})
+}
+
+// EarnOrderBonus credits the loyalty bonus for a paid or delivered order. An
+// order earns at most once.
+func EarnOrderBonus(tx *gorm.DB, order *models.Order) error {
+	if loyaltyConfig.EarnPercent <= 0 || order.TotalAmount <= 0 {
+		return nil
+	}
+	exists, err := hasBonusEntry(tx, order.ID, models.BonusTypeEarn)
+	if err != nil || exists {
+		return err
+	}
+
+	amount := roundBonus(order.TotalAmount * loyaltyConfig.EarnPercent / 100)
+	if amount <= 0 {
+		return nil
+	}
+	return createBonusEntry(tx, models.BonusTransaction{
+		UserID:      order.UserID,
+		Type:        models.BonusTypeEarn,
+		Amount:      amount,
+		Remaining:   amount,
+		Currency:    order.Currency,
+		OrderID:     &order.ID,
+		Description: fmt.Sprintf("earned on order %s", order.OrderNumber),
+		ExpiresAt:   bonusExpiry(),
+	})
+}
+
+// ReverseOrderBonus undoes the bonus effects of a cancelled or refunded
+// order: spent points are given back and the unspent part of the points the
+// order earned is revoked.
+func ReverseOrderBonus(tx *gorm.DB, order *models.Order) error {
+	var redeemed models.BonusTransaction
+	err := tx.Where("order_id = ? AND type = ?", order.ID, models.BonusTypeRedeem).First(&redeemed).Error
+	switch {
+	case err == nil:
+		refunded, err := hasBonusEntry(tx, order.ID, models.BonusTypeRefund)
+		if err != nil {
+			return err
+		}
+		if !refunded {
+			if err := createBonusEntry(tx, models.BonusTransaction{
+				UserID:      order.UserID,
+				Type:        models.BonusTypeRefund,
+				Amount:      redeemed.Amount,
+				Remaining:   redeemed.Amount,
+				Currency:    redeemed.Currency,
+				OrderID:     &order.ID,
+				Description: fmt.Sprintf("returned from order %s", order.OrderNumber),
+				ExpiresAt:   bonusExpiry(),
+			}); err != nil {
+				return err
+			}
+		}
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+
+	var earned models.BonusTransaction
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND type = ?", order.ID, models.BonusTypeEarn).
+		First(&earned).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if earned.Remaining <= 0 {
+		return nil
+	}
+
+	if err := tx.Model(&earned).Update("remaining", 0).Error; err != nil {
+		return err
+	}
+	return createBonusEntry(tx, models.BonusTransaction{
+		UserID:      order.UserID,
+		Type:        models.BonusTypeRevoke,
+		Amount:      earned.Remaining,
+		Currency:    earned.Currency,
+		OrderID:     &order.ID,
+		Description: fmt.Sprintf("revoked for order %s", order.OrderNumber),
+	})
+}
+
+// ExpireBonuses writes off the unspent part of credits past their expiry. It
+// returns the number of credits that expired.
+func ExpireBonuses(db *gorm.DB) (int, error) {
+	var ids []uuid.UUID
+	if err := db.Model(&models.BonusTransaction{}).
+		Where("type IN ? AND remaining > 0 AND expires_at IS NOT NULL AND expires_at <= ?",
+			bonusCreditTypes, time.Now()).
+		Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var credit models.BonusTransaction
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				First(&credit, "id = ? AND remaining > 0", id).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return nil
+				}
+				return err
+			}
+			if err := tx.Model(&credit).Update("remaining", 0).Error; err != nil {
+				return err
+			}
+			return createBonusEntry(tx, models.BonusTransaction{
+				UserID:      credit.UserID,
+				Type:        models.BonusTypeExpire,
+				Amount:      credit.Remaining,
+				Currency:    credit.Currency,
+				OrderID:     credit.OrderID,
+				Description: "bonus expired",
+			})
+		})
+		if err != nil {
+			log.Printf("[Loyalty] failed to expire bonus %s: %v", id, err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// StartBonusExpiryWorker periodically expires old bonus points in the
+// background.
+func StartBonusExpiryWorker(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			expired, err := ExpireBonuses(db)
+			if err != nil {
+				log.Printf("[Loyalty] bonus expiry sweep failed: %v", err)
+				continue
+			}
+			if expired > 0 {
+				log.Printf("[Loyalty] expired %d bonus credit(s)", expired)
+			}
+		}
+	}()
+}
+
+var bonusCreditTypes = []string{models.BonusTypeEarn, models.BonusTypeRefund}
+
+func spendableCredits(db *gorm.DB, userID uuid.UUID) *gorm.DB {
+	return db.Model(&models.BonusTransaction{}).
+		Where("user_id = ? AND type IN ? AND remaining > 0", userID, bonusCreditTypes).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("expires_at ASC NULLS LAST").
+		Order("created_at ASC")
+}
+
+func hasBonusEntry(tx *gorm.DB, orderID uuid.UUID, entryType string) (bool, error) {
+	var count int64
+	err := tx.Model(&models.BonusTransaction{}).
+		Where("order_id = ? AND type = ?", orderID, entryType).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func createBonusEntry(tx *gorm.DB, entry models.BonusTransaction) error {
+	entry.TransactionNumber = fmt.Sprintf("B%d%04d", time.Now().UnixNano()%1000000000, rand.Intn(10000))
+	entry.Status = models.BonusStatusCompleted
+	entry.OccurredAt = time.Now()
+	return tx.Create(&entry).Error
+}
+
+func bonusExpiry() *time.Time {
+	if loyaltyConfig.TTL <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(loyaltyConfig.TTL)
+	return &expiresAt
+}
+
+func roundBonus(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
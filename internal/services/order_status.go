@@ -0,0 +1,119 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// OrderTransitionError reports a status change the order lifecycle does not allow.
+type OrderTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *OrderTransitionError) Error() string {
+	return fmt.Sprintf("order cannot move from %q to %q", e.From, e.To)
+}
+
+// TransitionOrderStatus moves an order to a new status, records the change in
+// the status history and applies the stock and bonus side effects of the new
+// status. actorID is nil for changes made by the system. It must be called
+// inside a transaction.
+func TransitionOrderStatus(tx *gorm.DB, orderID uuid.UUID, to string, actorID *uuid.UUID, note string) (*models.Order, error) {
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&order, "id = ?", orderID).Error; err != nil {
+		return nil, err
+	}
+
+	if !models.CanTransitionOrderStatus(order.Status, to) {
+		return nil, &OrderTransitionError{From: order.Status, To: to}
+	}
+
+	history := models.OrderStatusHistory{
+		OrderID:     order.ID,
+		FromStatus:  order.Status,
+		ToStatus:    to,
+		ChangedByID: actorID,
+		Note:        note,
+	}
+
+	if err := tx.Model(&order).Update("status", to).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return nil, err
+	}
+
+	switch to {
+	case models.OrderStatusPaid, models.OrderStatusConfirmed:
+		if err := CommitReservedStock(tx, order.ID); err != nil {
+			return nil, err
+		}
+		if to == models.OrderStatusPaid {
+			if err := EarnOrderBonus(tx, &order); err != nil {
+				return nil, err
+			}
+		}
+	case models.OrderStatusCancelled:
+		if err := ReleaseReservedStock(tx, order.ID, "order_cancelled"); err != nil {
+			return nil, err
+		}
+		if err := RestockCommittedStock(tx, order.ID, "order_cancelled"); err != nil {
+			return nil, err
+		}
+		if err := ReleasePromoRedemption(tx, order.ID); err != nil {
+			return nil, err
+		}
+		if err := ReverseOrderBonus(tx, &order); err != nil {
+			return nil, err
+		}
+	case models.OrderStatusRefunded:
+		if err := RestockCommittedStock(tx, order.ID, "order_refunded"); err != nil {
+			return nil, err
+		}
+		if err := ReverseOrderBonus(tx, &order); err != nil {
+			return nil, err
+		}
+	case models.OrderStatusDelivered:
+		if err := markVerifiedReviews(tx, order.UserID, order.ID); err != nil {
+			return nil, err
+		}
+		if err := EarnOrderBonus(tx, &order); err != nil {
+			return nil, err
+		}
+	}
+
+	order.Status = to
+	return &order, nil
+}
+
+// AdminTransitionOrderStatus applies a status change made from the back
+// office. On top of the lifecycle rules it keeps online orders from being
+// confirmed before they are paid, and cancelling an order that still waits
+// for payment cancels its open provider transactions, so a payment finished
+// afterwards is rejected. It must be called inside a transaction.
+func AdminTransitionOrderStatus(tx *gorm.DB, orderID uuid.UUID, to string, actorID *uuid.UUID, note string) (*models.Order, error) {
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id, status, payment_method").
+		First(&order, "id = ?", orderID).Error; err != nil {
+		return nil, err
+	}
+
+	if !models.IsAdminOrderTransition(order.Status, to, order.PaymentMethod) {
+		return nil, &OrderTransitionError{From: order.Status, To: to}
+	}
+	if order.Status == models.OrderStatusPending && to == models.OrderStatusCancelled {
+		if err := cancelOpenOrderTransactions(tx, order.ID, PaymentCancelReasonMerchant); err != nil {
+			return nil, err
+		}
+	}
+
+	return TransitionOrderStatus(tx, orderID, to, actorID, note)
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// RateLimitError reports that an action is throttled.
+type RateLimitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return e.Message
+}
+
+// RetryAfterSeconds returns the wait time rounded up to whole seconds.
+func (e *RateLimitError) RetryAfterSeconds() int {
+	secs := int((e.RetryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		return 1
+	}
+	return secs
+}
+
+// OTPGuardConfig holds the OTP throttling limits.
+type OTPGuardConfig struct {
+	// MaxAttempts is the number of wrong codes allowed per phone (and per
+	// issued code) before a lockout.
+	MaxAttempts int
+	// IPMaxAttempts is the number of wrong codes allowed per client IP.
+	IPMaxAttempts int
+	// IPMaxSends is the number of codes a client IP may request per window.
+	IPMaxSends int
+	// Lockout is both the counting window and the lockout duration.
+	Lockout time.Duration
+	// ResendCooldown is the minimum time between two codes to one phone.
+	ResendCooldown time.Duration
+}
+
+// OTPGuard protects OTP flows against code enumeration and SMS flooding.
+type OTPGuard struct {
+	db  *gorm.DB
+	cfg OTPGuardConfig
+}
+
+func NewOTPGuard(db *gorm.DB, cfg OTPGuardConfig) *OTPGuard {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.IPMaxAttempts <= 0 {
+		cfg.IPMaxAttempts = 20
+	}
+	if cfg.IPMaxSends <= 0 {
+		cfg.IPMaxSends = 10
+	}
+	if cfg.Lockout <= 0 {
+		cfg.Lockout = 15 * time.Minute
+	}
+	if cfg.ResendCooldown <= 0 {
+		cfg.ResendCooldown = time.Minute
+	}
+	return &OTPGuard{db: db, cfg: cfg}
+}
+
+// MaxAttempts returns how many wrong guesses a single code tolerates.
+func (g *OTPGuard) MaxAttempts() int {
+	return g.cfg.MaxAttempts
+}
+
+// ResendCooldown returns the minimum time between two codes to one phone.
+func (g *OTPGuard) ResendCooldown() time.Duration {
+	return g.cfg.ResendCooldown
+}
+
+// CheckSend reports whether a new code may be sent. lastSentAt is the time
+// the previous code for the phone and purpose was issued, if any.
+func (g *OTPGuard) CheckSend(purpose, ip string, lastSentAt *time.Time) error {
+	if lastSentAt != nil {
+		if wait := g.cfg.ResendCooldown - time.Since(*lastSentAt); wait > 0 {
+			return &RateLimitError{Message: "please wait before requesting a new code", RetryAfter: wait}
+		}
+	}
+	return g.checkLocked(sendKind(purpose), ipKey(ip))
+}
+
+// RecordSend counts a sent code against the client IP.
+func (g *OTPGuard) RecordSend(purpose, ip string) error {
+	_, err := g.hit(sendKind(purpose), ipKey(ip), g.cfg.IPMaxSends)
+	return err
+}
+
+// CheckVerify reports whether the phone or client IP is locked out.
+func (g *OTPGuard) CheckVerify(purpose, phone, ip string) error {
+	if err := g.checkLocked(verifyKind(purpose), phoneKey(phone)); err != nil {
+		return err
+	}
+	return g.checkLocked(verifyKind(purpose), ipKey(ip))
+}
+
+// RecordFailure counts a wrong code for the phone and client IP. It returns a
+// *RateLimitError when this failure triggered a lockout.
+func (g *OTPGuard) RecordFailure(purpose, phone, ip string) error {
+	phoneLock, err := g.hit(verifyKind(purpose), phoneKey(phone), g.cfg.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	ipLock, err := g.hit(verifyKind(purpose), ipKey(ip), g.cfg.IPMaxAttempts)
+	if err != nil {
+		return err
+	}
+	if phoneLock != nil {
+		return phoneLock
+	}
+	if ipLock != nil {
+		return ipLock
+	}
+	return nil
+}
+
+// RecordSuccess clears the failure counter of a phone after a correct code.
+func (g *OTPGuard) RecordSuccess(purpose, phone string) error {
+	return g.db.Where("kind = ? AND key = ?", verifyKind(purpose), phoneKey(phone)).
+		Delete(&models.OTPThrottle{}).Error
+}
+
+func (g *OTPGuard) checkLocked(kind, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	var row models.OTPThrottle
+	err := g.db.Where("kind = ? AND key = ?", kind, key).Limit(1).Find(&row).Error
+	if err != nil {
+		return err
+	}
+	if row.LockedUntil != nil {
+		if wait := time.Until(*row.LockedUntil); wait > 0 {
+			return &RateLimitError{Message: "too many attempts, try again later", RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// hit increments a counter inside its window and locks the key once the
+// limit is reached. The returned *RateLimitError describes a new lockout.
+func (g *OTPGuard) hit(kind, key string, limit int) (*RateLimitError, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	var locked *RateLimitError
+	err := g.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		row := models.OTPThrottle{Kind: kind, Key: key, WindowStart: now}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("kind = ? AND key = ?", kind, key).
+			First(&row).Error; err != nil {
+			return err
+		}
+
+		if now.Sub(row.WindowStart) > g.cfg.Lockout || (row.LockedUntil != nil && now.After(*row.LockedUntil)) {
+			row.Count = 0
+			row.WindowStart = now
+			row.LockedUntil = nil
+		}
+		row.Count++
+		if row.Count >= limit && row.LockedUntil == nil {
+			until := now.Add(g.cfg.Lockout)
+			row.LockedUntil = &until
+			locked = &RateLimitError{Message: "too many attempts, try again later", RetryAfter: g.cfg.Lockout}
+		}
+
+		return tx.Model(&models.OTPThrottle{}).
+			Where("id = ?", row.ID).
+			Updates(map[string]any{
+				"count":        row.Count,
+				"window_start": row.WindowStart,
+				"locked_until": row.LockedUntil,
+			}).Error
+	})
+	return locked, err
+}
+
+func verifyKind(purpose string) string { return "verify:" + purpose }
+func sendKind(purpose string) string   { return "send:" + purpose }
+
+func phoneKey(phone string) string {
+	if phone == "" {
+		return ""
+	}
+	return fmt.Sprintf("phone:%s", phone)
+}
+
+func ipKey(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	return fmt.Sprintf("ip:%s", ip)
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// PaymeService implements PaymentGateway.
+var _ PaymentGateway = (*PaymeService)(nil)
+
+// Provider returns the payment provider type handled by Payme.
+func (s *PaymeService) Provider() string {
+	return models.PaymentTypePayme
+}
+
+// CreateCheckout creates a Payme transaction for the order and returns the
+// Payme checkout URL.
+func (s *PaymeService) CreateCheckout(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	amount := int64(math.Floor(req.Order.TotalAmount))
+	txn, err := startTransaction(ctx, s.db, models.PaymentTypePayme, req, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURL := strings.TrimRight(req.ReturnURL, "/")
+
+	payload := fmt.Sprintf("m=%s;ac.order_id=%s;a=%d;c=%s", s.cfg.MerchantID, txn.ID.String(), amount*100, redirectURL)
+	encoded := base64.StdEncoding.EncodeToString([]byte(payload))
+
+	return &CheckoutSession{
+		Provider:      models.PaymentTypePayme,
+		TransactionID: txn.ID,
+		URL:           "https://checkout.payme.uz/" + encoded,
+		Amount:        amount,
+	}, nil
+}
+
+// MarkRefunded records the refund of a paid Payme transaction. The money
+// itself is returned from the Payme merchant cabinet.
+func (s *PaymeService) MarkRefunded(ctx context.Context, txnID uuid.UUID, reason int) error {
+	return refundProviderTransaction(ctx, s.db, models.PaymentTypePayme, txnID, reason)
+}
+
+// Statement lists Payme transactions created in the given range.
+func (s *PaymeService) Statement(ctx context.Context, from, to time.Time) ([]models.PaymeTransaction, error) {
+	return providerStatement(ctx, s.db, models.PaymentTypePayme, from, to)
+}
+
+// VerifyPaymeAuthorization validates a Payme "Basic" Authorization header.
+func VerifyPaymeAuthorization(authHeader, merchantKey string) bool {
+	parts := strings.SplitN(authHeader, " ", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(decoded), merchantKey)
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 
 	"github.com/example/shafran/internal/models"
 )
@@ -97,14 +96,21 @@ func (e *TransactionError) Error() string {
 	return e.Info.Name
 }
 
+// PaymeConfig holds Payme merchant credentials.
+type PaymeConfig struct {
+	MerchantID  string
+	MerchantKey string
+}
+
 // PaymeService ports business logic from the JS payme.service.
 type PaymeService struct {
-	db       *gorm.DB
-	telegram *TelegramService
+	db     *gorm.DB
+	cfg    PaymeConfig
+	outbox *BillzOutbox
 }
 
-func NewPaymeService(db *gorm.DB, telegram *TelegramService) *PaymeService {
-	return &PaymeService{db: db, telegram: telegram}
+func NewPaymeService(db *gorm.DB, cfg PaymeConfig, outbox *BillzOutbox) *PaymeService {
+	return &PaymeService{db: db, cfg: cfg, outbox: outbox}
 }
 
 type PaymeAccount struct {
@@ -191,6 +197,22 @@ func (s *PaymeService) CheckPerformTransaction(ctx context.Context, params Check
 		return &TransactionError{Info: PaymeErrorInvalidAmount, ID: id}
 	}
 
+	if orderID, ok := linkedOrderID(*txn); ok {
+		var order models.Order
+		if err := s.db.WithContext(ctx).Select("id, status").First(&order, "id = ?", orderID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &TransactionError{Info: PaymeErrorTransactionNotFound, ID: id}
+			}
+			return err
+		}
+		if order.Status == models.OrderStatusPaid {
+			return &TransactionError{Info: PaymeErrorAlreadyDone, ID: id}
+		}
+		if order.Status != models.OrderStatusPending {
+			return &TransactionError{Info: PaymeErrorCantDoOperation, ID: id}
+		}
+	}
+
 	return nil
 }
 
@@ -208,7 +230,7 @@ func (s *PaymeService) CheckTransaction(ctx context.Context, params CheckTransac
 
 	var txn models.PaymeTransaction
 	if err := s.db.WithContext(ctx).
-		Where("transaction_id = ?", lookupID).
+		Where("transaction_id = ? AND provider = ?", lookupID, models.PaymentTypePayme).
 		First(&txn).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, &TransactionError{Info: PaymeErrorTransactionNotFound, ID: id}
@@ -244,7 +266,7 @@ func (s *PaymeService) CreateTransaction(ctx context.Context, params CreateTrans
 
 	var existing models.PaymeTransaction
 	err := s.db.WithContext(ctx).
-		Where("transaction_id = ?", params.ID).
+		Where("transaction_id = ? AND provider = ?", params.ID, models.PaymentTypePayme).
 		First(&existing).Error
 	if err == nil {
 		if existing.Status != TransactionStatePending {
@@ -254,7 +276,7 @@ func (s *PaymeService) CreateTransaction(ctx context.Context, params CreateTrans
 		if (currentTime-existing.CreateTime)/60000 >= 12 {
 			if err := s.db.WithContext(ctx).
 				Model(&models.PaymeTransaction{}).
-				Where("transaction_id = ?", params.ID).
+				Where("id = ?", existing.ID).
 				Updates(map[string]any{
 					"status": TransactionStatePendingCanceled,
 					"reason": 4,
@@ -288,7 +310,7 @@ func (s *PaymeService) CreateTransaction(ctx context.Context, params CreateTrans
 
 	if err := s.db.WithContext(ctx).
 		Model(&models.PaymeTransaction{}).
-		Where("provider = ? AND (id = ? OR order_id = ?)", "payme", params.Account.OrderID, params.Account.OrderID).
+		Where("provider = ? AND (id = ? OR order_id = ?)", models.PaymentTypePayme, params.Account.OrderID, params.Account.OrderID).
 		Updates(map[string]any{
 			"transaction_id": params.ID,
 			"status":         TransactionStatePending,
@@ -309,10 +331,8 @@ func (s *PaymeService) CreateTransaction(ctx context.Context, params CreateTrans
 func (s *PaymeService) PerformTransaction(ctx context.Context, params PerformTransactionParams, id any) (*PerformTransactionResult, error) {
 	currentTime := time.Now().UnixMilli()
 
-	var txn models.PaymeTransaction
-	if err := s.db.WithContext(ctx).
-		Where("transaction_id = ?", params.ID).
-		First(&txn).Error; err != nil {
+	txn, err := s.findTransaction(ctx, params.ID)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, &TransactionError{Info: PaymeErrorTransactionNotFound, ID: id}
 		}
@@ -323,7 +343,7 @@ func (s *PaymeService) PerformTransaction(ctx context.Context, params PerformTra
 		if txn.Status != TransactionStatePaid {
 			return nil, &TransactionError{Info: PaymeErrorCantDoOperation, ID: id}
 		}
-		if res, err := s.dispatchBillzOrder(ctx, txn.ID); err != nil {
+		if res, err := s.dispatchBillzOrder(txn.ID); err != nil {
 			log.Printf("billz order creation failed for payme transaction %s: %v", txn.ID, err)
 		} else if res != nil {
 			log.Printf("billz order %s created for payme transaction %s", res.OrderID, txn.ID)
@@ -338,7 +358,7 @@ func (s *PaymeService) PerformTransaction(ctx context.Context, params PerformTra
 	if (currentTime-txn.CreateTime)/60000 >= 12 {
 		if err := s.db.WithContext(ctx).
 			Model(&models.PaymeTransaction{}).
-			Where("transaction_id = ?", params.ID).
+			Where("id = ?", txn.ID).
 			Updates(map[string]any{
 				"status":      TransactionStatePendingCanceled,
 				"reason":      4,
@@ -349,37 +369,18 @@ func (s *PaymeService) PerformTransaction(ctx context.Context, params PerformTra
 		return nil, &TransactionError{Info: PaymeErrorCantDoOperation, ID: id}
 	}
 
-	if err := s.db.WithContext(ctx).
-		Model(&models.PaymeTransaction{}).
-		Where("transaction_id = ?", params.ID).
-		Updates(map[string]any{
-			"status":       TransactionStatePaid,
-			"perform_time": currentTime,
-		}).Error; err != nil {
+	if err := settleTransaction(ctx, s.db, *txn, currentTime, "paid via payme"); err != nil {
+		var transitionErr *OrderTransitionError
+		if errors.As(err, &transitionErr) {
+			return nil, &TransactionError{Info: PaymeErrorCantDoOperation, ID: id}
+		}
 		return nil, err
 	}
 
-	if res, err := s.dispatchBillzOrder(ctx, txn.ID); err != nil {
+	if res, err := s.dispatchBillzOrder(txn.ID); err != nil {
 		log.Printf("billz order creation failed for payme transaction %s: %v", txn.ID, err)
 	} else if res != nil {
 		log.Printf("billz order %s created for payme transaction %s", res.OrderID, txn.ID)
-
-		// Telegram'ga to'lov muvaffaqiyatli bo'lgani haqida xabar yuborish
-		if s.telegram != nil {
-			go func() {
-				if err := s.telegram.NotifyPaymentSuccess(PaymentSuccessNotification{
-					OrderID:      txn.OrderID,
-					OrderNumber:  txn.OrderID,
-					BillzOrderID: res.OrderID,
-					Amount:       float64(txn.Amount),
-					Currency:     "UZS",
-				}); err != nil {
-					log.Printf("[Payme] Telegram payment success notification failed: %v", err)
-				} else {
-					log.Printf("[Payme] Telegram payment success notification sent for order %s", txn.OrderID)
-				}
-			}()
-		}
 	}
 
 	return &PerformTransactionResult{
@@ -391,10 +392,8 @@ func (s *PaymeService) PerformTransaction(ctx context.Context, params PerformTra
 
 // CancelTransaction cancels an existing transaction.
 func (s *PaymeService) CancelTransaction(ctx context.Context, params CancelTransactionParams, id any) (*CancelTransactionResult, error) {
-	var txn models.PaymeTransaction
-	if err := s.db.WithContext(ctx).
-		Where("transaction_id = ?", params.ID).
-		First(&txn).Error; err != nil {
+	txn, err := s.findTransaction(ctx, params.ID)
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, &TransactionError{Info: PaymeErrorTransactionNotFound, ID: id}
 		}
@@ -404,15 +403,8 @@ func (s *PaymeService) CancelTransaction(ctx context.Context, params CancelTrans
 	currentTime := time.Now().UnixMilli()
 
 	if txn.Status > 0 {
-		newState := -1 * intAbs(txn.Status)
-		if err := s.db.WithContext(ctx).
-			Model(&models.PaymeTransaction{}).
-			Where("transaction_id = ?", params.ID).
-			Updates(map[string]any{
-				"status":      newState,
-				"reason":      params.Reason,
-				"cancel_time": currentTime,
-			}).Error; err != nil {
+		newState, err := cancelTransaction(ctx, s.db, *txn, params.Reason, currentTime, "payme transaction cancelled")
+		if err != nil {
 			return nil, err
 		}
 		txn.Status = newState
@@ -433,10 +425,8 @@ func (s *PaymeService) CancelTransaction(ctx context.Context, params CancelTrans
 
 // GetStatement returns transactions in the given time range.
 func (s *PaymeService) GetStatement(ctx context.Context, params StatementParams) ([]StatementTransaction, error) {
-	var txns []models.PaymeTransaction
-	if err := s.db.WithContext(ctx).
-		Where("create_time >= ? AND create_time <= ? AND provider = ?", params.From, params.To, "payme").
-		Find(&txns).Error; err != nil {
+	txns, err := s.Statement(ctx, time.UnixMilli(params.From), time.UnixMilli(params.To))
+	if err != nil {
 		return nil, err
 	}
 
@@ -459,9 +449,19 @@ func (s *PaymeService) GetStatement(ctx context.Context, params StatementParams)
 	return result, nil
 }
 
+func (s *PaymeService) findTransaction(ctx context.Context, transactionID string) (*models.PaymeTransaction, error) {
+	var txn models.PaymeTransaction
+	if err := s.db.WithContext(ctx).
+		Where("transaction_id = ? AND provider = ?", transactionID, models.PaymentTypePayme).
+		First(&txn).Error; err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
 func (s *PaymeService) findTransactionByOrderRef(ctx context.Context, orderRef string) (*models.PaymeTransaction, error) {
 	var txn models.PaymeTransaction
-	db := s.db.WithContext(ctx).Where("provider = ?", "payme")
+	db := s.db.WithContext(ctx).Where("provider = ?", models.PaymentTypePayme)
 
 	if parsed, err := uuid.Parse(orderRef); err == nil {
 		if err := db.Where("id = ?", parsed).First(&txn).Error; err == nil {
@@ -478,52 +478,10 @@ func (s *PaymeService) findTransactionByOrderRef(ctx context.Context, orderRef s
 	return &txn, nil
 }
 
-func (s *PaymeService) dispatchBillzOrder(ctx context.Context, txnID uuid.UUID) (*BillzOrderResult, error) {
-	var result *BillzOrderResult
-	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		var txn models.PaymeTransaction
-		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
-			Where("id = ? AND provider = ?", txnID, "payme").
-			First(&txn).Error; err != nil {
-			return err
-		}
-
-		if txn.BillzOrderID != "" {
-			result = &BillzOrderResult{
-				OrderID:     txn.BillzOrderID,
-				OrderNumber: txn.BillzOrderNumber,
-				OrderType:   txn.BillzOrderType,
-			}
-			return nil
-		}
-
-		res, err := CreateBillzOrderFromPaymeTransaction(txn)
-		if err != nil {
-			_ = tx.Model(&models.PaymeTransaction{}).
-				Where("id = ?", txnID).
-				Updates(map[string]any{"billz_sync_error": truncateBillzSyncError(err)}).Error
-			return err
-		}
-		if res == nil {
-			return nil
-		}
-
-		now := time.Now()
-		if err := tx.Model(&models.PaymeTransaction{}).
-			Where("id = ?", txnID).
-			Updates(map[string]any{
-				"billz_order_id":     res.OrderID,
-				"billz_order_number": res.OrderNumber,
-				"billz_order_type":   res.OrderType,
-				"billz_synced_at":    &now,
-				"billz_sync_error":   "",
-			}).Error; err != nil {
-			return err
-		}
-		result = res
-		return nil
-	})
-	return result, err
+// dispatchBillzOrder pushes a paid transaction to Billz through the outbox,
+// which retries it later if Billz cannot be reached now.
+func (s *PaymeService) dispatchBillzOrder(txnID uuid.UUID) (*BillzOrderResult, error) {
+	return s.outbox.DispatchTransaction(txnID)
 }
 
 func intAbs(v int) int {
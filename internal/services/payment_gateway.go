@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// Payment gateway errors.
+var (
+	ErrPaymentProviderUnavailable = errors.New("payment provider is not available")
+	ErrPaymentTransactionNotFound = errors.New("payment transaction not found")
+	ErrPaymentInvalidState        = errors.New("payment transaction is not in a state that allows this operation")
+)
+
+// Cancel reasons stored on transactions cancelled from our side.
+const (
+	PaymentCancelReasonMerchant = 3
+	PaymentCancelReasonRefund   = 5
+)
+
+// CheckoutRequest describes the order a checkout is created for.
+type CheckoutRequest struct {
+	Order     models.Order
+	UserID    uuid.UUID
+	ReturnURL string
+}
+
+// CheckoutSession is a started payment the customer completes on the
+// provider's page.
+type CheckoutSession struct {
+	Provider      string    `json:"provider"`
+	TransactionID uuid.UUID `json:"transaction_id"`
+	URL           string    `json:"url"`
+	Amount        int64     `json:"amount"`
+}
+
+// PaymentGateway is implemented by every online payment provider. Provider
+// callbacks stay provider specific; the gateway covers what the rest of the
+// shop needs from a payment.
+type PaymentGateway interface {
+	// Provider returns the PaymentProvider.Type the gateway is registered under.
+	Provider() string
+	// CreateCheckout starts a payment for a pending order.
+	CreateCheckout(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error)
+	// MarkRefunded records that a paid transaction was refunded outside the
+	// shop. It does not move any money; the refund itself is made in the
+	// provider's merchant cabinet.
+	MarkRefunded(ctx context.Context, txnID uuid.UUID, reason int) error
+	// Statement lists the provider's transactions created in the given range.
+	Statement(ctx context.Context, from, to time.Time) ([]models.PaymeTransaction, error)
+}
+
+// PaymentRegistry resolves payment gateways by PaymentProvider.Type.
+type PaymentRegistry struct {
+	db       *gorm.DB
+	gateways map[string]PaymentGateway
+}
+
+func NewPaymentRegistry(db *gorm.DB, gateways ...PaymentGateway) *PaymentRegistry {
+	r := &PaymentRegistry{db: db, gateways: make(map[string]PaymentGateway, len(gateways))}
+	for _, g := range gateways {
+		r.gateways[g.Provider()] = g
+	}
+	return r
+}
+
+// Get returns the gateway registered for a provider type.
+func (r *PaymentRegistry) Get(providerType string) (PaymentGateway, bool) {
+	g, ok := r.gateways[strings.ToLower(strings.TrimSpace(providerType))]
+	return g, ok
+}
+
+// Providers returns the registered provider types.
+func (r *PaymentRegistry) Providers() []string {
+	types := make([]string, 0, len(r.gateways))
+	for t := range r.gateways {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Active returns the gateway for a provider type when an active
+// PaymentProvider record of that type exists.
+func (r *PaymentRegistry) Active(ctx context.Context, providerType string) (PaymentGateway, error) {
+	g, ok := r.Get(providerType)
+	if !ok {
+		return nil, ErrPaymentProviderUnavailable
+	}
+
+	var count int64
+	if err := r.db.WithContext(ctx).Model(&models.PaymentProvider{}).
+		Where("LOWER(type) = ? AND is_active = ?", g.Provider(), true).
+		Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrPaymentProviderUnavailable
+	}
+	return g, nil
+}
+
+// startTransaction replaces the not yet started checkouts of an order with a
+// new transaction for the given provider.
+func startTransaction(ctx context.Context, db *gorm.DB, provider string, req CheckoutRequest, amount int64) (*models.PaymeTransaction, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid checkout amount %d", amount)
+	}
+
+	txn := models.PaymeTransaction{
+		UserID:          &req.UserID,
+		OrderID:         req.Order.OrderNumber,
+		InternalOrderID: &req.Order.ID,
+		Status:          0,
+		Provider:        provider,
+		Amount:          amount,
+	}
+
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.
+			Where("internal_order_id = ? AND provider = ? AND status IN ?", req.Order.ID, provider, []int{0, TransactionStatePending}).
+			Delete(&models.PaymeTransaction{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&txn).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// settleTransaction marks a transaction as paid and moves its order to paid.
+// An *OrderTransitionError means the order can no longer be paid.
+func settleTransaction(ctx context.Context, db *gorm.DB, txn models.PaymeTransaction, performTime int64, note string) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PaymeTransaction{}).
+			Where("id = ?", txn.ID).
+			Updates(map[string]any{
+				"status":       TransactionStatePaid,
+				"perform_time": performTime,
+			}).Error; err != nil {
+			return err
+		}
+		orderID, ok := linkedOrderID(txn)
+		if !ok {
+			return nil
+		}
+		if _, err := TransitionOrderStatus(tx, orderID, models.OrderStatusPaid, nil, note); err != nil {
+			return err
+		}
+		return tx.Model(&models.Order{}).
+			Where("id = ?", orderID).
+			Update("transaction_id", txn.TransactionID).Error
+	})
+}
+
+// cancelTransaction cancels a pending or paid transaction and cancels or
+// refunds its order. It returns the new transaction state.
+func cancelTransaction(ctx context.Context, db *gorm.DB, txn models.PaymeTransaction, reason int, cancelTime int64, note string) (int, error) {
+	if txn.Status <= 0 {
+		return txn.Status, nil
+	}
+
+	newState := -1 * intAbs(txn.Status)
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PaymeTransaction{}).
+			Where("id = ?", txn.ID).
+			Updates(map[string]any{
+				"status":      newState,
+				"reason":      reason,
+				"cancel_time": cancelTime,
+			}).Error; err != nil {
+			return err
+		}
+		if orderID, ok := linkedOrderID(txn); ok {
+			return cancelLinkedOrder(tx, orderID, txn.Status == TransactionStatePaid, note)
+		}
+		return nil
+	})
+	return newState, err
+}
+
+func findProviderTransaction(ctx context.Context, db *gorm.DB, provider string, txnID uuid.UUID) (*models.PaymeTransaction, error) {
+	var txn models.PaymeTransaction
+	if err := db.WithContext(ctx).
+		Where("id = ? AND provider = ?", txnID, provider).
+		First(&txn).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPaymentTransactionNotFound
+		}
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// refundProviderTransaction records the refund of a paid transaction. It is
+// bookkeeping only; no money is moved.
+func refundProviderTransaction(ctx context.Context, db *gorm.DB, provider string, txnID uuid.UUID, reason int) error {
+	txn, err := findProviderTransaction(ctx, db, provider, txnID)
+	if err != nil {
+		return err
+	}
+	if txn.Status != TransactionStatePaid {
+		return ErrPaymentInvalidState
+	}
+
+	note := fmt.Sprintf("payment refunded (%s)", provider)
+	_, err = cancelTransaction(ctx, db, *txn, reason, time.Now().UnixMilli(), note)
+	return err
+}
+
+// providerStatement lists a provider's transactions created in a time range.
+func providerStatement(ctx context.Context, db *gorm.DB, provider string, from, to time.Time) ([]models.PaymeTransaction, error) {
+	var txns []models.PaymeTransaction
+	err := db.WithContext(ctx).
+		Where("create_time >= ? AND create_time <= ? AND provider = ?", from.UnixMilli(), to.UnixMilli(), provider).
+		Order("create_time").
+		Find(&txns).Error
+	return txns, err
+}
+
+// cancelOpenOrderTransactions cancels the provider transactions of an order
+// that are still waiting for payment, so a payment finished after the order
+// was cancelled is rejected instead of failing half-way. It must be called
+// inside the transaction cancelling the order.
+func cancelOpenOrderTransactions(tx *gorm.DB, orderID uuid.UUID, reason int) error {
+	return tx.Model(&models.PaymeTransaction{}).
+		Where("internal_order_id = ? AND status = ?", orderID, TransactionStatePending).
+		Updates(map[string]any{
+			"status":      TransactionStatePendingCanceled,
+			"reason":      reason,
+			"cancel_time": time.Now().UnixMilli(),
+		}).Error
+}
+
+// linkedOrderID returns the internal order referenced by a transaction, if any.
+func linkedOrderID(txn models.PaymeTransaction) (uuid.UUID, bool) {
+	if txn.InternalOrderID == nil || *txn.InternalOrderID == uuid.Nil {
+		return uuid.Nil, false
+	}
+	return *txn.InternalOrderID, true
+}
+
+// cancelLinkedOrder moves the order behind a cancelled payment to cancelled,
+// or to refunded when the payment had already gone through. Orders that have
+// already left the payment stage are left as they are.
+func cancelLinkedOrder(tx *gorm.DB, orderID uuid.UUID, wasPaid bool, note string) error {
+	var order models.Order
+	if err := tx.Select("id, status").First(&order, "id = ?", orderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	target := models.OrderStatusCancelled
+	if wasPaid {
+		target = models.OrderStatusRefunded
+	}
+	if !models.CanTransitionOrderStatus(order.Status, target) {
+		return nil
+	}
+	_, err := TransitionOrderStatus(tx, orderID, target, nil, note)
+	return err
+}
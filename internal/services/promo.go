@@ -0,0 +1,245 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// Promo code rejection reasons.
+const (
+	PromoErrorNotFound      = "not_found"
+	PromoErrorInactive      = "inactive"
+	PromoErrorNotStarted    = "not_started"
+	PromoErrorExpired       = "expired"
+	PromoErrorMinAmount     = "min_order_amount"
+	PromoErrorUsageLimit    = "usage_limit_reached"
+	PromoErrorUserLimit     = "user_limit_reached"
+	PromoErrorNotApplicable = "not_applicable"
+)
+
+// PromoError reports why a promo code cannot be applied.
+type PromoError struct {
+	Code    string
+	Message string
+}
+
+func (e *PromoError) Error() string {
+	return e.Message
+}
+
+// PromoLine is an order line as seen by the discount engine.
+type PromoLine struct {
+	ProductID  uuid.UUID
+	BrandID    *uuid.UUID
+	CategoryID *uuid.UUID
+	LineTotal  float64
+}
+
+// PromoResult is the discount a promo code gives on a set of lines.
+type PromoResult struct {
+	Promo            models.PromoCode `json:"-"`
+	Code             string           `json:"code"`
+	Subtotal         float64          `json:"subtotal"`
+	EligibleSubtotal float64          `json:"eligible_subtotal"`
+	Discount         float64          `json:"discount"`
+}
+
+// NormalizePromoCode returns the canonical form codes are stored in.
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// PromoLinesForItems resolves the brand and category of each order item.
+func PromoLinesForItems(db *gorm.DB, items []models.OrderItem) ([]PromoLine, error) {
+	productIDs := make([]uuid.UUID, 0, len(items))
+	for _, item := range items {
+		if item.ProductID != nil {
+			productIDs = append(productIDs, *item.ProductID)
+		}
+	}
+
+	var products []models.Product
+	if len(productIDs) > 0 {
+		if err := db.Select("id", "brand_id", "category_id").
+			Where("id IN ?", productIDs).
+			Find(&products).Error; err != nil {
+			return nil, err
+		}
+	}
+	byID := make(map[uuid.UUID]models.Product, len(products))
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+
+	lines := make([]PromoLine, 0, len(items))
+	for _, item := range items {
+		line := PromoLine{LineTotal: item.LineTotal}
+		if item.ProductID != nil {
+			line.ProductID = *item.ProductID
+			if p, ok := byID[*item.ProductID]; ok {
+				line.BrandID = p.BrandID
+				line.CategoryID = p.CategoryID
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// EvaluatePromo checks a promo code against the lines and computes its
+// discount. userID may be nil for anonymous previews, in which case the
+// per-user limit is not checked.
+func EvaluatePromo(db *gorm.DB, code string, userID *uuid.UUID, lines []PromoLine) (*PromoResult, error) {
+	var promo models.PromoCode
+	if err := db.Where("code = ?", NormalizePromoCode(code)).First(&promo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &PromoError{Code: PromoErrorNotFound, Message: "promo code not found"}
+		}
+		return nil, err
+	}
+
+	if err := checkPromoLimits(db, &promo, userID); err != nil {
+		return nil, err
+	}
+	return applyPromo(promo, lines)
+}
+
+// RedeemPromo records the promo code as used by the order. The promo row is
+// locked so concurrent orders cannot exceed the usage limits.
+func RedeemPromo(tx *gorm.DB, promoID, userID, orderID uuid.UUID, amount float64) error {
+	var promo models.PromoCode
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&promo, "id = ?", promoID).Error; err != nil {
+		return err
+	}
+	if err := checkPromoLimits(tx, &promo, &userID); err != nil {
+		return err
+	}
+
+	if err := tx.Create(&models.PromoRedemption{
+		PromoCodeID: promoID,
+		UserID:      userID,
+		OrderID:     orderID,
+		Amount:      amount,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Model(&promo).UpdateColumn("used_count", gorm.Expr("used_count + 1")).Error
+}
+
+// ReleasePromoRedemption gives the promo usage of a cancelled order back.
+func ReleasePromoRedemption(tx *gorm.DB, orderID uuid.UUID) error {
+	var redemption models.PromoRedemption
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND released_at IS NULL", orderID).
+		First(&redemption).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Model(&redemption).Update("released_at", time.Now()).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.PromoCode{}).
+		Where("id = ? AND used_count > 0", redemption.PromoCodeID).
+		UpdateColumn("used_count", gorm.Expr("used_count - 1")).Error
+}
+
+func checkPromoLimits(db *gorm.DB, promo *models.PromoCode, userID *uuid.UUID) error {
+	now := time.Now()
+	if !promo.IsActive {
+		return &PromoError{Code: PromoErrorInactive, Message: "promo code is not active"}
+	}
+	if promo.StartsAt != nil && now.Before(*promo.StartsAt) {
+		return &PromoError{Code: PromoErrorNotStarted, Message: "promo code is not active yet"}
+	}
+	if promo.EndsAt != nil && now.After(*promo.EndsAt) {
+		return &PromoError{Code: PromoErrorExpired, Message: "promo code has expired"}
+	}
+	if promo.UsageLimit > 0 && promo.UsedCount >= promo.UsageLimit {
+		return &PromoError{Code: PromoErrorUsageLimit, Message: "promo code usage limit reached"}
+	}
+
+	if promo.PerUserLimit > 0 && userID != nil {
+		var used int64
+		if err := db.Model(&models.PromoRedemption{}).
+			Where("promo_code_id = ? AND user_id = ? AND released_at IS NULL", promo.ID, *userID).
+			Count(&used).Error; err != nil {
+			return err
+		}
+		if int(used) >= promo.PerUserLimit {
+			return &PromoError{Code: PromoErrorUserLimit, Message: "you have already used this promo code"}
+		}
+	}
+	return nil
+}
+
+func applyPromo(promo models.PromoCode, lines []PromoLine) (*PromoResult, error) {
+	result := &PromoResult{Promo: promo, Code: promo.Code}
+	for _, line := range lines {
+		result.Subtotal += line.LineTotal
+		if promoCovers(promo, line) {
+			result.EligibleSubtotal += line.LineTotal
+		}
+	}
+
+	if result.Subtotal < promo.MinOrderAmount {
+		return nil, &PromoError{Code: PromoErrorMinAmount, Message: "order total is below the promo code minimum"}
+	}
+	if result.EligibleSubtotal <= 0 {
+		return nil, &PromoError{Code: PromoErrorNotApplicable, Message: "promo code does not apply to these products"}
+	}
+
+	var discount float64
+	switch promo.Type {
+	case models.PromoTypePercent:
+		discount = result.EligibleSubtotal * promo.Value / 100
+		if promo.MaxDiscount > 0 && discount > promo.MaxDiscount {
+			discount = promo.MaxDiscount
+		}
+	default:
+		discount = promo.Value
+	}
+	if discount > result.EligibleSubtotal {
+		discount = result.EligibleSubtotal
+	}
+	result.Discount = math.Round(discount*100) / 100
+	return result, nil
+}
+
+// promoCovers reports whether the line matches the promo restrictions. A line
+// matches when it satisfies any of the configured restriction lists.
+func promoCovers(promo models.PromoCode, line PromoLine) bool {
+	if len(promo.BrandIDs) == 0 && len(promo.CategoryIDs) == 0 && len(promo.ProductIDs) == 0 {
+		return true
+	}
+	if containsID(promo.ProductIDs, &line.ProductID) ||
+		containsID(promo.BrandIDs, line.BrandID) ||
+		containsID(promo.CategoryIDs, line.CategoryID) {
+		return true
+	}
+	return false
+}
+
+func containsID(ids []string, id *uuid.UUID) bool {
+	if id == nil {
+		return false
+	}
+	for _, candidate := range ids {
+		if strings.EqualFold(candidate, id.String()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// Reminder channels selectable with REMINDER_CHANNEL. SMS goes to the
+// customer; Telegram goes to the admin chat so staff can follow up.
+const (
+	ReminderChannelSMS      = "sms"
+	ReminderChannelTelegram = "telegram"
+)
+
+// ReminderConfig holds reminder timing and delivery settings.
+type ReminderConfig struct {
+	Channel       string
+	StorefrontURL string
+	// CartAge is how long a cart must be idle before a reminder.
+	CartAge time.Duration
+	// PaymentAge is how long a checkout may stay unpaid before a reminder.
+	PaymentAge time.Duration
+	// MaxAge skips anything older, so old carts are not swept up at once.
+	MaxAge time.Duration
+}
+
+// ReminderService follows up on abandoned carts and unpaid checkouts.
+type ReminderService struct {
+	db       *gorm.DB
+	cfg      ReminderConfig
+	sms      SMSSender
+	telegram *TelegramService
+}
+
+func NewReminderService(db *gorm.DB, cfg ReminderConfig, sms SMSSender, telegram *TelegramService) *ReminderService {
+	cfg.Channel = strings.ToLower(strings.TrimSpace(cfg.Channel))
+	if cfg.Channel != ReminderChannelTelegram {
+		cfg.Channel = ReminderChannelSMS
+	}
+	cfg.StorefrontURL = strings.TrimRight(cfg.StorefrontURL, "/")
+	if cfg.CartAge <= 0 {
+		cfg.CartAge = 2 * time.Hour
+	}
+	if cfg.PaymentAge <= 0 {
+		cfg.PaymentAge = 10 * time.Minute
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 72 * time.Hour
+	}
+	return &ReminderService{db: db, cfg: cfg, sms: sms, telegram: telegram}
+}
+
+type cartReminderRow struct {
+	CartID    uuid.UUID
+	UserID    uuid.UUID
+	Phone     string
+	FirstName string
+}
+
+type paymentReminderRow struct {
+	Provider    string
+	OrderID     uuid.UUID
+	OrderNumber string
+	TotalAmount float64
+	Currency    string
+	UserID      uuid.UUID
+	Phone       string
+	FirstName   string
+}
+
+// SendDue sends every reminder that is due and returns how many were sent.
+func (s *ReminderService) SendDue() (int, error) {
+	carts, err := s.sendCartReminders()
+	if err != nil {
+		return carts, err
+	}
+	payments, err := s.sendPaymentReminders()
+	return carts + payments, err
+}
+
+func (s *ReminderService) sendCartReminders() (int, error) {
+	now := time.Now()
+	var rows []cartReminderRow
+	if err := s.db.Table("carts").
+		Select("carts.id AS cart_id, users.id AS user_id, users.phone, users.first_name").
+		Joins("JOIN users ON users.id = carts.user_id").
+		Where("carts.status = ?", models.CartStatusActive).
+		Where("carts.last_activity_at < ? AND carts.last_activity_at > ?", now.Add(-s.cfg.CartAge), now.Add(-s.cfg.MaxAge)).
+		Where("EXISTS (SELECT 1 FROM cart_items WHERE cart_items.cart_id = carts.id)").
+		Where("NOT EXISTS (SELECT 1 FROM reminders WHERE reminders.kind = ? AND reminders.subject_id = carts.id)", models.ReminderKindAbandonedCart).
+		Scan(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	link := s.cfg.StorefrontURL + "/cart"
+	for _, row := range rows {
+		sms := fmt.Sprintf("Shafran: savatingizda mahsulotlar sizni kutmoqda. Xaridni davom ettiring: %s", link)
+		admin := fmt.Sprintf("🛒 <b>Брошенная корзина</b>\n\nКлиент: %s\nТелефон: %s\nКорзина: %s", row.FirstName, row.Phone, row.CartID)
+		if s.remind(models.ReminderKindAbandonedCart, row.CartID, row.UserID, row.Phone, sms, admin) {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// sendPaymentReminders reminds customers of pending orders with an unpaid
+// checkout. Reminders are keyed on the order, so starting the checkout again
+// does not send another one.
+func (s *ReminderService) sendPaymentReminders() (int, error) {
+	now := time.Now()
+	var rows []paymentReminderRow
+	if err := s.db.Table("payme_transactions").
+		Select("payme_transactions.provider, "+
+			"orders.id AS order_id, orders.order_number, orders.total_amount, orders.currency, users.id AS user_id, users.phone, users.first_name").
+		Joins("JOIN orders ON orders.id = payme_transactions.internal_order_id").
+		Joins("JOIN users ON users.id = orders.user_id").
+		Where("payme_transactions.status IN ?", []int{0, TransactionStatePending}).
+		Where("orders.status = ?", models.OrderStatusPending).
+		Where("payme_transactions.created_at < ? AND payme_transactions.created_at > ?", now.Add(-s.cfg.PaymentAge), now.Add(-s.cfg.MaxAge)).
+		Where("NOT EXISTS (SELECT 1 FROM reminders WHERE reminders.kind = ? AND reminders.subject_id = orders.id)", models.ReminderKindUnpaidPayment).
+		Scan(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, row := range rows {
+		link := fmt.Sprintf("%s/orders/%s", s.cfg.StorefrontURL, row.OrderID)
+		sms := fmt.Sprintf("Shafran: %s buyurtmangiz to'lovi kutilmoqda. To'lovni yakunlang: %s", row.OrderNumber, link)
+		admin := fmt.Sprintf("💳 <b>Неоплаченный заказ</b>\n\nЗаказ: #%s\nСумма: %s\nПровайдер: %s\nКлиент: %s\nТелефон: %s",
+			row.OrderNumber, FormatPrice(row.TotalAmount, row.Currency), row.Provider, row.FirstName, row.Phone)
+		if s.remind(models.ReminderKindUnpaidPayment, row.OrderID, row.UserID, row.Phone, sms, admin) {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// remind claims the reminder for the subject, delivers it and records the
+// outcome. Failed deliveries are recorded too and not retried.
+func (s *ReminderService) remind(kind string, subjectID, userID uuid.UUID, phone, smsText, adminText string) bool {
+	reminder := models.Reminder{
+		Kind:      kind,
+		SubjectID: subjectID,
+		UserID:    &userID,
+		Channel:   s.cfg.Channel,
+		Status:    models.ReminderStatusPending,
+	}
+	res := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reminder)
+	if res.Error != nil {
+		log.Printf("[Reminder] failed to record %s reminder for %s: %v", kind, subjectID, res.Error)
+		return false
+	}
+	if res.RowsAffected == 0 {
+		return false
+	}
+
+	var err error
+	switch s.cfg.Channel {
+	case ReminderChannelTelegram:
+		if s.telegram == nil {
+			err = errors.New("telegram is not configured")
+		} else {
+			err = s.telegram.SendToAdmin(adminText)
+		}
+	default:
+		if phone == "" {
+			err = errors.New("customer has no phone")
+		} else {
+			err = s.sms.Send(phone, smsText)
+		}
+	}
+
+	updates := map[string]any{"status": models.ReminderStatusSent}
+	if err != nil {
+		log.Printf("[Reminder] %s reminder for %s failed: %v", kind, subjectID, err)
+		updates = map[string]any{"status": models.ReminderStatusFailed, "error": err.Error()}
+	} else {
+		now := time.Now()
+		updates["sent_at"] = &now
+	}
+	if uerr := s.db.Model(&reminder).Updates(updates).Error; uerr != nil {
+		log.Printf("[Reminder] failed to update %s reminder for %s: %v", kind, subjectID, uerr)
+	}
+	return err == nil
+}
+
+// StartReminderWorker periodically sends due reminders in the background.
+func StartReminderWorker(s *ReminderService, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			sent, err := s.SendDue()
+			if err != nil {
+				log.Printf("[Reminder] reminder sweep failed: %v", err)
+				continue
+			}
+			if sent > 0 {
+				log.Printf("[Reminder] sent %d reminder(s)", sent)
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"math"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// RecomputeProductRating refreshes the product's RatingAverage and
+// RatingCount from its approved reviews.
+func RecomputeProductRating(tx *gorm.DB, productID uuid.UUID) error {
+	var agg struct {
+		Average float64
+		Count   int
+	}
+	if err := tx.Model(&models.ProductReview{}).
+		Select("COALESCE(AVG(rating), 0) AS average, COUNT(*) AS count").
+		Where("product_id = ? AND status = ?", productID, models.ReviewStatusApproved).
+		Scan(&agg).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&models.Product{}).
+		Where("id = ?", productID).
+		UpdateColumns(map[string]any{
+			"rating_average": math.Round(agg.Average*100) / 100,
+			"rating_count":   agg.Count,
+		}).Error
+}
+
+// HasDeliveredPurchase reports whether the user has received the product in
+// a delivered order.
+func HasDeliveredPurchase(tx *gorm.DB, userID, productID uuid.UUID) (bool, error) {
+	var count int64
+	err := tx.Model(&models.OrderItem{}).
+		Joins("JOIN orders ON orders.id = order_items.order_id").
+		Where("orders.user_id = ? AND orders.status = ? AND order_items.product_id = ?",
+			userID, models.OrderStatusDelivered, productID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// markVerifiedReviews flags the user's reviews of products in a delivered
+// order as verified purchases.
+func markVerifiedReviews(tx *gorm.DB, userID, orderID uuid.UUID) error {
+	return tx.Model(&models.ProductReview{}).
+		Where("user_id = ? AND is_verified_purchase = ?", userID, false).
+		Where("product_id IN (?)", tx.Model(&models.OrderItem{}).
+			Select("product_id").
+			Where("order_id = ? AND product_id IS NOT NULL", orderID)).
+		Update("is_verified_purchase", true).Error
+}
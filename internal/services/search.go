@@ -0,0 +1,358 @@
+package services
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// searchSimilarity is the minimum pg_trgm word similarity between the query
+// and a product's search key for a fuzzy match.
+const searchSimilarity = 0.4
+
+// cyrillicToLatin maps Russian and Uzbek Cyrillic letters to Uzbek Latin.
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo",
+	'ж': "j", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "x", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "sh", 'ъ': "",
+	'ы': "i", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'ў': "o", 'қ': "q", 'ғ': "g", 'ҳ': "h",
+}
+
+// phoneticFolds rewrites spellings that sound alike in brand names written
+// in Latin, Cyrillic or their transliterations. Where several entries match at
+// the same position the earlier one wins.
+var phoneticFolds = strings.NewReplacer(
+	"eau", "o",
+	"dzh", "j",
+	"zh", "j",
+	"dj", "j",
+	"kh", "h",
+	"ph", "f",
+	"ck", "k",
+	"au", "o",
+	"ou", "u",
+	"ge", "je",
+	"gi", "ji",
+	"ce", "se",
+	"ci", "si",
+	"cy", "si",
+	"ch", "ch", // keeps ch out of the c rule below
+	"c", "k",
+	"x", "h",
+	"q", "k",
+	"w", "v",
+	"y", "i",
+)
+
+// TransliterateToLatin lowercases s and writes Cyrillic letters in Uzbek
+// Latin. Apostrophes of o' and g' are dropped.
+func TransliterateToLatin(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if latin, ok := cyrillicToLatin[r]; ok {
+			b.WriteString(latin)
+			continue
+		}
+		switch r {
+		case '\'', '`', 'ʻ', 'ʼ', '‘', '’':
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// SearchTokens splits s into folded search words. Text and queries are
+// folded the same way so "диор саваж", "dior savaj" and "Dior Sauvage" all
+// produce comparable words.
+func SearchTokens(s string) []string {
+	words := strings.FieldsFunc(TransliterateToLatin(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if token := foldWord(word); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// FoldSearchText returns the folded words of s joined by spaces.
+func FoldSearchText(s string) string {
+	return strings.Join(SearchTokens(s), " ")
+}
+
+func foldWord(word string) string {
+	folded := []rune(phoneticFolds.Replace(word))
+
+	// Doubled letters are rarely heard and often mistyped.
+	out := folded[:0]
+	for i, r := range folded {
+		if i > 0 && r == folded[i-1] && unicode.IsLetter(r) {
+			continue
+		}
+		out = append(out, r)
+	}
+	// A silent final e (Sauvage, Dolce) is dropped from longer words.
+	if len(out) > 3 && out[len(out)-1] == 'e' {
+		out = out[:len(out)-1]
+	}
+	return string(out)
+}
+
+// ProductSearchQuery is a parsed product search.
+type ProductSearchQuery struct {
+	Raw     string
+	Folded  string
+	TSQuery string
+}
+
+// ParseProductSearch folds the query words and builds a prefix tsquery that
+// requires every word. It returns nil when nothing searchable is left.
+func ParseProductSearch(raw string) *ProductSearchQuery {
+	tokens := SearchTokens(raw)
+	if len(tokens) == 0 {
+		return nil
+	}
+	terms := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		terms = append(terms, token+":*")
+	}
+	return &ProductSearchQuery{
+		Raw:     raw,
+		Folded:  strings.Join(tokens, " "),
+		TSQuery: strings.Join(terms, " & "),
+	}
+}
+
+// Apply restricts query to products matching the search, either through the
+// full-text index or by trigram similarity of the brand and name.
+func (q *ProductSearchQuery) Apply(query *gorm.DB) *gorm.DB {
+	return query.Where(
+		"products.search_vector @@ to_tsquery('simple', ?) OR word_similarity(?, products.search_key) >= ?",
+		q.TSQuery, q.Folded, searchSimilarity,
+	)
+}
+
+// Rank orders query by relevance, best matches first.
+func (q *ProductSearchQuery) Rank(query *gorm.DB) *gorm.DB {
+	return query.Order(clause.OrderBy{Expression: clause.Expr{
+		SQL:                "ts_rank(products.search_vector, to_tsquery('simple', ?)) + word_similarity(?, products.search_key) DESC",
+		Vars:               []any{q.TSQuery, q.Folded},
+		WithoutParentheses: true,
+	}})
+}
+
+// Highlight marks the words of the product name and description that match
+// the query, tolerating transliteration and small typos.
+func (q *ProductSearchQuery) Highlight(product *models.Product) *models.ProductSearchHighlight {
+	tokens := strings.Fields(q.Folded)
+	snippet := product.ShortDescription
+	if snippet == "" {
+		snippet = product.LongDescription
+	}
+	return &models.ProductSearchHighlight{
+		Name:    highlightText(product.Name, tokens, 0),
+		Snippet: highlightText(snippet, tokens, 160),
+	}
+}
+
+// highlightText escapes text and wraps words matching any token in <mark>.
+// With a positive limit the text is cut to a window around the first match.
+func highlightText(text string, tokens []string, limit int) string {
+	runes := []rune(text)
+	type span struct{ start, end int }
+	var matches []span
+
+	start := -1
+	for i := 0; i <= len(runes); i++ {
+		inWord := i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+		if inWord && start < 0 {
+			start = i
+		}
+		if !inWord && start >= 0 {
+			if matchesToken(foldWord(TransliterateToLatin(string(runes[start:i]))), tokens) {
+				matches = append(matches, span{start, i})
+			}
+			start = -1
+		}
+	}
+
+	from, to := 0, len(runes)
+	if limit > 0 && len(runes) > limit {
+		if len(matches) > 0 && matches[0].start > limit/3 {
+			from = matches[0].start - limit/3
+			for from > 0 && !unicode.IsSpace(runes[from-1]) {
+				from--
+			}
+		}
+		to = from + limit
+		if to > len(runes) {
+			to = len(runes)
+		}
+		for to < len(runes) && !unicode.IsSpace(runes[to]) {
+			to++
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, m := range matches {
+		if m.start < from || m.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:m.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[m.start:m.end])))
+		b.WriteString("</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:to])))
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// matchesToken reports whether a folded word matches a query token by prefix
+// or within a small edit distance.
+func matchesToken(word string, tokens []string) bool {
+	if word == "" {
+		return false
+	}
+	for _, token := range tokens {
+		if strings.HasPrefix(word, token) {
+			return true
+		}
+		allowed := 1
+		if len([]rune(token)) >= 7 {
+			allowed = 2
+		}
+		if len([]rune(token)) >= 4 && editDistance(word, token) <= allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// RefreshProductSearch rebuilds the search columns of the given products from
+// their names, brand, category, notes and specifications.
+func RefreshProductSearch(db *gorm.DB, productIDs ...uuid.UUID) error {
+	if len(productIDs) == 0 {
+		return nil
+	}
+
+	var products []models.Product
+	if err := db.Preload("Brand").
+		Preload("Category").
+		Preload("Specifications").
+		Preload("FragranceNotes").
+		Where("id IN ?", productIDs).
+		Find(&products).Error; err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		key, document := productSearchText(product)
+		if err := db.Model(&models.Product{}).
+			Where("id = ?", product.ID).
+			UpdateColumns(map[string]any{
+				"search_key":      key,
+				"search_document": document,
+			}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefreshBrandProductSearch rebuilds the search columns of a brand's products.
+func RefreshBrandProductSearch(db *gorm.DB, brandID uuid.UUID) error {
+	var ids []uuid.UUID
+	if err := db.Model(&models.Product{}).Where("brand_id = ?", brandID).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	return RefreshProductSearch(db, ids...)
+}
+
+// BackfillProductSearch fills the search columns of products that were
+// stored before search was introduced.
+func BackfillProductSearch(db *gorm.DB) {
+	var ids []uuid.UUID
+	if err := db.Model(&models.Product{}).Where("search_key = ''").Pluck("id", &ids).Error; err != nil {
+		log.Printf("[Search] backfill lookup failed: %v", err)
+		return
+	}
+	for start := 0; start < len(ids); start += 100 {
+		end := min(start+100, len(ids))
+		if err := RefreshProductSearch(db, ids[start:end]...); err != nil {
+			log.Printf("[Search] backfill failed: %v", err)
+			return
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("[Search] indexed %d product(s)", len(ids))
+	}
+}
+
+func productSearchText(product models.Product) (string, string) {
+	var brand string
+	if product.Brand != nil {
+		brand = product.Brand.Name
+	}
+	key := FoldSearchText(fmt.Sprintf("%s %s", brand, product.Name))
+
+	parts := []string{
+		product.Manufacturer,
+		product.ShortDescription,
+		product.FragranceFamily,
+		product.FragranceGroup,
+		product.CompositionNotes,
+	}
+	if product.Category != nil {
+		parts = append(parts, product.Category.Name)
+	}
+	for _, note := range product.FragranceNotes {
+		parts = append(parts, note.Name)
+	}
+	for _, spec := range product.Specifications {
+		parts = append(parts, spec.Label, spec.Value)
+	}
+	return key, FoldSearchText(strings.Join(parts, " "))
+}
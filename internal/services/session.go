@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+	"github.com/example/shafran/internal/utils"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// SessionConfig holds token signing settings.
+type SessionConfig struct {
+	Secret     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// SessionTokens is the token pair returned to a client after sign-in or
+// refresh.
+type SessionTokens struct {
+	SessionID        uuid.UUID `json:"session_id"`
+	AccessToken      string    `json:"token"`
+	ExpiresIn        int       `json:"expires_in"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// SessionService issues, rotates and revokes user sessions.
+type SessionService struct {
+	db  *gorm.DB
+	cfg SessionConfig
+}
+
+func NewSessionService(db *gorm.DB, cfg SessionConfig) *SessionService {
+	if cfg.AccessTTL <= 0 {
+		cfg.AccessTTL = 15 * time.Minute
+	}
+	if cfg.RefreshTTL <= 0 {
+		cfg.RefreshTTL = 30 * 24 * time.Hour
+	}
+	return &SessionService{db: db, cfg: cfg}
+}
+
+// Issue starts a new session for the user.
+func (s *SessionService) Issue(ctx context.Context, user *models.User, userAgent, ip string) (*SessionTokens, error) {
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := models.UserSession{
+		UserID:           user.ID,
+		RefreshTokenHash: utils.HashToken(refreshToken),
+		UserAgent:        userAgent,
+		IP:               ip,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(s.cfg.RefreshTTL),
+	}
+	if err := s.db.WithContext(ctx).Create(&session).Error; err != nil {
+		return nil, err
+	}
+
+	return s.tokens(user, &session, refreshToken)
+}
+
+// Refresh rotates the refresh token and issues a new access token. Presenting
+// an already rotated refresh token revokes the whole session, since it means
+// the token was copied.
+func (s *SessionService) Refresh(ctx context.Context, refreshToken, userAgent, ip string) (*SessionTokens, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	hash := utils.HashToken(refreshToken)
+
+	var result *SessionTokens
+	var notFound bool
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var session models.UserSession
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("refresh_token_hash = ?", hash).
+			First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			notFound = true
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+			return ErrInvalidRefreshToken
+		}
+
+		var user models.User
+		if err := tx.First(&user, "id = ?", session.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return err
+		}
+
+		newToken, err := utils.GenerateRefreshToken()
+		if err != nil {
+			return err
+		}
+		session.PreviousRefreshTokenHash = hash
+		session.RefreshTokenHash = utils.HashToken(newToken)
+		session.UserAgent = userAgent
+		session.IP = ip
+		session.LastUsedAt = now
+		session.ExpiresAt = now.Add(s.cfg.RefreshTTL)
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+
+		result, err = s.tokens(&user, &session, newToken)
+		return err
+	})
+	if notFound {
+		res := s.db.WithContext(ctx).Model(&models.UserSession{}).
+			Where("previous_refresh_token_hash = ? AND revoked_at IS NULL", hash).
+			Update("revoked_at", time.Now())
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.RowsAffected > 0 {
+			return nil, ErrRefreshTokenReused
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// IsActive reports whether the session exists, belongs to the user and has
+// not been revoked or expired.
+func (s *SessionService) IsActive(ctx context.Context, userID, sessionID uuid.UUID) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&models.UserSession{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, userID, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// List returns the user's active sessions, most recently used first.
+func (s *SessionService) List(ctx context.Context, userID uuid.UUID) ([]models.UserSession, error) {
+	var sessions []models.UserSession
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at desc").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke ends one of the user's sessions.
+func (s *SessionService) Revoke(ctx context.Context, userID, sessionID uuid.UUID) error {
+	res := s.db.WithContext(ctx).Model(&models.UserSession{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeByRefreshToken ends the session owning the refresh token.
+func (s *SessionService) RevokeByRefreshToken(ctx context.Context, refreshToken string) error {
+	res := s.db.WithContext(ctx).Model(&models.UserSession{}).
+		Where("refresh_token_hash = ? AND revoked_at IS NULL", utils.HashToken(refreshToken)).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every session of the user except the given one, which may be
+// uuid.Nil.
+func (s *SessionService) RevokeAll(ctx context.Context, userID, except uuid.UUID) (int64, error) {
+	res := s.db.WithContext(ctx).Model(&models.UserSession{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, except).
+		Update("revoked_at", time.Now())
+	return res.RowsAffected, res.Error
+}
+
+func (s *SessionService) tokens(user *models.User, session *models.UserSession, refreshToken string) (*SessionTokens, error) {
+	accessToken, err := utils.GenerateToken(s.cfg.Secret, user.ID, user.Role, session.ID, s.cfg.AccessTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{
+		SessionID:        session.ID,
+		AccessToken:      accessToken,
+		ExpiresIn:        int(s.cfg.AccessTTL / time.Second),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	}, nil
+}
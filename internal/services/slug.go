@@ -0,0 +1,152 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/example/shafran/internal/models"
+)
+
+// accentFolds strips the accents common in perfume names.
+var accentFolds = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ò", "o", "ó", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n", "ß", "ss", "æ", "ae", "œ", "oe",
+)
+
+// slugModels maps slug kinds to the tables holding the live slugs.
+var slugModels = map[string]func() any{
+	models.SlugKindProduct:  func() any { return &models.Product{} },
+	models.SlugKindCategory: func() any { return &models.Category{} },
+	models.SlugKindBrand:    func() any { return &models.Brand{} },
+}
+
+// Slugify turns s into a lowercase, dash separated URL segment. Cyrillic is
+// transliterated to Uzbek Latin.
+func Slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range accentFolds.Replace(TransliterateToLatin(s)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// UniqueSlug builds a slug from requested, or from name when requested is
+// empty, and appends a number until no other entity of the kind uses it now
+// or used it before.
+func UniqueSlug(db *gorm.DB, kind, requested, name string, id uuid.UUID) (string, error) {
+	newModel, ok := slugModels[kind]
+	if !ok {
+		return "", fmt.Errorf("unknown slug kind %q", kind)
+	}
+
+	base := Slugify(requested)
+	if base == "" {
+		base = Slugify(name)
+	}
+	if base == "" {
+		base = kind
+	}
+
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+
+		var live, former int64
+		if err := db.Model(newModel()).Where("slug = ? AND id <> ?", candidate, id).Count(&live).Error; err != nil {
+			return "", err
+		}
+		if err := db.Model(&models.SlugRedirect{}).
+			Where("entity_type = ? AND old_slug = ? AND entity_id <> ?", kind, candidate, id).
+			Count(&former).Error; err != nil {
+			return "", err
+		}
+		if live == 0 && former == 0 {
+			return candidate, nil
+		}
+	}
+}
+
+// RecordSlugChange keeps the old slug of an entity as a redirect to it. A
+// slug that becomes live again stops being a redirect.
+func RecordSlugChange(tx *gorm.DB, kind string, id uuid.UUID, oldSlug, newSlug string) error {
+	if oldSlug == newSlug {
+		return nil
+	}
+	if err := tx.Where("entity_type = ? AND old_slug = ?", kind, newSlug).
+		Delete(&models.SlugRedirect{}).Error; err != nil {
+		return err
+	}
+	if oldSlug == "" {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "entity_type"}, {Name: "old_slug"}},
+		DoUpdates: clause.AssignmentColumns([]string{"entity_id", "updated_at"}),
+	}).Create(&models.SlugRedirect{EntityType: kind, OldSlug: oldSlug, EntityID: id}).Error
+}
+
+// ResolveSlugRedirect returns the entity a former slug belonged to.
+func ResolveSlugRedirect(db *gorm.DB, kind, slug string) (uuid.UUID, bool, error) {
+	var redirect models.SlugRedirect
+	err := db.Where("entity_type = ? AND old_slug = ?", kind, slug).First(&redirect).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return uuid.Nil, false, nil
+	}
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	return redirect.EntityID, true, nil
+}
+
+// BackfillSlugs gives a slug to products, categories and brands stored
+// without one.
+func BackfillSlugs(db *gorm.DB) {
+	type sluggable struct {
+		ID   uuid.UUID
+		Name string
+	}
+
+	for _, kind := range []string{models.SlugKindProduct, models.SlugKindCategory, models.SlugKindBrand} {
+		var rows []sluggable
+		if err := db.Model(slugModels[kind]()).
+			Select("id", "name").
+			Where("slug IS NULL OR slug = ''").
+			Find(&rows).Error; err != nil {
+			log.Printf("[Slug] %s backfill lookup failed: %v", kind, err)
+			continue
+		}
+		for _, row := range rows {
+			slug, err := UniqueSlug(db, kind, "", row.Name, row.ID)
+			if err == nil {
+				err = db.Model(slugModels[kind]()).Where("id = ?", row.ID).UpdateColumn("slug", slug).Error
+			}
+			if err != nil {
+				log.Printf("[Slug] failed to backfill %s %s: %v", kind, row.ID, err)
+			}
+		}
+		if len(rows) > 0 {
+			log.Printf("[Slug] generated %d %s slug(s)", len(rows), kind)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMS providers selectable with SMS_PROVIDER.
+const (
+	SMSProviderPlum  = "plum"
+	SMSProviderEskiz = "eskiz"
+	SMSProviderLog   = "log"
+)
+
+// SMSSender delivers text messages to a phone number.
+type SMSSender interface {
+	Name() string
+	Send(phone, message string) error
+}
+
+// SMSConfig selects and configures the SMS provider.
+type SMSConfig struct {
+	Provider      string
+	EskizBaseURL  string
+	EskizEmail    string
+	EskizPassword string
+	EskizFrom     string
+	LogFile       string
+}
+
+// NewSMSSender returns the sender for the configured provider. Without an
+// explicit provider Plum is used when enabled. Messages are only logged when
+// the log provider is chosen explicitly, so a missing or mistyped provider
+// fails instead of silently dropping codes.
+func NewSMSSender(cfg SMSConfig) (SMSSender, error) {
+	provider := strings.ToLower(strings.TrimSpace(cfg.Provider))
+	if provider == "" {
+		if !LoadPlumConfig().Enabled {
+			return nil, fmt.Errorf("no SMS provider configured: set SMS_PROVIDER to %s, %s or %s", SMSProviderPlum, SMSProviderEskiz, SMSProviderLog)
+		}
+		provider = SMSProviderPlum
+	}
+
+	switch provider {
+	case SMSProviderPlum:
+		return PlumSMSSender{}, nil
+	case SMSProviderEskiz:
+		return NewEskizSMSSender(cfg), nil
+	case SMSProviderLog:
+		log.Printf("[SMS] using the log sender; messages are not delivered")
+		return LogSMSSender{Path: cfg.LogFile}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", cfg.Provider)
+	}
+}
+
+// OTP message purposes.
+const (
+	OTPPurposeVerification  = "verification"
+	OTPPurposePasswordReset = "password_reset"
+)
+
+// OTPMessage renders the SMS text for a one-time code.
+func OTPMessage(purpose, code string) string {
+	if purpose == OTPPurposePasswordReset {
+		return fmt.Sprintf("Shafran: parolni tiklash kodi %s. Kodni hech kimga bermang.", code)
+	}
+	return fmt.Sprintf("Shafran: tasdiqlash kodi %s. Kodni hech kimga bermang.", code)
+}
+
+// PlumSMSSender sends messages through the Plum API.
+type PlumSMSSender struct{}
+
+func (PlumSMSSender) Name() string { return SMSProviderPlum }
+
+func (PlumSMSSender) Send(phone, message string) error {
+	return PlumSendSMS(phone, message)
+}
+
+// LogSMSSender writes messages to the log, and to a file when Path is set.
+// It is meant for local development only.
+type LogSMSSender struct {
+	Path string
+}
+
+var logSMSMu sync.Mutex
+
+func (LogSMSSender) Name() string { return SMSProviderLog }
+
+func (s LogSMSSender) Send(phone, message string) error {
+	log.Printf("[SMS] to %s: %s", phone, message)
+	if s.Path == "" {
+		return nil
+	}
+
+	logSMSMu.Lock()
+	defer logSMSMu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("sms log file: %w", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), phone, message)
+	return err
+}
+
+// EskizSMSSender sends messages through the Eskiz.uz API.
+type EskizSMSSender struct {
+	baseURL  string
+	email    string
+	password string
+	from     string
+	client   *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewEskizSMSSender(cfg SMSConfig) *EskizSMSSender {
+	baseURL := strings.TrimRight(cfg.EskizBaseURL, "/")
+	if baseURL == "" {
+		baseURL = "https://notify.eskiz.uz/api"
+	}
+	return &EskizSMSSender{
+		baseURL:  baseURL,
+		email:    cfg.EskizEmail,
+		password: cfg.EskizPassword,
+		from:     cfg.EskizFrom,
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *EskizSMSSender) Name() string { return SMSProviderEskiz }
+
+func (s *EskizSMSSender) Send(phone, message string) error {
+	form := url.Values{}
+	form.Set("mobile_phone", normalizeEskizPhone(phone))
+	form.Set("message", message)
+	if s.from != "" {
+		form.Set("from", s.from)
+	}
+
+	status, body, err := s.post("/message/sms/send", form, false)
+	if err != nil {
+		return err
+	}
+	// Tokens live for a month; refresh once when Eskiz rejects one early.
+	if status == http.StatusUnauthorized {
+		status, body, err = s.post("/message/sms/send", form, true)
+		if err != nil {
+			return err
+		}
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("eskiz send sms: status %d, body: %s", status, string(body))
+	}
+	return nil
+}
+
+func (s *EskizSMSSender) post(path string, form url.Values, refresh bool) (int, []byte, error) {
+	token, err := s.getToken(refresh)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, nil, fmt.Errorf("eskiz request build: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("eskiz request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, body, nil
+}
+
+func (s *EskizSMSSender) getToken(force bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !force && s.token != "" && time.Now().Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+	if s.email == "" || s.password == "" {
+		return "", errors.New("eskiz credentials are not configured")
+	}
+
+	form := url.Values{}
+	form.Set("email", s.email)
+	form.Set("password", s.password)
+
+	resp, err := s.client.PostForm(s.baseURL+"/auth/login", form)
+	if err != nil {
+		return "", fmt.Errorf("eskiz auth request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("eskiz auth failed: status %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var authResp struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &authResp); err != nil {
+		return "", fmt.Errorf("eskiz auth unmarshal: %w", err)
+	}
+	if authResp.Data.Token == "" {
+		return "", errors.New("eskiz auth: empty token")
+	}
+
+	s.token = authResp.Data.Token
+	s.tokenExpiry = time.Now().Add(24 * time.Hour)
+	return s.token, nil
+}
+
+// normalizeEskizPhone strips everything but digits; Eskiz expects 998XXXXXXXXX.
+func normalizeEskizPhone(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
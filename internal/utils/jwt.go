@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -8,14 +11,26 @@ import (
 )
 
 type jwtCustomClaims struct {
-	UserID string `json:"user_id"`
+	UserID    string `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a signed JWT for the provided user ID.
-func GenerateToken(secret string, userID uuid.UUID, ttl time.Duration) (string, error) {
+// TokenClaims holds the identity extracted from a validated JWT.
+type TokenClaims struct {
+	UserID    uuid.UUID
+	Role      string
+	SessionID uuid.UUID
+}
+
+// GenerateToken creates a signed access token for the provided user, role and
+// session.
+func GenerateToken(secret string, userID uuid.UUID, role string, sessionID uuid.UUID, ttl time.Duration) (string, error) {
 	claims := &jwtCustomClaims{
-		UserID: userID.String(),
+		UserID:    userID.String(),
+		Role:      role,
+		SessionID: sessionID.String(),
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   userID.String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
@@ -27,19 +42,42 @@ func GenerateToken(secret string, userID uuid.UUID, ttl time.Duration) (string,
 	return token.SignedString([]byte(secret))
 }
 
-// ParseToken validates the token and returns the embedded user ID.
-func ParseToken(secret, tokenString string) (uuid.UUID, error) {
+// ParseToken validates the token and returns the embedded claims.
+func ParseToken(secret, tokenString string) (*TokenClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &jwtCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(secret), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*jwtCustomClaims); ok && token.Valid {
-		return uuid.Parse(claims.UserID)
+		userID, err := uuid.Parse(claims.UserID)
+		if err != nil {
+			return nil, err
+		}
+		sessionID, err := uuid.Parse(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		return &TokenClaims{UserID: userID, Role: claims.Role, SessionID: sessionID}, nil
 	}
 
-	return uuid.Nil, jwt.ErrTokenInvalidClaims
+	return nil, jwt.ErrTokenInvalidClaims
+}
+
+// GenerateRefreshToken returns a random opaque refresh token.
+func GenerateRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
+// HashToken returns the SHA-256 hex digest under which a refresh token is
+// stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}